@@ -0,0 +1,472 @@
+package main
+
+import (
+	"fmt"
+	"github.com/pelletier/go-toml"
+	"logger"
+	"mongoDB"
+	"sort"
+	"ssh"
+	"strings"
+	"sync"
+	"time"
+)
+
+// alertKey 告警规则引擎的观察者和保持连接使用的 key
+const alertKey = "alert"
+
+// alertOperators 规则支持的比较
+var alertOperators = map[string]func(v, threshold float64) bool{
+	">":  func(v, threshold float64) bool { return v > threshold },
+	">=": func(v, threshold float64) bool { return v >= threshold },
+	"<":  func(v, threshold float64) bool { return v < threshold },
+	"<=": func(v, threshold float64) bool { return v <= threshold },
+}
+
+// alertTarget 一个用户保存的 ssh, 多个用户可以保存同一台主机
+type alertTarget struct {
+	key      string
+	username string
+	groups   []string
+}
+
+// alertState 一条规则在一个 ssh 的一个序列上的状态
+type alertState struct {
+	rule   mongoDB.AlertRule
+	host   string
+	labels map[string]string
+	value  float64
+	// pending 开始满足条件的时间, 满足 For 后触发
+	pending   time.Time
+	firing    bool
+	startTime time.Time
+	// seen 最近一次收到数据的时间
+	seen time.Time
+}
+
+// alertEngine 作为观察者用每条消息判断用户的告警规则, 触发和恢复时写入告警历史
+type alertEngine struct {
+	mutex sync.Mutex
+	// rules 按用户名保存开启的规则
+	rules map[string][]mongoDB.AlertRule
+	// targets 按 user@host:port 保存对应的已保存的 ssh
+	targets map[string][]alertTarget
+	states  map[string]*alertState
+	// raised 其他模块判断的正在触发的告警, 例如主机不可达, 按 RuleId 和 Host 保存
+	raised map[string]mongoDB.Alert
+	events []string
+	// stale 超过这么久没有数据的序列视为恢复
+	stale  time.Duration
+	alerts chan mongoDB.Alert
+	// handlers 写入告警历史后依次调用, 例如发送通知
+	handlers     []func(a mongoDB.Alert)
+	scanInterval time.Duration
+	intervals    map[string]int
+}
+
+var alerts *alertEngine
+
+// startAlert 按 conf.toml 的 [alert] 准备告警规则引擎, 返回 nil 时不提供告警接口,
+// 其他模块注册处理函数后调用 start 开始判断
+func startAlert(conf *toml.Tree) *alertEngine {
+	if !conf.GetDefault("alert.Enable", false).(bool) {
+		return nil
+	}
+	e := &alertEngine{
+		rules:   make(map[string][]mongoDB.AlertRule),
+		targets: make(map[string][]alertTarget),
+		states:  make(map[string]*alertState),
+		raised:  make(map[string]mongoDB.Alert),
+		events:  confEvents(conf, "alert.Events", []string{"cpuPerformance", "memoryPerformance", "loadavg", "netDev", "netStat", "temp", "disk", "uptime"}),
+		stale:   time.Duration(conf.GetDefault("alert.Stale", int64(300)).(int64)) * time.Second,
+		alerts:  make(chan mongoDB.Alert, 1024),
+	}
+	e.scanInterval = time.Duration(conf.GetDefault("alert.ScanInterval", int64(60)).(int64)) * time.Second
+	if e.stale <= 0 || e.scanInterval <= 0 {
+		logger.L.Fatalf("alert.Stale and ScanInterval must be positive")
+	}
+	interval := int(conf.GetDefault("alert.Interval", int64(0)).(int64))
+	e.intervals = make(map[string]int)
+	for _, event := range e.events {
+		e.intervals[event] = interval
+	}
+	return e
+}
+
+// start 在通知等处理函数注册之后调用, 重启时恢复或直接恢复的告警也会交给它们
+func (e *alertEngine) start() {
+	go e.write()
+	if err := e.reloadRules(); err != nil {
+		logger.L.Warnf("alert load rules fail : %v", err)
+	} else {
+		e.resume()
+	}
+	ssh.M.AddObserver(alertKey, func(port int, host, user string) ssh.AllListener {
+		key := ssh.GeneralKey(port, host, user)
+		return ssh.NewAllListener(e.events, func(event string, message interface{}) {
+			e.evaluate(key, event, ssh.Points(message))
+		}, e.intervals)
+	})
+	go e.scan(e.scanInterval)
+	logger.L.Infof("evaluate alert rules on %v", e.events)
+}
+
+// watches 规则的字段所属的事件是否在 [alert.Events] 中
+func (e *alertEngine) watches(event string) bool {
+	for _, v := range e.events {
+		if v == event {
+			return true
+		}
+	}
+	return false
+}
+
+// scan 定时重新读取规则和保存的 ssh, 保持与有规则作用的 ssh 的连接, 并恢复没有数据的序列
+func (e *alertEngine) scan(scanInterval time.Duration) {
+	pinned := make(map[string]ssh.Message)
+	for ; ; time.Sleep(scanInterval) {
+		if err := e.reloadRules(); err != nil {
+			logger.L.Warnf("alert load rules fail : %v", err)
+		}
+		userSSH, err := mongoDB.Client.SelectAllUserSSH()
+		if err != nil {
+			logger.L.Warnf("alert scan saved ssh fail : %v", err)
+			if userSSH == nil {
+				continue
+			}
+		}
+		targets := make(map[string][]alertTarget)
+		for _, u := range userSSH {
+			key := ssh.GeneralKey(u.Port, u.Host, u.User)
+			targets[key] = append(targets[key], alertTarget{key: u.Key, username: u.UserName, groups: u.Groups})
+		}
+		e.mutex.Lock()
+		e.targets = targets
+		watched := make([]mongoDB.UserSSH, 0)
+		for _, u := range userSSH {
+			for _, r := range e.rules[u.UserName] {
+				if ruleApplies(r, alertTarget{key: u.Key, username: u.UserName, groups: u.Groups}) {
+					watched = append(watched, u)
+					break
+				}
+			}
+		}
+		e.mutex.Unlock()
+		pinUserSSH(alertKey, pinned, watched)
+		e.sweep(time.Now())
+	}
+}
+
+// reloadRules 规则增删改后调用, 关闭和删除的规则正在触发的告警随之恢复
+func (e *alertEngine) reloadRules() error {
+	all, err := mongoDB.Client.SelectAlertRule("")
+	if err != nil {
+		return err
+	}
+	rules := make(map[string][]mongoDB.AlertRule)
+	enabled := make(map[string]bool)
+	for _, r := range all {
+		if r.Enable {
+			rules[r.UserName] = append(rules[r.UserName], r)
+			enabled[r.Id] = true
+		}
+	}
+	now := time.Now()
+	e.mutex.Lock()
+	e.rules = rules
+	resolved := make([]mongoDB.Alert, 0)
+	for key, s := range e.states {
+		if enabled[s.rule.Id] {
+			continue
+		}
+		if s.firing {
+			resolved = append(resolved, s.alert(mongoDB.AlertResolved, now, "rule disabled or deleted"))
+		}
+		delete(e.states, key)
+	}
+	e.mutex.Unlock()
+	e.emit(resolved)
+	return nil
+}
+
+// resume 从告警历史恢复重启前正在触发的告警, 不重复触发, 恢复时保留原来的 StartTime;
+// 期间关闭或删除的规则直接恢复, 没有数据的序列超过 Stale 后恢复. 主机不可达告警由探测自己恢复
+func (e *alertEngine) resume() {
+	firing, err := mongoDB.Client.SelectFiringAlert()
+	if err != nil {
+		logger.L.Warnf("alert resume firing alerts fail : %v", err)
+		return
+	}
+	now := time.Now()
+	resumed := 0
+	resolved := make([]mongoDB.Alert, 0)
+	e.mutex.Lock()
+	enabled := make(map[string]mongoDB.AlertRule)
+	for _, rules := range e.rules {
+		for _, r := range rules {
+			enabled[r.Id] = r
+		}
+	}
+	for _, a := range firing {
+		if a.RuleId == probeRuleId {
+			continue
+		}
+		s := &alertState{
+			host:      a.Host,
+			labels:    a.Labels,
+			value:     a.Value,
+			firing:    true,
+			startTime: a.StartTime,
+			seen:      now,
+		}
+		r, ok := enabled[a.RuleId]
+		if !ok {
+			s.rule = mongoDB.AlertRule{
+				Id:        a.RuleId,
+				UserName:  a.UserName,
+				Name:      a.RuleName,
+				Metric:    a.Metric,
+				Operator:  a.Operator,
+				Threshold: a.Threshold,
+				Severity:  a.Severity,
+			}
+			resolved = append(resolved, s.alert(mongoDB.AlertResolved, now, "rule disabled or deleted"))
+			continue
+		}
+		s.rule = r
+		e.states[r.Id+"\x00"+a.Host+"\x00"+labelsKey(a.Labels)] = s
+		resumed++
+	}
+	e.mutex.Unlock()
+	logger.L.Infof("alert resume %d firing alerts", resumed)
+	e.emit(resolved)
+}
+
+func ruleApplies(r mongoDB.AlertRule, t alertTarget) bool {
+	if r.UserName != t.username {
+		return false
+	}
+	if len(r.Hosts) > 0 && !contains(r.Hosts, t.key) {
+		return false
+	}
+	return r.Group == "" || contains(t.groups, r.Group)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func labelsMatch(labels map[string]string, want map[string]string) bool {
+	for k, v := range want {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// evaluate 用 host 的一条消息判断所有保存了它的用户的规则
+func (e *alertEngine) evaluate(host string, event string, points []ssh.Point) {
+	if len(points) == 0 {
+		return
+	}
+	now := time.Now()
+	changed := make([]mongoDB.Alert, 0)
+	e.mutex.Lock()
+	for _, t := range e.targets[host] {
+		for _, r := range e.rules[t.username] {
+			if ruleEvent, _ := ssh.PointEvent(r.Metric); ruleEvent != event || !ruleApplies(r, t) {
+				continue
+			}
+			for _, p := range points {
+				if p.Name != r.Metric || !labelsMatch(p.Labels, r.Labels) {
+					continue
+				}
+				if a, ok := e.step(r, t.key, p, now); ok {
+					changed = append(changed, a)
+				}
+			}
+		}
+	}
+	e.mutex.Unlock()
+	e.emit(changed)
+}
+
+// step 更新一个序列的状态, 触发或恢复时返回告警, 调用者持有锁
+func (e *alertEngine) step(r mongoDB.AlertRule, host string, p ssh.Point, now time.Time) (mongoDB.Alert, bool) {
+	key := r.Id + "\x00" + host + "\x00" + labelsKey(p.Labels)
+	s, ok := e.states[key]
+	if !ok {
+		s = &alertState{host: host, labels: p.Labels}
+		e.states[key] = s
+	}
+	s.rule = r
+	s.value = p.Value
+	s.seen = now
+	compare := alertOperators[r.Operator]
+	if compare == nil {
+		return mongoDB.Alert{}, false
+	}
+	if !s.firing {
+		if !compare(p.Value, r.Threshold) {
+			s.pending = time.Time{}
+			return mongoDB.Alert{}, false
+		}
+		if s.pending.IsZero() {
+			s.pending = now
+		}
+		if now.Sub(s.pending) < time.Duration(r.For)*time.Second {
+			return mongoDB.Alert{}, false
+		}
+		s.firing = true
+		s.startTime = now
+		return s.alert(mongoDB.AlertFiring, now, ""), true
+	}
+	// 恢复的阈值向另一侧移动 Hysteresis, 例如 > 90 且 Hysteresis 为 5 时降到 85 以下才恢复
+	recovery := r.Threshold - r.Hysteresis
+	if strings.HasPrefix(r.Operator, "<") {
+		recovery = r.Threshold + r.Hysteresis
+	}
+	if compare(p.Value, recovery) {
+		return mongoDB.Alert{}, false
+	}
+	s.firing = false
+	s.pending = time.Time{}
+	return s.alert(mongoDB.AlertResolved, now, ""), true
+}
+
+// sweep 超过 Stale 没有数据的序列不再保留, 正在触发的视为恢复
+func (e *alertEngine) sweep(now time.Time) {
+	resolved := make([]mongoDB.Alert, 0)
+	e.mutex.Lock()
+	for key, s := range e.states {
+		if now.Sub(s.seen) <= e.stale {
+			continue
+		}
+		if s.firing {
+			resolved = append(resolved, s.alert(mongoDB.AlertResolved, now, "no data"))
+		}
+		delete(e.states, key)
+	}
+	e.mutex.Unlock()
+	e.emit(resolved)
+}
+
+func (s *alertState) alert(state string, now time.Time, reason string) mongoDB.Alert {
+	message := fmt.Sprintf("%s%s = %g %s %g", s.rule.Metric, formatLabels(s.labels), s.value, s.rule.Operator, s.rule.Threshold)
+	if state == mongoDB.AlertResolved {
+		message = fmt.Sprintf("%s%s = %g, resolved", s.rule.Metric, formatLabels(s.labels), s.value)
+	}
+	if reason != "" {
+		message += " : " + reason
+	}
+	return mongoDB.Alert{
+		RuleId:    s.rule.Id,
+		RuleName:  s.rule.Name,
+		UserName:  s.rule.UserName,
+		Host:      s.host,
+		Metric:    s.rule.Metric,
+		Labels:    s.labels,
+		Operator:  s.rule.Operator,
+		Threshold: s.rule.Threshold,
+		Severity:  s.rule.Severity,
+		State:     state,
+		Value:     s.value,
+		StartTime: s.startTime,
+		Time:      now,
+		Message:   message,
+	}
+}
+
+// formatLabels 把 labels 写成 {mount="/"}
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(labels))
+	for _, k := range sortedKeys(labels) {
+		parts = append(parts, fmt.Sprintf("%s=%q", k, labels[k]))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// active 用户正在触发的告警, 按开始时间排序
+func (e *alertEngine) active(username string) []mongoDB.Alert {
+	now := time.Now()
+	r := make([]mongoDB.Alert, 0)
+	e.mutex.Lock()
+	for _, s := range e.states {
+		if s.firing && s.rule.UserName == username {
+			r = append(r, s.alert(mongoDB.AlertFiring, now, ""))
+		}
+	}
+	for _, a := range e.raised {
+		if a.UserName == username {
+			r = append(r, a)
+		}
+	}
+	e.mutex.Unlock()
+	sort.Slice(r, func(i, j int) bool { return r[i].StartTime.Before(r[j].StartTime) })
+	return r
+}
+
+// emit 不阻塞采集循环, 写入跟不上时丢弃
+func (e *alertEngine) emit(changed []mongoDB.Alert) {
+	for _, a := range changed {
+		select {
+		case e.alerts <- a:
+		default:
+			logger.L.Warnf("alert queue full, drop %s %s on %s", a.State, a.RuleName, a.Host)
+		}
+	}
+}
+
+// raise 触发或恢复其他模块判断的告警, 与当前状态相同时忽略
+func (e *alertEngine) raise(a mongoDB.Alert) {
+	key := a.RuleId + "\x00" + a.Host
+	e.mutex.Lock()
+	_, firing := e.raised[key]
+	if a.State == mongoDB.AlertFiring {
+		e.raised[key] = a
+	} else {
+		delete(e.raised, key)
+	}
+	e.mutex.Unlock()
+	if firing != (a.State == mongoDB.AlertFiring) {
+		e.emit([]mongoDB.Alert{a})
+	}
+}
+
+// restore 重启后恢复重启前已经触发的告警, 不再写入历史和通知
+func (e *alertEngine) restore(a mongoDB.Alert) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.raised[a.RuleId+"\x00"+a.Host] = a
+}
+
+// onAlert 注册告警触发和恢复时的处理函数
+func (e *alertEngine) onAlert(handler func(a mongoDB.Alert)) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.handlers = append(e.handlers, handler)
+}
+
+func (e *alertEngine) write() {
+	for a := range e.alerts {
+		logger.L.Infof("alert %s %s %s on %s : %s", a.Severity, a.State, a.RuleName, a.Host, a.Message)
+		if err := mongoDB.Client.InsertAlert(a); err != nil {
+			logger.L.Warnf("record alert fail : %v", err)
+		}
+		e.mutex.Lock()
+		handlers := e.handlers
+		e.mutex.Unlock()
+		for _, handler := range handlers {
+			handler(a)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	mapSet "github.com/deckarep/golang-set/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"logger"
+	"mongoDB"
+	"net/http"
+	"ssh"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type AlertRuleRequest struct {
+	Name string `json:"name" validate:"required"`
+	// Metric 字段名, 例如 CPUPerformanceTotal.Utilization, 所属事件需要在 [alert.Events] 中
+	Metric    string   `json:"metric" validate:"required"`
+	Operator  string   `json:"operator" validate:"required"`
+	Threshold *float64 `json:"threshold" validate:"required"`
+	// For 持续满足条件的秒数
+	For        int64   `json:"for" validate:"min=0"`
+	Hysteresis float64 `json:"hysteresis" validate:"min=0"`
+	// Severity 为空时为 warning
+	Severity string            `json:"severity" validate:"omitempty,oneof=info warning critical"`
+	Hosts    []string          `json:"hosts"`
+	Group    string            `json:"group"`
+	Labels   map[string]string `json:"labels"`
+	// Enable 为空时开启
+	Enable *bool `json:"enable"`
+}
+
+type UpdateAlertRuleRequest struct {
+	Id string `json:"id" validate:"required"`
+	AlertRuleRequest
+}
+
+type DeleteAlertRuleRequest struct {
+	Data []string `json:"data" validate:"required,dive,required"`
+}
+
+type AlertRuleResponse struct {
+	Code    int                `json:"code"`
+	Message *string            `json:"message"`
+	Data    *mongoDB.AlertRule `json:"data"`
+}
+
+type SelectAlertRuleResponse struct {
+	Code    int                 `json:"code"`
+	Message *string             `json:"message"`
+	Data    []mongoDB.AlertRule `json:"data"`
+}
+
+type DeleteAlertRuleResponse struct {
+	Code    int                           `json:"code"`
+	Message *string                       `json:"message"`
+	Data    []DeleteAlertRuleResponseData `json:"data"`
+}
+
+type DeleteAlertRuleResponseData struct {
+	Id      string `json:"id"`
+	Deleted bool   `json:"deleted"`
+}
+
+type SelectAlertResponse struct {
+	Code    int             `json:"code"`
+	Message *string         `json:"message"`
+	Data    []mongoDB.Alert `json:"data"`
+}
+
+const (
+	defaultAlertHistoryLimit = 100
+	maxAlertHistoryLimit     = 1000
+)
+
+// alertRuleHelper 检查请求并转为规则, hosts 补全为保存的 ssh 的 key, 只能使用自己保存的 ssh
+func alertRuleHelper(username string, request *AlertRuleRequest) (mongoDB.AlertRule, error) {
+	rule := mongoDB.AlertRule{
+		UserName:   username,
+		Name:       request.Name,
+		Metric:     request.Metric,
+		Operator:   request.Operator,
+		Threshold:  *request.Threshold,
+		For:        request.For,
+		Hysteresis: request.Hysteresis,
+		Severity:   request.Severity,
+		Hosts:      make([]string, 0, len(request.Hosts)),
+		Group:      request.Group,
+		Labels:     request.Labels,
+		Enable:     request.Enable == nil || *request.Enable,
+	}
+	event, ok := ssh.PointEvent(rule.Metric)
+	if !ok {
+		return rule, fmt.Errorf("unknown metric %q", rule.Metric)
+	}
+	if !alerts.watches(event) {
+		return rule, fmt.Errorf("event %s of %s is not in alert.Events", event, rule.Metric)
+	}
+	if _, ok := alertOperators[rule.Operator]; !ok {
+		return rule, fmt.Errorf("operator must be one of > >= < <=, got %q", rule.Operator)
+	}
+	if rule.Severity == "" {
+		rule.Severity = "warning"
+	}
+	for k := range rule.Labels {
+		if !contains(metricLabels, k) {
+			return rule, fmt.Errorf("unknown label %q", k)
+		}
+	}
+	for _, key := range request.Hosts {
+		if !strings.HasPrefix(key, username+":") {
+			key = username + ":" + key
+		}
+		if userSSH, err := mongoDB.Client.GetUserSSH(key); err != nil || userSSH.UserName != username {
+			return rule, fmt.Errorf("ssh %s not belong to user %s", key, username)
+		}
+		rule.Hosts = append(rule.Hosts, key)
+	}
+	return rule, nil
+}
+
+// reloadAlertRules 规则修改后立即生效, 失败时等下次扫描
+func reloadAlertRules() {
+	if err := alerts.reloadRules(); err != nil {
+		logger.L.Warnf("alert load rules fail : %v", err)
+	}
+}
+
+func addAlertRuleHandler(context *gin.Context) {
+	addAlertRuleRequest := &AlertRuleRequest{}
+	if ok := requestJsonParseHelper(context, addAlertRuleRequest); ok {
+		username := context.Request.Header.Get("User-Name")
+		rule, err := alertRuleHelper(username, addAlertRuleRequest)
+		if err != nil {
+			authFailHelper(context, err)
+			return
+		}
+		rule.Id = uuid.New().String()
+		alertRuleResponse := &AlertRuleResponse{
+			Code:    200,
+			Message: nil,
+			Data:    &rule,
+		}
+		if err := mongoDB.Client.InsertAlertRule(rule); err != nil {
+			errText := fmt.Sprintf("Insert Alert Rule Fail : %v", err)
+			alertRuleResponse.Code = 500
+			alertRuleResponse.Message = &errText
+			alertRuleResponse.Data = nil
+		} else {
+			reloadAlertRules()
+		}
+		context.JSON(http.StatusOK, alertRuleResponse)
+	}
+}
+
+func updateAlertRuleHandler(context *gin.Context) {
+	updateAlertRuleRequest := &UpdateAlertRuleRequest{}
+	if ok := requestJsonParseHelper(context, updateAlertRuleRequest); ok {
+		username := context.Request.Header.Get("User-Name")
+		rule, err := alertRuleHelper(username, &updateAlertRuleRequest.AlertRuleRequest)
+		if err != nil {
+			authFailHelper(context, err)
+			return
+		}
+		rule.Id = updateAlertRuleRequest.Id
+		alertRuleResponse := &AlertRuleResponse{
+			Code:    200,
+			Message: nil,
+			Data:    &rule,
+		}
+		if err := mongoDB.Client.UpdateAlertRule(rule); err != nil {
+			errText := fmt.Sprintf("Update Alert Rule Fail : %v", err)
+			alertRuleResponse.Code = 500
+			alertRuleResponse.Message = &errText
+			alertRuleResponse.Data = nil
+		} else {
+			reloadAlertRules()
+		}
+		context.JSON(http.StatusOK, alertRuleResponse)
+	}
+}
+
+func deleteAlertRuleHandler(context *gin.Context) {
+	deleteAlertRuleRequest := &DeleteAlertRuleRequest{}
+	if ok := requestJsonParseHelper(context, deleteAlertRuleRequest); ok {
+		username := context.Request.Header.Get("User-Name")
+		res, err := mongoDB.Client.DeleteAlertRule(username, deleteAlertRuleRequest.Data)
+		deleteAlertRuleResponse := &DeleteAlertRuleResponse{
+			Code:    200,
+			Message: nil,
+			Data:    make([]DeleteAlertRuleResponseData, 0),
+		}
+		if err != nil {
+			errText := fmt.Sprintf("Delete Alert Rule Fail : %v", err)
+			deleteAlertRuleResponse.Code = 500
+			deleteAlertRuleResponse.Message = &errText
+		}
+		resSet := mapSet.NewSet(res...)
+		for _, id := range deleteAlertRuleRequest.Data {
+			deleteAlertRuleResponse.Data = append(deleteAlertRuleResponse.Data, DeleteAlertRuleResponseData{
+				Id:      id,
+				Deleted: resSet.Contains(id),
+			})
+		}
+		if len(res) > 0 {
+			reloadAlertRules()
+		}
+		context.JSON(http.StatusOK, deleteAlertRuleResponse)
+	}
+}
+
+func selectAlertRuleHandler(context *gin.Context) {
+	username := context.Request.Header.Get("User-Name")
+	res, err := mongoDB.Client.SelectAlertRule(username)
+	selectAlertRuleResponse := &SelectAlertRuleResponse{
+		Code:    200,
+		Message: nil,
+		Data:    res,
+	}
+	if err != nil {
+		errText := fmt.Sprintf("Select Alert Rule Fail : %v", err)
+		selectAlertRuleResponse.Code = 500
+		selectAlertRuleResponse.Message = &errText
+		selectAlertRuleResponse.Data = make([]mongoDB.AlertRule, 0)
+	}
+	context.JSON(http.StatusOK, selectAlertRuleResponse)
+}
+
+// selectActiveAlertHandler 正在触发的告警
+func selectActiveAlertHandler(context *gin.Context) {
+	username := context.Request.Header.Get("User-Name")
+	context.JSON(http.StatusOK, SelectAlertResponse{
+		Code:    200,
+		Message: nil,
+		Data:    alerts.active(username),
+	})
+}
+
+// selectAlertHistoryHandler 查询 /alert/selectHistory?from=&to=&rule=&host=&limit=, 按时间倒序
+func selectAlertHistoryHandler(context *gin.Context) {
+	username := context.Request.Header.Get("User-Name")
+	badRequest := func(err error) {
+		errText := fmt.Sprintf("Request Validate Fail %v", err)
+		context.JSON(http.StatusBadRequest, Response{
+			Code:    400,
+			Message: &errText,
+		})
+	}
+	to, err := parseHistoryTime(context.Query("to"), time.Now())
+	if err != nil {
+		badRequest(fmt.Errorf("to : %v", err))
+		return
+	}
+	from, err := parseHistoryTime(context.Query("from"), to.Add(-7*24*time.Hour))
+	if err != nil {
+		badRequest(fmt.Errorf("from : %v", err))
+		return
+	}
+	if !from.Before(to) {
+		badRequest(errors.New("from must be before to"))
+		return
+	}
+	limit := int64(defaultAlertHistoryLimit)
+	if s := context.Query("limit"); s != "" {
+		if limit, err = strconv.ParseInt(s, 10, 64); err != nil || limit <= 0 || limit > maxAlertHistoryLimit {
+			badRequest(fmt.Errorf("limit must be between 1 and %d", maxAlertHistoryLimit))
+			return
+		}
+	}
+	host := context.Query("host")
+	if host != "" && !strings.HasPrefix(host, username+":") {
+		host = username + ":" + host
+	}
+	res, err := mongoDB.Client.SelectAlert(username, context.Query("rule"), host, from, to, limit)
+	selectAlertResponse := &SelectAlertResponse{
+		Code:    200,
+		Message: nil,
+		Data:    res,
+	}
+	if err != nil {
+		errText := fmt.Sprintf("Select Alert History Fail : %v", err)
+		selectAlertResponse.Code = 500
+		selectAlertResponse.Message = &errText
+		selectAlertResponse.Data = make([]mongoDB.Alert, 0)
+	}
+	context.JSON(http.StatusOK, selectAlertResponse)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"mongoDB"
+	"ssh"
+	"testing"
+	"time"
+)
+
+// alertSample 第 at 秒收到的值, want 为这次应该产生的告警状态, 为空时不产生告警
+type alertSample struct {
+	at    int
+	value float64
+	want  string
+}
+
+func TestAlertStep(t *testing.T) {
+	cases := []struct {
+		name    string
+		rule    mongoDB.AlertRule
+		samples []alertSample
+	}{
+		{
+			name: "greater with hysteresis",
+			rule: mongoDB.AlertRule{Id: "r", Metric: "CPU", Operator: ">", Threshold: 90, Hysteresis: 5},
+			samples: []alertSample{
+				{0, 80, ""},
+				{10, 95, mongoDB.AlertFiring},
+				{20, 89, ""},
+				{30, 86, ""},
+				{40, 85, mongoDB.AlertResolved},
+				{50, 89, ""},
+			},
+		},
+		{
+			name: "less with hysteresis",
+			rule: mongoDB.AlertRule{Id: "r", Metric: "Free", Operator: "<", Threshold: 10, Hysteresis: 5},
+			samples: []alertSample{
+				{0, 20, ""},
+				{10, 5, mongoDB.AlertFiring},
+				{20, 11, ""},
+				{30, 14, ""},
+				{40, 15, mongoDB.AlertResolved},
+				{50, 11, ""},
+			},
+		},
+		{
+			name: "for resets when the value dips",
+			rule: mongoDB.AlertRule{Id: "r", Metric: "CPU", Operator: ">", Threshold: 90, For: 60},
+			samples: []alertSample{
+				{0, 95, ""},
+				{30, 95, ""},
+				{40, 80, ""},
+				{50, 95, ""},
+				{100, 95, ""},
+				{110, 95, mongoDB.AlertFiring},
+				{120, 95, ""},
+			},
+		},
+	}
+	start := time.Unix(1700000000, 0)
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			e := &alertEngine{states: make(map[string]*alertState)}
+			for _, s := range c.samples {
+				a, changed := e.step(c.rule, "root@10.0.0.1:22", ssh.Point{Name: c.rule.Metric, Value: s.value}, start.Add(time.Duration(s.at)*time.Second))
+				got := ""
+				if changed {
+					got = a.State
+				}
+				if got != s.want {
+					t.Fatalf("at %ds value %g : want %q, got %q", s.at, s.value, s.want, got)
+				}
+			}
+		})
+	}
+}
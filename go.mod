@@ -6,6 +6,7 @@ replace (
 	logger => ./logger
 	mongoDB => ./mongoDB
 	mutexMap => ./mutexMap
+	otlp => ./otlp
 	ssh => ./ssh
 	wsocket => ./wsocket
 )
@@ -23,8 +24,10 @@ require (
 	github.com/gorilla/websocket v1.5.0
 	github.com/json-iterator/go v1.1.12
 	github.com/pelletier/go-toml v1.9.5
+	golang.org/x/net v0.0.0-20211112202133-69e39bad7dc2
 	logger v0.0.0
 	mongoDB v0.0.0
+	otlp v0.0.0
 	wsocket v0.0.0
 )
 
@@ -52,7 +55,6 @@ require (
 	github.com/youmark/pkcs8 v0.0.0-20181117223130-1be2e3e5546d // indirect
 	go.mongodb.org/mongo-driver v1.10.3 // indirect
 	golang.org/x/crypto v0.0.0-20221012134737-56aed061732a // indirect
-	golang.org/x/net v0.0.0-20211112202133-69e39bad7dc2 // indirect
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c // indirect
 	golang.org/x/sys v0.0.0-20220715151400-c0bba94af5f8 // indirect
 	golang.org/x/text v0.3.7 // indirect
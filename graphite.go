@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"github.com/pelletier/go-toml"
+	"math"
+	"net"
+	"strconv"
+	"time"
+)
+
+// graphiteSink 按 plaintext 协议通过 TCP 写入 Graphite (carbon), 连接断开后下次写入时重连
+type graphiteSink struct {
+	address string
+	prefix  string
+	timeout time.Duration
+	conn    net.Conn
+}
+
+func newGraphiteSink(conf *toml.Tree) (Sink, error) {
+	return &graphiteSink{
+		address: conf.GetDefault("Address", "localhost:2003").(string),
+		prefix:  conf.GetDefault("Prefix", "argus").(string),
+		timeout: time.Duration(conf.GetDefault("Timeout", int64(10)).(int64)) * time.Second,
+	}, nil
+}
+
+// Write 每个字段一行, 路径为 <Prefix>.<host>.<port>.<user>.<结构体>[.<label 值>...].<字段>, 例如
+// argus.10_0_0_1.22.cc.net_dev.eth0.up_speed 1024 1666000000
+func (s *graphiteSink) Write(samples []SinkSample) error {
+	var b bytes.Buffer
+	for _, sample := range samples {
+		host := s.prefix + "." + graphiteNode(sample.Host) + "." + strconv.Itoa(sample.Port) + "." + graphiteNode(sample.User)
+		timestamp := strconv.FormatInt(sample.Time.Unix(), 10)
+		for _, g := range sinkFields(sample.Points) {
+			path := host + "." + snakeCase(g.Struct)
+			for _, k := range sortedKeys(g.Labels) {
+				path += "." + graphiteNode(g.Labels[k])
+			}
+			for _, f := range g.Fields {
+				if math.IsNaN(f.Value) || math.IsInf(f.Value, 0) {
+					continue
+				}
+				b.WriteString(path + "." + snakeCase(f.Name) + " " + strconv.FormatFloat(f.Value, 'f', -1, 64) + " " + timestamp + "\n")
+			}
+		}
+	}
+	if b.Len() == 0 {
+		return nil
+	}
+
+	if s.conn == nil {
+		conn, err := net.DialTimeout("tcp", s.address, s.timeout)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	_ = s.conn.SetWriteDeadline(time.Now().Add(s.timeout))
+	// 写入一部分后失败时整批重试, carbon 会用后写入的值覆盖重复的点
+	if _, err := s.conn.Write(b.Bytes()); err != nil {
+		_ = s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+// graphiteNode 路径中的一节只保留字母数字 - 和 _, 例如 10.0.0.1 为 10_0_0_1, 挂载点 / 为 _
+func graphiteNode(s string) string {
+	node := []byte(s)
+	for i, c := range node {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			node[i] = '_'
+		}
+	}
+	if len(node) == 0 {
+		return "_"
+	}
+	return string(node)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"github.com/pelletier/go-toml"
+	"logger"
+	"mongoDB"
+	"ssh"
+	"sync/atomic"
+	"time"
+)
+
+// historyKey 记录历史数据的观察者和保持连接使用的 key
+const historyKey = "history"
+
+// historyBatchSize 积累到这么多条时立即写入, 否则每秒写入一次
+const historyBatchSize = 1000
+
+type historyBatch struct {
+	event   string
+	samples []mongoDB.MetricSample
+}
+
+// historyRecorder 作为观察者监听每个 ssh, 把消息拆成字段后批量写入 MongoDB 时序集合
+type historyRecorder struct {
+	batches chan historyBatch
+	// dropped 写入跟不上时丢弃的条数, 每次写入时报告
+	dropped int64
+}
+
+// startHistory 按 conf.toml 的 [history] 开始记录, 没有开启时什么也不做
+func startHistory(conf *toml.Tree) {
+	if !conf.GetDefault("history.Enable", false).(bool) {
+		return
+	}
+	retention, ok := conf.Get("history.Retention").(*toml.Tree)
+	if !ok {
+		logger.L.Fatalf("history.Retention must list the recorded events")
+	}
+	interval := int(conf.GetDefault("history.Interval", int64(10)).(int64))
+	if interval <= 0 {
+		logger.L.Fatalf("history.Interval must be positive")
+	}
+	events := make([]string, 0)
+	intervals := make(map[string]int)
+	for event, hours := range retention.ToMap() {
+		h, ok := hours.(int64)
+		if !ok || h <= 0 {
+			logger.L.Fatalf("history.Retention.%s must be positive hours", event)
+		}
+		if !isEvent(event) {
+			logger.L.Fatalf("history.Retention.%s is not an event", event)
+		}
+		if err := mongoDB.Client.EnsureMetricCollection(event, time.Duration(h)*time.Hour); err != nil {
+			logger.L.Fatalf("prepare history of %s fail : %v", event, err)
+		}
+		events = append(events, event)
+		intervals[event] = interval
+	}
+
+	r := &historyRecorder{
+		batches: make(chan historyBatch, 1024),
+	}
+	go r.write()
+	ssh.M.AddObserver(historyKey, func(port int, host, user string) ssh.AllListener {
+		return ssh.NewAllListener(events, r.record(ssh.GeneralKey(port, host, user)), intervals)
+	})
+	logger.L.Infof("record history of %v every %ds", events, interval)
+
+	if conf.GetDefault("history.RecordAll", false).(bool) {
+		scanInterval := conf.GetDefault("history.ScanInterval", int64(60)).(int64)
+		if scanInterval <= 0 {
+			logger.L.Fatalf("history.ScanInterval must be positive")
+		}
+		go pinAllUserSSH(historyKey, time.Duration(scanInterval)*time.Second)
+	}
+}
+
+func isEvent(event string) bool {
+	for _, e := range ssh.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *historyRecorder) record(host string) func(event string, message interface{}) {
+	return func(event string, message interface{}) {
+		points := ssh.Points(message)
+		if len(points) == 0 {
+			return
+		}
+		t := time.Now()
+		samples := make([]mongoDB.MetricSample, len(points))
+		for i, p := range points {
+			samples[i] = mongoDB.MetricSample{
+				Time:  t,
+				Meta:  mongoDB.MetricMeta{Host: host, Name: p.Name, Labels: p.Labels},
+				Value: p.Value,
+			}
+		}
+		// 不阻塞采集循环, MongoDB 写入跟不上时丢弃
+		select {
+		case r.batches <- historyBatch{event: event, samples: samples}:
+		default:
+			atomic.AddInt64(&r.dropped, int64(len(samples)))
+		}
+	}
+}
+
+func (r *historyRecorder) write() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	pending := make(map[string][]mongoDB.MetricSample)
+	n := 0
+	flush := func() {
+		for event, samples := range pending {
+			if err := mongoDB.Client.InsertMetricSamples(event, samples); err != nil {
+				logger.L.Warnf("record history fail : %v", err)
+			}
+		}
+		if dropped := atomic.SwapInt64(&r.dropped, 0); dropped > 0 {
+			logger.L.Warnf("record history too slow, %d samples dropped", dropped)
+		}
+		pending = make(map[string][]mongoDB.MetricSample)
+		n = 0
+	}
+	for {
+		select {
+		case b := <-r.batches:
+			pending[b.event] = append(pending[b.event], b.samples...)
+			n += len(b.samples)
+			if n >= historyBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// pinAllUserSSH 定时扫描所有保存的 ssh, 以 key 保持与它们的连接让观察者持续记录,
+// 连接失败的下次扫描时重试, 删除的 ssh 不再保持连接
+func pinAllUserSSH(key string, scanInterval time.Duration) {
+	pinned := make(map[string]ssh.Message)
+	for ; ; time.Sleep(scanInterval) {
+		userSSH, err := mongoDB.Client.SelectAllUserSSH()
+		if err != nil {
+			logger.L.Warnf("%s scan saved ssh fail : %v", key, err)
+			if userSSH == nil {
+				continue
+			}
+		}
+		pinUserSSH(key, pinned, userSSH)
+	}
+}
+
+// pinUserSSH 以 key 保持与 userSSH 的连接, pinned 中其余已保持的连接释放
+func pinUserSSH(key string, pinned map[string]ssh.Message, userSSH []mongoDB.UserSSH) {
+	saved := make(map[string]bool)
+	for i := range userSSH {
+		u := &userSSH[i]
+		sshKey := ssh.GeneralKey(u.Port, u.Host, u.User)
+		saved[sshKey] = true
+		if _, ok := pinned[sshKey]; ok {
+			continue
+		}
+		auth := sshAuth(u)
+		var err error
+		if auth.ProxyJump, err = proxyJumpHops(u); err != nil {
+			logger.L.Debugf("%s connect %s fail : %v", key, u.Key, err)
+			continue
+		}
+		if err := ssh.M.Pin(u.Port, u.Host, u.User, auth, key); err != nil {
+			logger.L.Debugf("%s connect %s fail : %v", key, u.Key, err)
+			continue
+		}
+		verifiedHelper(u)
+		pinned[sshKey] = ssh.Message{Port: u.Port, Host: u.Host, User: u.User}
+	}
+	for sshKey, u := range pinned {
+		if !saved[sshKey] {
+			ssh.M.Unpin(u.Port, u.Host, u.User, key)
+			delete(pinned, sshKey)
+		}
+	}
+}
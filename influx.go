@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/pelletier/go-toml"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// influxSink 用 HTTP 写入 API 按行协议写入 InfluxDB, 配置 Bucket 时使用 2.x 的 /api/v2/write, 配置 Database 时使用 1.x 的 /write
+type influxSink struct {
+	url      string
+	token    string
+	username string
+	password string
+	client   *http.Client
+}
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(`,`, `\,`, ` `, `\ `)
+	influxKeyEscaper         = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `)
+)
+
+func newInfluxSink(conf *toml.Tree) (Sink, error) {
+	base := strings.TrimSuffix(conf.GetDefault("URL", "http://localhost:8086").(string), "/")
+	s := &influxSink{
+		token:    conf.GetDefault("Token", "").(string),
+		username: conf.GetDefault("Username", "").(string),
+		password: conf.GetDefault("Password", "").(string),
+		client:   &http.Client{Timeout: time.Duration(conf.GetDefault("Timeout", int64(10)).(int64)) * time.Second},
+	}
+	query := url.Values{"precision": {"ms"}}
+	if bucket := conf.GetDefault("Bucket", "").(string); bucket != "" {
+		query.Set("org", conf.GetDefault("Org", "").(string))
+		query.Set("bucket", bucket)
+		s.url = base + "/api/v2/write?" + query.Encode()
+	} else if database := conf.GetDefault("Database", "").(string); database != "" {
+		query.Set("db", database)
+		if rp := conf.GetDefault("RetentionPolicy", "").(string); rp != "" {
+			query.Set("rp", rp)
+		}
+		s.url = base + "/write?" + query.Encode()
+	} else {
+		return nil, errors.New("influx needs Bucket or Database")
+	}
+	return s, nil
+}
+
+// Write 同一结构体同一组 labels 的字段写在同一行, 例如
+// argus_net_dev,host=10.0.0.1,interface=eth0,port=22,user=cc up_bytes=5,up_speed=1 1666000000000
+func (s *influxSink) Write(samples []SinkSample) error {
+	var b bytes.Buffer
+	for _, sample := range samples {
+		hostTags := map[string]string{"host": sample.Host, "port": strconv.Itoa(sample.Port), "user": sample.User}
+		timestamp := strconv.FormatInt(sample.Time.UnixMilli(), 10)
+		for _, g := range sinkFields(sample.Points) {
+			fields := make([]string, 0, len(g.Fields))
+			for _, f := range g.Fields {
+				// 行协议不支持 NaN 和 Inf
+				if math.IsNaN(f.Value) || math.IsInf(f.Value, 0) {
+					continue
+				}
+				fields = append(fields, influxKeyEscaper.Replace(snakeCase(f.Name))+"="+strconv.FormatFloat(f.Value, 'f', -1, 64))
+			}
+			if len(fields) == 0 {
+				continue
+			}
+			b.WriteString(influxMeasurementEscaper.Replace("argus_" + snakeCase(g.Struct)))
+			tags := make(map[string]string, len(g.Labels)+len(hostTags))
+			for k, v := range g.Labels {
+				tags[k] = v
+			}
+			for k, v := range hostTags {
+				tags[k] = v
+			}
+			for _, k := range sortedKeys(tags) {
+				// 空的 tag 值不合法
+				if tags[k] == "" {
+					continue
+				}
+				b.WriteString("," + influxKeyEscaper.Replace(k) + "=" + influxKeyEscaper.Replace(tags[k]))
+			}
+			b.WriteString(" " + strings.Join(fields, ",") + " " + timestamp + "\n")
+		}
+	}
+	if b.Len() == 0 {
+		return nil
+	}
+
+	request, _ := http.NewRequest(http.MethodPost, s.url, &b)
+	request.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.token != "" {
+		request.Header.Set("Authorization", "Token "+s.token)
+	} else if s.username != "" {
+		request.SetBasicAuth(s.username, s.password)
+	}
+	response, err := s.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+	if response.StatusCode/100 == 2 {
+		return nil
+	}
+	errText := fmt.Sprintf("write to influx fail : %s %s", response.Status, strings.TrimSpace(string(body)))
+	// 格式错误和超出大小的数据重试也不会成功
+	switch response.StatusCode {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return &sinkRejected{err: errors.New(errText)}
+	}
+	return errors.New(errText)
+}
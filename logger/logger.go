@@ -10,15 +10,17 @@ import (
 var L = logrus.New()
 
 func init() {
+	L.SetOutput(os.Stdout)
 	conf, err := toml.LoadFile("./conf.toml")
 	if err != nil {
-		log.Fatalf("Read Config File Fail %e", err)
+		// 单元测试的工作目录下没有配置文件, 使用默认的日志级别
+		L.Warnf("Read Config File Fail %v, use default log level", err)
+		return
 	}
-	level := conf.Get("log.Level").(string)
+	level := conf.GetDefault("log.Level", "info").(string)
 	res, err := logrus.ParseLevel(level)
 	if err != nil {
 		log.Fatalf("Parse Config Log Level fail %e", err)
 	}
 	L.SetLevel(res)
-	L.SetOutput(os.Stdout)
 }
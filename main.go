@@ -1,11 +1,13 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	mapSet "github.com/deckarep/golang-set/v2"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
+	"github.com/gorilla/websocket"
 	"github.com/pelletier/go-toml"
 	"logger"
 	"mongoDB"
@@ -33,8 +35,25 @@ func main() {
 		logger.L.Println(http.ListenAndServe(":6060", nil))
 	}()
 
+	mongoDB.Connect()
 	defer mongoDB.Client.Close()
 
+	reencrypt := flag.Bool("reencrypt", false, "re-encrypt stored ssh credentials and notify channels with the current master key and exit")
+	flag.Parse()
+	if *reencrypt {
+		count, err := mongoDB.Client.ReencryptUserSSH()
+		logger.L.Infof("reencrypt %d ssh credentials", count)
+		if err != nil {
+			logger.L.Fatalf("reencrypt fail : %v", err)
+		}
+		count, err = mongoDB.Client.ReencryptNotifyChannel()
+		logger.L.Infof("reencrypt %d notify channels", count)
+		if err != nil {
+			logger.L.Fatalf("reencrypt fail : %v", err)
+		}
+		return
+	}
+
 	conf, err := toml.LoadFile("./conf.toml")
 	if err != nil {
 		logger.L.Fatalf("Read Config File Fail %e", err)
@@ -45,6 +64,17 @@ func main() {
 	allowOrigin := conf.Get("server.AllowOrigin").(string)
 	addr := fmt.Sprintf("%s:%d", ip, port)
 
+	startHistory(conf)
+	prometheus = startPrometheus(conf)
+	startOTLP(conf)
+	startSinks(conf)
+	alerts = startAlert(conf)
+	notify = startNotify(conf, alerts)
+	probe = startProbe(conf, alerts)
+	if alerts != nil {
+		alerts.start()
+	}
+
 	router := gin.New()
 	router.Use(ginAllowOriginMiddleware(allowOrigin))
 	router.Use(ginAuthMiddleware())
@@ -54,10 +84,38 @@ func main() {
 	router.DELETE("/user/deleteSSH", deleteUserSSHHandler)
 	router.PUT("/user/updateSSH", updateUserSSHHandler)
 	router.GET("/user/selectSSH", selectUserSSHHandler)
+	router.POST("/user/revealSSH", revealUserSSHHandler)
+	router.GET("/user/selectKnownHost", selectKnownHostHandler)
+	router.PUT("/user/acceptKnownHost", acceptKnownHostHandler)
+	router.DELETE("/user/revokeKnownHost", revokeKnownHostHandler)
 	router.POST("/user/register", registerHandler)
 	router.POST("/user/login", loginHandler)
 	router.PUT("/user/changePasswd", changePasswdHandler)
+	router.GET("/metrics/history", metricHistoryHandler)
+	if prometheus != nil {
+		router.GET("/metrics", prometheusHandler)
+	}
+	if alerts != nil {
+		router.POST("/alert/addRule", addAlertRuleHandler)
+		router.PUT("/alert/updateRule", updateAlertRuleHandler)
+		router.DELETE("/alert/deleteRule", deleteAlertRuleHandler)
+		router.GET("/alert/selectRule", selectAlertRuleHandler)
+		router.GET("/alert/selectActive", selectActiveAlertHandler)
+		router.GET("/alert/selectHistory", selectAlertHistoryHandler)
+	}
+	if notify != nil {
+		router.POST("/notify/addChannel", addNotifyChannelHandler)
+		router.PUT("/notify/updateChannel", updateNotifyChannelHandler)
+		router.DELETE("/notify/deleteChannel", deleteNotifyChannelHandler)
+		router.GET("/notify/selectChannel", selectNotifyChannelHandler)
+		router.POST("/notify/testChannel", testNotifyChannelHandler)
+	}
+	if probe != nil {
+		router.GET("/probe/selectStatus", selectProbeStatusHandler)
+		router.GET("/probe/selectHistory", selectProbeHistoryHandler)
+	}
 
+	wsocket.WsocketManager.RegisterConnectHandler(authTimeoutHandler)
 	wsocket.WsocketManager.RegisterMessageHandler(messageRouter)
 	wsocket.WsocketManager.RegisterCloseHandler(func(conn *wsocket.Connect) {
 		ssh.M.ClearListener(conn.Key)
@@ -72,11 +130,11 @@ func main() {
 }
 
 func monitorHandler(c *gin.Context) {
-	wsocket.WsocketManager.HandleNewConnect(c.Writer, c.Request)
+	wsocket.WsocketManager.HandleNewConnect(c.Writer, c.Request, c.Request.Header.Get("User-Name"))
 }
 
 func sshHandler(c *gin.Context) {
-	handleNewSSHConnect(c.Writer, c.Request)
+	handleNewSSHConnect(c.Writer, c.Request, c.Request.Header.Get("User-Name"))
 }
 
 func ginAllowOriginMiddleware(allowOrigin string) gin.HandlerFunc {
@@ -107,36 +165,67 @@ func ginAuthMiddleware() gin.HandlerFunc {
 	}
 
 	return func(c *gin.Context) {
-		if !isInWhiteList(c.Request.URL, c.Request.Method) {
-			strToken := c.Request.Header.Get("A-Token")
-			token, err := jwt.ParseWithClaims(strToken, &LoginRequest{}, func(token *jwt.Token) (interface{}, error) {
-				return []byte(jwtSecret), nil
-			})
-			if err != nil {
-				abort(c, fmt.Sprintf("Token auth fail : %v", err))
-				return
-			}
-			loginRequest, ok := token.Claims.(*LoginRequest)
-			if !ok {
-				abort(c, fmt.Sprintf("Token auth fail : %v", err))
-				return
-			}
-			if err := token.Claims.Valid(); err != nil {
-				abort(c, fmt.Sprintf("Token auth fail : %v", err))
+		// User-Name is only ever set by this middleware, never trust the one sent by client
+		c.Request.Header.Del("User-Name")
+		if isInWhiteList(c.Request.URL, c.Request.Method) {
+			c.Next()
+			return
+		}
+		strToken := c.Request.Header.Get("A-Token")
+		if isWebsocket(c.Request.URL, c.Request.Method) {
+			// 浏览器无法为 websocket 设置请求头, token 放在 query 或 Sec-WebSocket-Protocol 中,
+			// 都没有时交给 websocket 的第一帧 auth 消息认证
+			strToken = websocketToken(c.Request)
+			if strToken == "" {
+				c.Next()
 				return
 			}
-			c.Request.Header.Add("User-Name", loginRequest.UserName)
 		}
+		username, err := parseToken(strToken)
+		if err != nil {
+			abort(c, err.Error())
+			return
+		}
+		c.Request.Header.Add("User-Name", username)
 		c.Next()
 	}
 }
 
+func parseToken(strToken string) (string, error) {
+	token, err := jwt.ParseWithClaims(strToken, &LoginRequest{}, func(token *jwt.Token) (interface{}, error) {
+		return []byte(jwtSecret), nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("Token auth fail : %v", err)
+	}
+	loginRequest, ok := token.Claims.(*LoginRequest)
+	if !ok {
+		return "", fmt.Errorf("Token auth fail : %v", err)
+	}
+	if err := token.Claims.Valid(); err != nil {
+		return "", fmt.Errorf("Token auth fail : %v", err)
+	}
+	return loginRequest.UserName, nil
+}
+
+func websocketToken(r *http.Request) string {
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token
+	}
+	for _, protocol := range websocket.Subprotocols(r) {
+		if protocol != wsocket.Subprotocol {
+			return protocol
+		}
+	}
+	return ""
+}
+
 func isInWhiteList(url *url.URL, method string) bool {
 	whiteList := map[string]mapSet.Set[string]{
 		"/user/register": mapSet.NewSet("POST"),
 		"/user/login":    mapSet.NewSet("POST"),
-		"/monitor":       mapSet.NewSet("GET"),
-		"/ssh":           mapSet.NewSet("GET"),
+		// /metrics 使用 [prometheus] 中配置的认证
+		"/metrics": mapSet.NewSet("GET"),
 	}
 	queryUrl := strings.Split(fmt.Sprint(url), "?")[0]
 	if set, ok := whiteList[queryUrl]; ok {
@@ -147,3 +236,15 @@ func isInWhiteList(url *url.URL, method string) bool {
 	}
 	return false
 }
+
+func isWebsocket(url *url.URL, method string) bool {
+	websocketList := map[string]mapSet.Set[string]{
+		"/monitor": mapSet.NewSet("GET"),
+		"/ssh":     mapSet.NewSet("GET"),
+	}
+	queryUrl := strings.Split(fmt.Sprint(url), "?")[0]
+	if set, ok := websocketList[queryUrl]; ok {
+		return set.Contains(method)
+	}
+	return false
+}
@@ -0,0 +1,211 @@
+package mongoDB
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"sort"
+	"time"
+)
+
+// AlertRule 用户的告警规则, 例如 CPUPerformanceTotal.Utilization > 90 持续 5 分钟
+type AlertRule struct {
+	Id       string `json:"id" bson:"_id"`
+	UserName string `json:"username" bson:"username"`
+	Name     string `json:"name" bson:"name"`
+	// Metric 字段名, 与 /metrics/history 的 metric 相同
+	Metric    string  `json:"metric" bson:"metric"`
+	Operator  string  `json:"operator" bson:"operator"`
+	Threshold float64 `json:"threshold" bson:"threshold"`
+	// For 持续满足条件这么多秒后触发, 为 0 时立即触发
+	For int64 `json:"for" bson:"for"`
+	// Hysteresis 触发后值要回到阈值另一侧超过 Hysteresis 才恢复, 避免在阈值附近反复触发
+	Hysteresis float64 `json:"hysteresis" bson:"hysteresis"`
+	Severity   string  `json:"severity" bson:"severity"`
+	// Hosts 为保存的 ssh 的 key, Group 为 ssh 的分组, 都为空时作用于用户保存的所有 ssh
+	Hosts []string `json:"hosts" bson:"hosts"`
+	Group string   `json:"group" bson:"group"`
+	// Labels 只判断 labels 匹配的序列, 例如 {"mount": "/"}, 为空时每个序列分别判断
+	Labels     map[string]string `json:"labels" bson:"labels"`
+	Enable     bool              `json:"enable" bson:"enable"`
+	CreateTime time.Time         `json:"createTime" bson:"createTime"`
+	UpdateTime time.Time         `json:"updateTime" bson:"updateTime"`
+}
+
+const (
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+)
+
+// Alert 告警的一次触发或恢复, 保存在 Alert 集合中作为告警历史
+type Alert struct {
+	RuleId    string            `json:"ruleId" bson:"ruleId"`
+	RuleName  string            `json:"ruleName" bson:"ruleName"`
+	UserName  string            `json:"username" bson:"username"`
+	Host      string            `json:"host" bson:"host"`
+	Metric    string            `json:"metric" bson:"metric"`
+	Labels    map[string]string `json:"labels" bson:"labels"`
+	Operator  string            `json:"operator" bson:"operator"`
+	Threshold float64           `json:"threshold" bson:"threshold"`
+	Severity  string            `json:"severity" bson:"severity"`
+	State     string            `json:"state" bson:"state"`
+	Value     float64           `json:"value" bson:"value"`
+	// StartTime 开始触发的时间, 恢复事件中也保留
+	StartTime time.Time `json:"startTime" bson:"startTime"`
+	Time      time.Time `json:"time" bson:"time"`
+	Message   string    `json:"message" bson:"message"`
+}
+
+func (c *MongoClient) InsertAlertRule(rule AlertRule) error {
+	rule.CreateTime = time.Now()
+	rule.UpdateTime = rule.CreateTime
+	_, err := c.alertRuleCollection.InsertOne(context.TODO(), rule)
+	if err != nil {
+		errText := fmt.Sprintf("Insert fail %s : %v", rule.Id, err)
+		return errors.New(errText)
+	}
+	return nil
+}
+
+// UpdateAlertRule 只能修改 rule.UserName 自己的规则
+func (c *MongoClient) UpdateAlertRule(rule AlertRule) error {
+	update := bson.D{{"$set", bson.D{
+		{"name", rule.Name},
+		{"metric", rule.Metric},
+		{"operator", rule.Operator},
+		{"threshold", rule.Threshold},
+		{"for", rule.For},
+		{"hysteresis", rule.Hysteresis},
+		{"severity", rule.Severity},
+		{"hosts", rule.Hosts},
+		{"group", rule.Group},
+		{"labels", rule.Labels},
+		{"enable", rule.Enable},
+		{"updateTime", time.Now()},
+	}}}
+	result, err := c.alertRuleCollection.UpdateOne(context.TODO(), bson.D{{"_id", rule.Id}, {"username", rule.UserName}}, update)
+	if err != nil || result.MatchedCount == 0 {
+		errText := fmt.Sprintf("update fail %s : %v", rule.Id, err)
+		return errors.New(errText)
+	}
+	return nil
+}
+
+func (c *MongoClient) DeleteAlertRule(username string, ids []string) ([]string, error) {
+	r := make([]string, 0)
+	errText := ""
+	for _, id := range ids {
+		result, err := c.alertRuleCollection.DeleteOne(context.TODO(), bson.D{{"_id", id}, {"username", username}})
+		if err != nil || result.DeletedCount == 0 {
+			errText += fmt.Sprintf("delete fail %s : %v", id, err)
+		} else {
+			r = append(r, id)
+		}
+	}
+	if errText == "" {
+		return r, nil
+	}
+	return r, errors.New(errText)
+}
+
+// SelectAlertRule username 为空时返回所有用户的规则
+func (c *MongoClient) SelectAlertRule(username string) ([]AlertRule, error) {
+	filter := bson.D{}
+	if username != "" {
+		filter = append(filter, bson.E{Key: "username", Value: username})
+	}
+	result, err := c.alertRuleCollection.Find(context.TODO(), filter, options.Find().SetSort(bson.D{{Key: "createTime", Value: 1}}))
+	if err != nil {
+		errText := fmt.Sprintf("Select fail %s : %v", username, err)
+		return nil, errors.New(errText)
+	}
+	rules := make([]AlertRule, 0)
+	if err = result.All(context.TODO(), &rules); err != nil {
+		errText := fmt.Sprintf("Select fail %s : %v", username, err)
+		return nil, errors.New(errText)
+	}
+	return rules, nil
+}
+
+func (c *MongoClient) InsertAlert(alert Alert) error {
+	_, err := c.alertCollection.InsertOne(context.TODO(), alert)
+	if err != nil {
+		errText := fmt.Sprintf("Insert alert of %s fail : %v", alert.RuleId, err)
+		return errors.New(errText)
+	}
+	return nil
+}
+
+// SelectFiringAlert 每个序列 (ruleId, host, labels) 最后一次记录为触发的告警, 用于重启后恢复告警状态.
+// 按 AlertRuleHostTimeIndex 排序后取每组第一条, 不需要把整个历史读进内存
+func (c *MongoClient) SelectFiringAlert() ([]Alert, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$sort", Value: bson.D{{Key: "ruleId", Value: 1}, {Key: "host", Value: 1}, {Key: "time", Value: -1}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   bson.M{"ruleId": "$ruleId", "host": "$host", "labels": "$labels"},
+			"alert": bson.M{"$first": "$$ROOT"},
+		}}},
+	}
+	cursor, err := c.alertCollection.Aggregate(context.TODO(), pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		errText := fmt.Sprintf("Select firing alert fail : %v", err)
+		return nil, errors.New(errText)
+	}
+	var result []struct {
+		Alert Alert `bson:"alert"`
+	}
+	if err := cursor.All(context.TODO(), &result); err != nil {
+		errText := fmt.Sprintf("Select firing alert fail : %v", err)
+		return nil, errors.New(errText)
+	}
+	// labels 写入时的键顺序不固定, 相同的序列可能分在几组, 按排序后的键值合并后再只保留触发的
+	last := make(map[string]Alert)
+	for _, r := range result {
+		a := r.Alert
+		keys := make([]string, 0, len(a.Labels))
+		for k := range a.Labels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		key := a.RuleId + "\x00" + a.Host
+		for _, k := range keys {
+			key += "\x00" + k + "=" + a.Labels[k]
+		}
+		if v, ok := last[key]; !ok || a.Time.After(v.Time) {
+			last[key] = a
+		}
+	}
+	alerts := make([]Alert, 0)
+	for _, a := range last {
+		if a.State == AlertFiring {
+			alerts = append(alerts, a)
+		}
+	}
+	return alerts, nil
+}
+
+// SelectAlert 按时间倒序返回用户 [from, to) 内的告警历史, ruleId 和 host 不为空时只返回匹配的
+func (c *MongoClient) SelectAlert(username string, ruleId string, host string, from time.Time, to time.Time, limit int64) ([]Alert, error) {
+	filter := bson.D{{"username", username}, {"time", bson.M{"$gte": from, "$lt": to}}}
+	if ruleId != "" {
+		filter = append(filter, bson.E{Key: "ruleId", Value: ruleId})
+	}
+	if host != "" {
+		filter = append(filter, bson.E{Key: "host", Value: host})
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "time", Value: -1}}).SetLimit(limit)
+	result, err := c.alertCollection.Find(context.TODO(), filter, opts)
+	if err != nil {
+		errText := fmt.Sprintf("Select alert fail %s : %v", username, err)
+		return nil, errors.New(errText)
+	}
+	alerts := make([]Alert, 0)
+	if err = result.All(context.TODO(), &alerts); err != nil {
+		errText := fmt.Sprintf("Select alert fail %s : %v", username, err)
+		return nil, errors.New(errText)
+	}
+	return alerts, nil
+}
@@ -3,6 +3,7 @@ package mongoDB
 import (
 	"context"
 	"crypto/md5"
+	"crypto/subtle"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -10,17 +11,25 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/bcrypt"
 	"logger"
-	"math/rand"
 	"time"
 )
 
 type User struct {
 	UserName string `json:"userName" bson:"_id"`
 	Passwd   string `json:"passwd" bson:"passwd"`
-	Salt     string `bson:"salt"`
+	// Salt 只有旧的 MD5 记录使用, bcrypt 的盐保存在 Passwd 中
+	Salt      string `bson:"salt,omitempty"`
+	Algorithm string `bson:"algorithm,omitempty"`
 }
 
+const (
+	// PasswdMD5 旧记录没有 algorithm 字段, 登录成功后迁移到 PasswdBcrypt
+	PasswdMD5    = "md5"
+	PasswdBcrypt = "bcrypt"
+)
+
 type UserSSH struct {
 	Key      string `bson:"key"`
 	UserName string `json:"username" bson:"username"`
@@ -28,7 +37,40 @@ type UserSSH struct {
 	Port     int    `json:"port" bson:"port"`
 	Host     string `json:"host" bson:"host"`
 	User     string `json:"user" bson:"user"`
-	Passwd   string `json:"passwd" bson:"passwd"`
+	AuthType string `json:"authType" bson:"authType,omitempty"`
+	// 凭据字段只在内存中为明文, 写入前加密进 Sealed
+	Passwd      string            `json:"passwd" bson:"passwd,omitempty"`
+	PrivateKey  string            `json:"privateKey" bson:"privateKey,omitempty"`
+	Passphrase  string            `json:"passphrase" bson:"passphrase,omitempty"`
+	Certificate string            `json:"certificate" bson:"certificate,omitempty"`
+	Sealed      *SealedCredential `json:"-" bson:"sealed,omitempty"`
+	// ProxyJump 依次经过的跳板机, 为同一用户保存的 ssh 的 key
+	ProxyJump []string `json:"proxyJump" bson:"proxyJump"`
+	// Intervals 按事件名设置的采集间隔, 单位秒, 优先于 conf.toml 中的默认间隔
+	Intervals map[string]int `json:"intervals" bson:"intervals"`
+	// Groups 分组, 例如 web, 告警规则可以作用于一个分组
+	Groups []string `json:"groups" bson:"groups"`
+	// Verified 保存的凭据成功登录过, 修改后重新置为 false; UpdateTime 为最后一次保存的时间
+	Verified   bool      `json:"verified" bson:"verified"`
+	UpdateTime time.Time `json:"updateTime" bson:"updateTime"`
+}
+
+const (
+	// AuthPassword 旧记录没有 authType 字段, 都是密码认证
+	AuthPassword            = "password"
+	AuthPublicKey           = "publicKey"
+	AuthCertificate         = "certificate"
+	AuthKeyboardInteractive = "keyboardInteractive"
+)
+
+// Audit records access to sensitive data such as stored credentials
+type Audit struct {
+	UserName   string    `json:"username" bson:"username"`
+	Action     string    `json:"action" bson:"action"`
+	Target     string    `json:"target" bson:"target"`
+	RemoteAddr string    `json:"remoteAddr" bson:"remoteAddr"`
+	Success    bool      `json:"success" bson:"success"`
+	Time       time.Time `json:"time" bson:"time"`
 }
 
 type UserSSHUpdater struct {
@@ -37,14 +79,23 @@ type UserSSHUpdater struct {
 }
 
 type MongoClient struct {
-	mongoCli          *mongo.Client
-	userSSHCollection *mongo.Collection
-	userCollection    *mongo.Collection
+	mongoCli            *mongo.Client
+	database            *mongo.Database
+	userSSHCollection   *mongo.Collection
+	userCollection      *mongo.Collection
+	auditCollection     *mongo.Collection
+	knownHostCollection *mongo.Collection
+	alertRuleCollection *mongo.Collection
+	alertCollection     *mongo.Collection
+	channelCollection   *mongo.Collection
+	hostEventCollection *mongo.Collection
+	keyring             *keyring
 }
 
 var Client *MongoClient
 
-func init() {
+// Connect 按 conf.toml 连接 MongoDB 并建立索引, 使用 Client 之前调用, 失败时退出
+func Connect() {
 	conf, err := toml.LoadFile("./conf.toml")
 	if err != nil {
 		logger.L.Fatalf("Read Config File Fail %e", err)
@@ -64,8 +115,10 @@ func init() {
 		logger.L.Fatalf("connect to mongo DB fail : %v", err)
 	}
 
-	userSSHCollection := mgoCli.Database("Argusyes").Collection("UserSSH")
-	userCollection := mgoCli.Database("Argusyes").Collection("User")
+	database := mgoCli.Database("Argusyes")
+	userSSHCollection := database.Collection("UserSSH")
+	userCollection := database.Collection("User")
+	auditCollection := database.Collection("Audit")
 	_, err = userSSHCollection.Indexes().CreateOne(
 		context.Background(),
 		mongo.IndexModel{
@@ -77,10 +130,73 @@ func init() {
 		logger.L.Fatalf("create index fail : %v", err)
 	}
 
+	knownHostCollection := database.Collection("KnownHost")
+	_, err = knownHostCollection.Indexes().CreateOne(
+		context.Background(),
+		mongo.IndexModel{
+			Keys:    bson.D{{Key: "key", Value: 1}},
+			Options: options.Index().SetUnique(true).SetName("KnownHostKeyIndex"),
+		},
+	)
+	if err != nil {
+		logger.L.Fatalf("create index fail : %v", err)
+	}
+
+	alertRuleCollection := database.Collection("AlertRule")
+	alertCollection := database.Collection("Alert")
+	_, err = alertCollection.Indexes().CreateOne(
+		context.Background(),
+		mongo.IndexModel{
+			Keys:    bson.D{{Key: "username", Value: 1}, {Key: "time", Value: -1}},
+			Options: options.Index().SetName("AlertUserNameTimeIndex"),
+		},
+	)
+	if err != nil {
+		logger.L.Fatalf("create index fail : %v", err)
+	}
+	// 重启后按序列取最后一条告警
+	_, err = alertCollection.Indexes().CreateOne(
+		context.Background(),
+		mongo.IndexModel{
+			Keys:    bson.D{{Key: "ruleId", Value: 1}, {Key: "host", Value: 1}, {Key: "time", Value: -1}},
+			Options: options.Index().SetName("AlertRuleHostTimeIndex"),
+		},
+	)
+	if err != nil {
+		logger.L.Fatalf("create index fail : %v", err)
+	}
+
+	channelCollection := database.Collection("NotifyChannel")
+
+	hostEventCollection := database.Collection("HostEvent")
+	_, err = hostEventCollection.Indexes().CreateOne(
+		context.Background(),
+		mongo.IndexModel{
+			Keys:    bson.D{{Key: "host", Value: 1}, {Key: "time", Value: -1}},
+			Options: options.Index().SetName("HostEventHostTimeIndex"),
+		},
+	)
+	if err != nil {
+		logger.L.Fatalf("create index fail : %v", err)
+	}
+
+	keyring, err := newKeyring(conf)
+	if err != nil {
+		logger.L.Fatalf("load master key fail : %v", err)
+	}
+
 	Client = &MongoClient{
-		mongoCli:          mgoCli,
-		userSSHCollection: userSSHCollection,
-		userCollection:    userCollection,
+		mongoCli:            mgoCli,
+		database:            database,
+		userSSHCollection:   userSSHCollection,
+		userCollection:      userCollection,
+		auditCollection:     auditCollection,
+		knownHostCollection: knownHostCollection,
+		alertRuleCollection: alertRuleCollection,
+		alertCollection:     alertCollection,
+		channelCollection:   channelCollection,
+		hostEventCollection: hostEventCollection,
+		keyring:             keyring,
 	}
 	logger.L.Traceln("MongoDB connect success")
 }
@@ -89,6 +205,7 @@ func GeneralSSHId(ssh UserSSH) string {
 	return fmt.Sprintf("%s:%s@%s:%d", ssh.UserName, ssh.User, ssh.Host, ssh.Port)
 }
 
+// MD5V 旧的密码哈希, 只用于校验迁移前的记录
 func MD5V(str string, salt string) string {
 	b := []byte(str)
 	s := []byte(salt)
@@ -105,15 +222,12 @@ func MD5V(str string, salt string) string {
 	return hex.EncodeToString(res)
 }
 
-func nextSalt() string {
-	rand.Seed(time.Now().UnixNano())
-	size := rand.Intn(26) + 1
-	warehouse := []int{97, 122}
-	result := make([]byte, 26)
-	for i := 0; i < size; i++ {
-		result[i] = uint8(warehouse[0] + rand.Intn(26))
+func hashPasswd(passwd string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(passwd), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
 	}
-	return string(result)
+	return string(hash), nil
 }
 
 func (c *MongoClient) Close() {
@@ -125,9 +239,15 @@ func (c *MongoClient) Close() {
 }
 
 func (c *MongoClient) InsertUser(user User) error {
-	user.Salt = nextSalt()
-	user.Passwd = MD5V(user.Passwd, user.Salt)
-	_, err := c.userCollection.InsertOne(context.TODO(), user)
+	hash, err := hashPasswd(user.Passwd)
+	if err != nil {
+		errText := fmt.Sprintf("Insert fail : %v", err)
+		return errors.New(errText)
+	}
+	user.Passwd = hash
+	user.Salt = ""
+	user.Algorithm = PasswdBcrypt
+	_, err = c.userCollection.InsertOne(context.TODO(), user)
 	if err != nil {
 		errText := fmt.Sprintf("Insert fail : %v", err)
 		return errors.New(errText)
@@ -139,21 +259,43 @@ func (c *MongoClient) CheckUserPasswd(user User) error {
 	var result User
 	if err := c.userCollection.FindOne(context.TODO(), bson.D{{"_id", user.UserName}}).Decode(&result); err != nil {
 		return err
-	} else if result.Passwd != MD5V(user.Passwd, result.Salt) {
-		return errors.New("pass word diff")
+	}
+	switch result.Algorithm {
+	case PasswdBcrypt:
+		if err := bcrypt.CompareHashAndPassword([]byte(result.Passwd), []byte(user.Passwd)); err != nil {
+			return errors.New("pass word diff")
+		}
+	case "", PasswdMD5:
+		if subtle.ConstantTimeCompare([]byte(result.Passwd), []byte(MD5V(user.Passwd, result.Salt))) != 1 {
+			return errors.New("pass word diff")
+		}
+		// 旧记录校验通过后用 bcrypt 重新哈希, 失败不影响本次登录
+		if err := c.ChangeUserPasswd(user); err != nil {
+			logger.L.Warnf("migrate passwd of %s fail : %v", user.UserName, err)
+		}
+	default:
+		return fmt.Errorf("unknown passwd algorithm %s", result.Algorithm)
 	}
 	return nil
 }
 
-func (c *MongoClient) ChangeUserPasswd(user User) interface{} {
-
-	salt := nextSalt()
+func (c *MongoClient) ChangeUserPasswd(user User) error {
+	hash, err := hashPasswd(user.Passwd)
+	if err != nil {
+		return errors.New("change passwd fail " + err.Error())
+	}
 
 	filter := bson.D{{"_id", user.UserName}}
-	update := bson.D{{"$set", bson.D{{"passwd", MD5V(user.Passwd, salt)}, {"salt", salt}}}}
+	update := bson.D{
+		{"$set", bson.D{{"passwd", hash}, {"algorithm", PasswdBcrypt}}},
+		{"$unset", bson.D{{"salt", ""}}},
+	}
 	result, err := c.userCollection.UpdateOne(context.TODO(), filter, update)
-	if err != nil || result.UpsertedCount == 1 {
-		return errors.New("change passwd fail" + err.Error())
+	if err != nil {
+		return errors.New("change passwd fail " + err.Error())
+	}
+	if result.MatchedCount == 0 {
+		return errors.New("change passwd fail user not found")
 	}
 	return nil
 }
@@ -163,6 +305,11 @@ func (c *MongoClient) InsertUserSSH(userSSH []UserSSH) ([]string, error) {
 	errText := ""
 	for _, ssh := range userSSH {
 		ssh.Key = GeneralSSHId(ssh)
+		ssh.Verified, ssh.UpdateTime = false, time.Now()
+		if err := c.keyring.sealUserSSH(&ssh); err != nil {
+			errText += fmt.Sprintf("insert fail %s : %v", ssh.Key, err)
+			continue
+		}
 		_, err := c.userSSHCollection.InsertOne(context.TODO(), ssh)
 		if err != nil {
 			errText += fmt.Sprintf("insert fail %s : %v", ssh.Key, err)
@@ -203,9 +350,16 @@ func (c *MongoClient) UpdateUserSSH(userSSHUpdater []UserSSHUpdater) ([]string,
 	for _, u := range userSSHUpdater {
 		u.OldSSH.Key = GeneralSSHId(u.OldSSH)
 		u.NewSSH.Key = GeneralSSHId(u.NewSSH)
-		result, err := c.userSSHCollection.UpdateOne(context.TODO(), bson.D{{"key", u.OldSSH.Key}}, bson.D{{"$set", u.NewSSH}})
+		u.NewSSH.Verified, u.NewSSH.UpdateTime = false, time.Now()
+		if err := c.keyring.sealUserSSH(&u.NewSSH); err != nil {
+			errText += fmt.Sprintf("update fail %s : %v", u.OldSSH.Key, err)
+			continue
+		}
+		result, err := c.userSSHCollection.UpdateOne(context.TODO(), bson.D{{"key", u.OldSSH.Key}}, bson.D{{"$set", u.NewSSH}, {"$unset", bson.D{{"passwd", ""}}}})
 		if err != nil || result.ModifiedCount == 0 {
 			errText += fmt.Sprintf("update fail %s : %v", u.OldSSH.Key, err)
+		} else {
+			r = append(r, u.OldSSH.Key)
 		}
 
 	}
@@ -230,5 +384,117 @@ func (c *MongoClient) SelectUserSSH(username string, name string) ([]UserSSH, er
 		errText := fmt.Sprintf("Select fail %s : %v", username, err)
 		return nil, errors.New(errText)
 	}
+	for i := range userSSH {
+		if err := c.keyring.openUserSSH(&userSSH[i]); err != nil {
+			errText := fmt.Sprintf("Select fail %s : %v", username, err)
+			return nil, errors.New(errText)
+		}
+	}
 	return userSSH, nil
 }
+
+// SelectAllUserSSH 返回所有用户保存的 ssh, 解密失败的记录跳过并在 error 中说明
+func (c *MongoClient) SelectAllUserSSH() ([]UserSSH, error) {
+	result, err := c.userSSHCollection.Find(context.TODO(), bson.D{})
+	if err != nil {
+		errText := fmt.Sprintf("Select all fail : %v", err)
+		return nil, errors.New(errText)
+	}
+	var userSSH []UserSSH
+	if err = result.All(context.TODO(), &userSSH); err != nil {
+		errText := fmt.Sprintf("Select all fail : %v", err)
+		return nil, errors.New(errText)
+	}
+	r := make([]UserSSH, 0, len(userSSH))
+	errText := ""
+	for i := range userSSH {
+		if err := c.keyring.openUserSSH(&userSSH[i]); err != nil {
+			errText += fmt.Sprintf("Select fail %s : %v", userSSH[i].Key, err)
+			continue
+		}
+		r = append(r, userSSH[i])
+	}
+	if errText == "" {
+		return r, nil
+	}
+	return r, errors.New(errText)
+}
+
+func (c *MongoClient) GetUserSSH(key string) (*UserSSH, error) {
+	var userSSH UserSSH
+	if err := c.userSSHCollection.FindOne(context.TODO(), bson.D{{"key", key}}).Decode(&userSSH); err != nil {
+		errText := fmt.Sprintf("Get fail %s : %v", key, err)
+		return nil, errors.New(errText)
+	}
+	if err := c.keyring.openUserSSH(&userSSH); err != nil {
+		errText := fmt.Sprintf("Get fail %s : %v", key, err)
+		return nil, errors.New(errText)
+	}
+	return &userSSH, nil
+}
+
+// SetUserSSHVerified 标记凭据登录成功, updateTime 为登录时读到的记录版本, 期间记录被修改时不标记
+func (c *MongoClient) SetUserSSHVerified(key string, updateTime time.Time) error {
+	filter := bson.D{{"key", key}, {"updateTime", updateTime}}
+	if updateTime.IsZero() {
+		// 旧记录没有 updateTime 字段
+		filter = bson.D{{"key", key}, {"updateTime", bson.D{{"$exists", false}}}}
+	}
+	if _, err := c.userSSHCollection.UpdateOne(context.TODO(), filter, bson.D{{"$set", bson.D{{"verified", true}}}}); err != nil {
+		errText := fmt.Sprintf("verify fail %s : %v", key, err)
+		return errors.New(errText)
+	}
+	return nil
+}
+
+// ReencryptUserSSH 用当前主密钥重新加密所有凭据, 包括旧的明文记录和旧主密钥加密的记录, 返回迁移的数量
+func (c *MongoClient) ReencryptUserSSH() (int, error) {
+	cursor, err := c.userSSHCollection.Find(context.TODO(), bson.D{})
+	if err != nil {
+		return 0, fmt.Errorf("reencrypt fail : %v", err)
+	}
+	defer cursor.Close(context.TODO())
+	count := 0
+	errText := ""
+	for cursor.Next(context.TODO()) {
+		var ssh UserSSH
+		if err := cursor.Decode(&ssh); err != nil {
+			errText += fmt.Sprintf("reencrypt decode fail : %v", err)
+			continue
+		}
+		if ssh.Sealed != nil && ssh.Sealed.KeyId == c.keyring.keyId {
+			continue
+		}
+		if err := c.keyring.openUserSSH(&ssh); err != nil {
+			errText += fmt.Sprintf("reencrypt fail %s : %v", ssh.Key, err)
+			continue
+		}
+		if err := c.keyring.sealUserSSH(&ssh); err != nil {
+			errText += fmt.Sprintf("reencrypt fail %s : %v", ssh.Key, err)
+			continue
+		}
+		update := bson.D{{"$set", bson.D{{"sealed", ssh.Sealed}}}, {"$unset", bson.D{{"passwd", ""}}}}
+		if _, err := c.userSSHCollection.UpdateOne(context.TODO(), bson.D{{"key", ssh.Key}}, update); err != nil {
+			errText += fmt.Sprintf("reencrypt fail %s : %v", ssh.Key, err)
+			continue
+		}
+		count++
+	}
+	if err := cursor.Err(); err != nil {
+		errText += fmt.Sprintf("reencrypt fail : %v", err)
+	}
+	if errText == "" {
+		return count, nil
+	}
+	return count, errors.New(errText)
+}
+
+func (c *MongoClient) InsertAudit(audit Audit) error {
+	audit.Time = time.Now()
+	_, err := c.auditCollection.InsertOne(context.TODO(), audit)
+	if err != nil {
+		errText := fmt.Sprintf("Insert audit fail : %v", err)
+		return errors.New(errText)
+	}
+	return nil
+}
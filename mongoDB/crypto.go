@@ -0,0 +1,259 @@
+package mongoDB
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/pelletier/go-toml"
+	"go.mongodb.org/mongo-driver/bson"
+	"io"
+	"logger"
+	"os"
+	"strings"
+)
+
+// SealedCredential 信封加密后的凭据, DataKey 为主密钥加密的数据密钥, Ciphertext 为数据密钥加密的凭据
+type SealedCredential struct {
+	KeyId      string `bson:"keyId"`
+	DataKey    []byte `bson:"dataKey"`
+	Ciphertext []byte `bson:"ciphertext"`
+}
+
+// credential 需要加密保存的 UserSSH 和 NotifyChannel 字段
+type credential struct {
+	Passwd      string `bson:"passwd"`
+	PrivateKey  string `bson:"privateKey,omitempty"`
+	Passphrase  string `bson:"passphrase,omitempty"`
+	Certificate string `bson:"certificate,omitempty"`
+	// URL Secret Headers 为 NotifyChannel 的 webhook 地址, 加签密钥和请求头, 可能包含 token
+	URL     string            `bson:"url,omitempty"`
+	Secret  string            `bson:"secret,omitempty"`
+	Headers map[string]string `bson:"headers,omitempty"`
+}
+
+type keyring struct {
+	keyId string
+	keys  map[string][]byte
+}
+
+// newKeyring 读取 crypto 配置, 当前主密钥来自 crypto.MasterKey 或 crypto.KeyFile,
+// 轮换前的旧主密钥放在 crypto.OldKeyFiles 中用于解密
+func newKeyring(conf *toml.Tree) (*keyring, error) {
+	k := &keyring{
+		keyId: conf.GetDefault("crypto.KeyId", "default").(string),
+		keys:  make(map[string][]byte),
+	}
+	if masterKey := conf.GetDefault("crypto.MasterKey", "").(string); masterKey != "" {
+		key, err := decodeMasterKey(masterKey)
+		if err != nil {
+			return nil, fmt.Errorf("crypto.MasterKey : %v", err)
+		}
+		k.keys[k.keyId] = key
+	} else {
+		key, err := loadOrCreateKeyFile(conf.GetDefault("crypto.KeyFile", "./master.key").(string))
+		if err != nil {
+			return nil, err
+		}
+		k.keys[k.keyId] = key
+	}
+	if oldKeyFiles, ok := conf.Get("crypto.OldKeyFiles").(*toml.Tree); ok {
+		for keyId, file := range oldKeyFiles.ToMap() {
+			path, ok := file.(string)
+			if !ok {
+				return nil, fmt.Errorf("crypto.OldKeyFiles.%s must be a path", keyId)
+			}
+			key, err := loadKeyFile(path)
+			if err != nil {
+				return nil, err
+			}
+			k.keys[keyId] = key
+		}
+	}
+	return k, nil
+}
+
+func decodeMasterKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("master key must be 32 bytes, got %d", len(key))
+	}
+	return key, nil
+}
+
+func loadKeyFile(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read key file %s fail : %v", path, err)
+	}
+	key, err := decodeMasterKey(string(b))
+	if err != nil {
+		return nil, fmt.Errorf("key file %s : %v", path, err)
+	}
+	return key, nil
+}
+
+func loadOrCreateKeyFile(path string) ([]byte, error) {
+	if _, err := os.Stat(path); err == nil {
+		return loadKeyFile(path)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("stat key file %s fail : %v", path, err)
+	}
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600); err != nil {
+		return nil, fmt.Errorf("create key file %s fail : %v", path, err)
+	}
+	logger.L.Warnf("master key not found, created new one at %s, keep it safe or stored credentials are lost", path)
+	return key, nil
+}
+
+func gcmSeal(key, plaintext, additional []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+func gcmOpen(key, ciphertext, additional []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, additional)
+}
+
+// seal 使用新的数据密钥加密凭据, 凭据与 UserName 绑定, 无法被挪到其他用户的记录中解密
+func (k *keyring) seal(c credential, userName string) (*SealedCredential, error) {
+	plaintext, err := bson.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	dataKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, err
+	}
+	ciphertext, err := gcmSeal(dataKey, plaintext, []byte(userName))
+	if err != nil {
+		return nil, err
+	}
+	wrappedKey, err := gcmSeal(k.keys[k.keyId], dataKey, []byte(k.keyId))
+	if err != nil {
+		return nil, err
+	}
+	return &SealedCredential{
+		KeyId:      k.keyId,
+		DataKey:    wrappedKey,
+		Ciphertext: ciphertext,
+	}, nil
+}
+
+func (k *keyring) open(s *SealedCredential, userName string) (credential, error) {
+	var c credential
+	masterKey, ok := k.keys[s.KeyId]
+	if !ok {
+		return c, fmt.Errorf("master key %s not configured", s.KeyId)
+	}
+	dataKey, err := gcmOpen(masterKey, s.DataKey, []byte(s.KeyId))
+	if err != nil {
+		return c, fmt.Errorf("unwrap data key fail : %v", err)
+	}
+	plaintext, err := gcmOpen(dataKey, s.Ciphertext, []byte(userName))
+	if err != nil {
+		return c, fmt.Errorf("decrypt credential fail : %v", err)
+	}
+	err = bson.Unmarshal(plaintext, &c)
+	return c, err
+}
+
+// sealUserSSH 把明文凭据加密进 Sealed, 并清空明文字段
+func (k *keyring) sealUserSSH(ssh *UserSSH) error {
+	sealed, err := k.seal(credential{
+		Passwd:      ssh.Passwd,
+		PrivateKey:  ssh.PrivateKey,
+		Passphrase:  ssh.Passphrase,
+		Certificate: ssh.Certificate,
+	}, ssh.UserName)
+	if err != nil {
+		return fmt.Errorf("seal %s fail : %v", ssh.Key, err)
+	}
+	ssh.Sealed = sealed
+	ssh.Passwd = ""
+	ssh.PrivateKey = ""
+	ssh.Passphrase = ""
+	ssh.Certificate = ""
+	return nil
+}
+
+// openUserSSH 解密 Sealed 填回明文字段, 没有 Sealed 的旧记录保持明文
+func (k *keyring) openUserSSH(ssh *UserSSH) error {
+	if ssh.Sealed == nil {
+		return nil
+	}
+	c, err := k.open(ssh.Sealed, ssh.UserName)
+	if err != nil {
+		return fmt.Errorf("open %s fail : %v", ssh.Key, err)
+	}
+	ssh.Passwd = c.Passwd
+	ssh.PrivateKey = c.PrivateKey
+	ssh.Passphrase = c.Passphrase
+	ssh.Certificate = c.Certificate
+	ssh.Sealed = nil
+	return nil
+}
+
+// sealNotifyChannel 把 webhook 地址, 加签密钥和请求头加密进 Sealed, 并清空明文字段
+func (k *keyring) sealNotifyChannel(channel *NotifyChannel) error {
+	sealed, err := k.seal(credential{
+		URL:     channel.URL,
+		Secret:  channel.Secret,
+		Headers: channel.Headers,
+	}, channel.UserName)
+	if err != nil {
+		return fmt.Errorf("seal %s fail : %v", channel.Id, err)
+	}
+	channel.Sealed = sealed
+	channel.URL = ""
+	channel.Secret = ""
+	channel.Headers = nil
+	return nil
+}
+
+func (k *keyring) openNotifyChannel(channel *NotifyChannel) error {
+	if channel.Sealed == nil {
+		return nil
+	}
+	c, err := k.open(channel.Sealed, channel.UserName)
+	if err != nil {
+		return fmt.Errorf("open %s fail : %v", channel.Id, err)
+	}
+	channel.URL = c.URL
+	channel.Secret = c.Secret
+	channel.Headers = c.Headers
+	channel.Sealed = nil
+	return nil
+}
@@ -0,0 +1,125 @@
+package mongoDB
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"time"
+)
+
+// KnownHost 用户信任的主机公钥, 公钥变化后新公钥保存在 Pending 中等待用户确认
+type KnownHost struct {
+	Key                string    `json:"key" bson:"key"`
+	UserName           string    `json:"username" bson:"username"`
+	Host               string    `json:"host" bson:"host"`
+	Port               int       `json:"port" bson:"port"`
+	PublicKey          string    `json:"publicKey" bson:"publicKey"`
+	Fingerprint        string    `json:"fingerprint" bson:"fingerprint"`
+	PendingPublicKey   string    `json:"pendingPublicKey" bson:"pendingPublicKey,omitempty"`
+	PendingFingerprint string    `json:"pendingFingerprint" bson:"pendingFingerprint,omitempty"`
+	CreateTime         time.Time `json:"createTime" bson:"createTime"`
+	UpdateTime         time.Time `json:"updateTime" bson:"updateTime"`
+}
+
+func GeneralKnownHostId(username string, host string, port int) string {
+	return fmt.Sprintf("%s:%s:%d", username, host, port)
+}
+
+// GetKnownHost 没有记录时返回 nil, nil
+func (c *MongoClient) GetKnownHost(key string) (*KnownHost, error) {
+	var knownHost KnownHost
+	err := c.knownHostCollection.FindOne(context.TODO(), bson.D{{"key", key}}).Decode(&knownHost)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	} else if err != nil {
+		errText := fmt.Sprintf("Get fail %s : %v", key, err)
+		return nil, errors.New(errText)
+	}
+	return &knownHost, nil
+}
+
+func (c *MongoClient) InsertKnownHost(knownHost KnownHost) error {
+	knownHost.Key = GeneralKnownHostId(knownHost.UserName, knownHost.Host, knownHost.Port)
+	knownHost.CreateTime = time.Now()
+	knownHost.UpdateTime = knownHost.CreateTime
+	_, err := c.knownHostCollection.InsertOne(context.TODO(), knownHost)
+	if err != nil {
+		errText := fmt.Sprintf("Insert fail %s : %v", knownHost.Key, err)
+		return errors.New(errText)
+	}
+	return nil
+}
+
+// PendingKnownHost 记录与已信任公钥不一致的新公钥
+func (c *MongoClient) PendingKnownHost(key string, publicKey string, fingerprint string) error {
+	update := bson.D{{"$set", bson.D{
+		{"pendingPublicKey", publicKey},
+		{"pendingFingerprint", fingerprint},
+		{"updateTime", time.Now()},
+	}}}
+	_, err := c.knownHostCollection.UpdateOne(context.TODO(), bson.D{{"key", key}}, update)
+	if err != nil {
+		errText := fmt.Sprintf("Update fail %s : %v", key, err)
+		return errors.New(errText)
+	}
+	return nil
+}
+
+// AcceptKnownHost 确认 fingerprint 对应的新公钥, fingerprint 必须与等待确认的一致
+func (c *MongoClient) AcceptKnownHost(key string, fingerprint string) error {
+	knownHost, err := c.GetKnownHost(key)
+	if err != nil {
+		return err
+	}
+	if knownHost == nil || knownHost.PendingFingerprint == "" || knownHost.PendingFingerprint != fingerprint {
+		return fmt.Errorf("accept fail %s : no pending host key %s", key, fingerprint)
+	}
+	update := bson.D{
+		{"$set", bson.D{
+			{"publicKey", knownHost.PendingPublicKey},
+			{"fingerprint", knownHost.PendingFingerprint},
+			{"updateTime", time.Now()},
+		}},
+		{"$unset", bson.D{{"pendingPublicKey", ""}, {"pendingFingerprint", ""}}},
+	}
+	filter := bson.D{{"key", key}, {"pendingFingerprint", fingerprint}}
+	result, err := c.knownHostCollection.UpdateOne(context.TODO(), filter, update)
+	if err != nil || result.ModifiedCount == 0 {
+		errText := fmt.Sprintf("accept fail %s : %v", key, err)
+		return errors.New(errText)
+	}
+	return nil
+}
+
+func (c *MongoClient) DeleteKnownHost(keys []string) ([]string, error) {
+	r := make([]string, 0)
+	errText := ""
+	for _, key := range keys {
+		result, err := c.knownHostCollection.DeleteOne(context.TODO(), bson.M{"key": key})
+		if err != nil || result.DeletedCount == 0 {
+			errText += fmt.Sprintf("delete fail %s : %v", key, err)
+		} else {
+			r = append(r, key)
+		}
+	}
+	if errText == "" {
+		return r, nil
+	}
+	return r, errors.New(errText)
+}
+
+func (c *MongoClient) SelectKnownHost(username string) ([]KnownHost, error) {
+	result, err := c.knownHostCollection.Find(context.TODO(), bson.D{{"username", username}})
+	if err != nil {
+		errText := fmt.Sprintf("Select fail %s : %v", username, err)
+		return nil, errors.New(errText)
+	}
+	knownHosts := make([]KnownHost, 0)
+	if err = result.All(context.TODO(), &knownHosts); err != nil {
+		errText := fmt.Sprintf("Select fail %s : %v", username, err)
+		return nil, errors.New(errText)
+	}
+	return knownHosts, nil
+}
@@ -0,0 +1,204 @@
+package mongoDB
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"logger"
+	"math"
+	"sort"
+	"time"
+)
+
+// MetricSample 一个字段在某一时刻的值, 每个事件保存在各自的时序集合 Metric.<事件> 中
+type MetricSample struct {
+	Time  time.Time  `json:"time" bson:"time"`
+	Meta  MetricMeta `json:"meta" bson:"meta"`
+	Value float64    `json:"value" bson:"value"`
+}
+
+type MetricMeta struct {
+	// Host 为 user@host:port, 与监控的 ssh 一一对应
+	Host   string       `json:"host" bson:"host"`
+	Name   string       `json:"name" bson:"name"`
+	Labels MetricLabels `json:"labels" bson:"labels,omitempty"`
+}
+
+// MetricLabels 按 key 排序写入, 相同的 labels 在 MongoDB 中是相同的文档, 可以直接用来分组
+type MetricLabels map[string]string
+
+func (l MetricLabels) MarshalBSONValue() (bsontype.Type, []byte, error) {
+	keys := make([]string, 0, len(l))
+	for k := range l {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	d := make(bson.D, 0, len(keys))
+	for _, k := range keys {
+		d = append(d, bson.E{Key: k, Value: l[k]})
+	}
+	return bson.MarshalValue(d)
+}
+
+// MetricBucket 同一组 labels 在 [Time, Time+step) 内的样本的聚合值
+type MetricBucket struct {
+	Labels map[string]string
+	Time   time.Time
+	Avg    float64
+	Min    float64
+	Max    float64
+	P95    float64
+	Count  int
+}
+
+func metricCollectionName(event string) string {
+	return "Metric." + event
+}
+
+// EnsureMetricCollection 创建事件的时序集合并设置保留时间, 已存在时只修改保留时间,
+// MongoDB 5.0 之前不支持时序集合, 改用普通集合和 time 上的 TTL 索引
+func (c *MongoClient) EnsureMetricCollection(event string, retention time.Duration) error {
+	name := metricCollectionName(event)
+	expire := int64(retention / time.Second)
+	specs, err := c.database.ListCollectionSpecifications(context.TODO(), bson.D{{"name", name}})
+	if err != nil {
+		errText := fmt.Sprintf("list collection %s fail : %v", name, err)
+		return errors.New(errText)
+	}
+	timeSeries := false
+	if len(specs) == 0 {
+		opts := options.CreateCollection().
+			SetTimeSeriesOptions(options.TimeSeries().SetTimeField("time").SetMetaField("meta").SetGranularity("seconds")).
+			SetExpireAfterSeconds(expire)
+		if err := c.database.CreateCollection(context.TODO(), name, opts); err != nil {
+			logger.L.Warnf("create time series collection %s fail, use ttl index instead : %v", name, err)
+		} else {
+			timeSeries = true
+		}
+	} else {
+		timeSeries = specs[0].Type == "timeseries"
+		if timeSeries {
+			command := bson.D{{"collMod", name}, {"expireAfterSeconds", expire}}
+			if err := c.database.RunCommand(context.TODO(), command).Err(); err != nil {
+				errText := fmt.Sprintf("change retention of %s fail : %v", name, err)
+				return errors.New(errText)
+			}
+		}
+	}
+
+	collection := c.database.Collection(name)
+	if !timeSeries {
+		_, err := collection.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+			Keys:    bson.D{{Key: "time", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32(expire)).SetName("MetricTTLIndex"),
+		})
+		// 保留时间修改后索引选项冲突, 用 collMod 修改已有索引
+		if err != nil {
+			index := bson.D{{"name", "MetricTTLIndex"}, {"expireAfterSeconds", expire}}
+			command := bson.D{{"collMod", name}, {"index", index}}
+			if err := c.database.RunCommand(context.TODO(), command).Err(); err != nil {
+				errText := fmt.Sprintf("change retention of %s fail : %v", name, err)
+				return errors.New(errText)
+			}
+		}
+	}
+	_, err = collection.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "meta.host", Value: 1}, {Key: "meta.name", Value: 1}, {Key: "time", Value: 1}},
+		Options: options.Index().SetName("MetricHostNameTimeIndex"),
+	})
+	if err != nil {
+		errText := fmt.Sprintf("create index of %s fail : %v", name, err)
+		return errors.New(errText)
+	}
+	return nil
+}
+
+func (c *MongoClient) InsertMetricSamples(event string, samples []MetricSample) error {
+	if len(samples) == 0 {
+		return nil
+	}
+	docs := make([]interface{}, len(samples))
+	for i := range samples {
+		docs[i] = samples[i]
+	}
+	_, err := c.database.Collection(metricCollectionName(event)).InsertMany(context.TODO(), docs, options.InsertMany().SetOrdered(false))
+	if err != nil {
+		errText := fmt.Sprintf("Insert %d samples of %s fail : %v", len(samples), event, err)
+		return errors.New(errText)
+	}
+	return nil
+}
+
+// AggregateMetric 按 step 把 [from, to) 内 host 的 name 字段分桶聚合, labels 不为空时只统计匹配的样本,
+// 桶从 from 开始对齐, 结果按 labels 分组后按时间排序
+func (c *MongoClient) AggregateMetric(event string, host string, name string, labels map[string]string, from time.Time, to time.Time, step time.Duration) ([]MetricBucket, error) {
+	match := bson.M{
+		"meta.host": host,
+		"meta.name": name,
+		"time":      bson.M{"$gte": from, "$lt": to},
+	}
+	for k, v := range labels {
+		match["meta.labels."+k] = v
+	}
+	bucket := bson.M{"$subtract": bson.A{"$time", bson.M{"$mod": bson.A{bson.M{"$subtract": bson.A{"$time", from}}, step.Milliseconds()}}}}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$group", Value: bson.M{
+			"_id":    bson.M{"labels": "$meta.labels", "time": bucket},
+			"avg":    bson.M{"$avg": "$value"},
+			"min":    bson.M{"$min": "$value"},
+			"max":    bson.M{"$max": "$value"},
+			"values": bson.M{"$push": "$value"},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "_id.time", Value: 1}}}},
+	}
+	cursor, err := c.database.Collection(metricCollectionName(event)).Aggregate(context.TODO(), pipeline)
+	if err != nil {
+		errText := fmt.Sprintf("Aggregate %s of %s fail : %v", name, host, err)
+		return nil, errors.New(errText)
+	}
+	var result []struct {
+		Id struct {
+			Labels map[string]string `bson:"labels"`
+			Time   time.Time         `bson:"time"`
+		} `bson:"_id"`
+		Avg    float64   `bson:"avg"`
+		Min    float64   `bson:"min"`
+		Max    float64   `bson:"max"`
+		Values []float64 `bson:"values"`
+	}
+	if err := cursor.All(context.TODO(), &result); err != nil {
+		errText := fmt.Sprintf("Aggregate %s of %s fail : %v", name, host, err)
+		return nil, errors.New(errText)
+	}
+	r := make([]MetricBucket, len(result))
+	for i, b := range result {
+		r[i] = MetricBucket{
+			Labels: b.Id.Labels,
+			Time:   b.Id.Time,
+			Avg:    b.Avg,
+			Min:    b.Min,
+			Max:    b.Max,
+			P95:    percentile(b.Values, 0.95),
+			Count:  len(b.Values),
+		}
+	}
+	return r, nil
+}
+
+// percentile 最近秩法, values 会被排序
+func percentile(values []float64, p float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sort.Float64s(values)
+	rank := int(math.Ceil(p*float64(len(values)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return values[rank]
+}
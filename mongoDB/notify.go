@@ -0,0 +1,175 @@
+package mongoDB
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+const (
+	NotifyWebhook  = "webhook"
+	NotifyEmail    = "email"
+	NotifySlack    = "slack"
+	NotifyDingTalk = "dingtalk"
+	NotifyFeishu   = "feishu"
+)
+
+// NotifyChannel 用户接收告警通知的渠道
+type NotifyChannel struct {
+	Id       string `json:"id" bson:"_id"`
+	UserName string `json:"username" bson:"username"`
+	Name     string `json:"name" bson:"name"`
+	Type     string `json:"type" bson:"type"`
+	Enable   bool   `json:"enable" bson:"enable"`
+	// Severities 只通知这些级别的告警, 为空时通知全部
+	Severities []string `json:"severities" bson:"severities"`
+	// URL Secret Headers 只在内存中为明文, 写入前加密进 Sealed
+	URL     string            `json:"url" bson:"url,omitempty"`
+	Secret  string            `json:"secret" bson:"secret,omitempty"`
+	Headers map[string]string `json:"headers" bson:"headers,omitempty"`
+	Sealed  *SealedCredential `json:"-" bson:"sealed,omitempty"`
+	// Template webhook 的 JSON body 模板, 为空时发送告警本身
+	Template string `json:"template" bson:"template"`
+	// To 邮件收件人
+	To []string `json:"to" bson:"to"`
+	// RateLimit 每分钟最多发送的通知数, 为 0 时使用 conf.toml 中的默认值
+	RateLimit  int       `json:"rateLimit" bson:"rateLimit"`
+	CreateTime time.Time `json:"createTime" bson:"createTime"`
+	UpdateTime time.Time `json:"updateTime" bson:"updateTime"`
+}
+
+func (c *MongoClient) InsertNotifyChannel(channel NotifyChannel) error {
+	channel.CreateTime = time.Now()
+	channel.UpdateTime = channel.CreateTime
+	if err := c.keyring.sealNotifyChannel(&channel); err != nil {
+		errText := fmt.Sprintf("Insert fail %s : %v", channel.Id, err)
+		return errors.New(errText)
+	}
+	_, err := c.channelCollection.InsertOne(context.TODO(), channel)
+	if err != nil {
+		errText := fmt.Sprintf("Insert fail %s : %v", channel.Id, err)
+		return errors.New(errText)
+	}
+	return nil
+}
+
+// UpdateNotifyChannel 只能修改 channel.UserName 自己的渠道
+func (c *MongoClient) UpdateNotifyChannel(channel NotifyChannel) error {
+	if err := c.keyring.sealNotifyChannel(&channel); err != nil {
+		errText := fmt.Sprintf("update fail %s : %v", channel.Id, err)
+		return errors.New(errText)
+	}
+	update := bson.D{{"$set", bson.D{
+		{"name", channel.Name},
+		{"type", channel.Type},
+		{"enable", channel.Enable},
+		{"severities", channel.Severities},
+		{"sealed", channel.Sealed},
+		{"template", channel.Template},
+		{"to", channel.To},
+		{"rateLimit", channel.RateLimit},
+		{"updateTime", time.Now()},
+	}}}
+	result, err := c.channelCollection.UpdateOne(context.TODO(), bson.D{{"_id", channel.Id}, {"username", channel.UserName}}, update)
+	if err != nil || result.MatchedCount == 0 {
+		errText := fmt.Sprintf("update fail %s : %v", channel.Id, err)
+		return errors.New(errText)
+	}
+	return nil
+}
+
+func (c *MongoClient) DeleteNotifyChannel(username string, ids []string) ([]string, error) {
+	r := make([]string, 0)
+	errText := ""
+	for _, id := range ids {
+		result, err := c.channelCollection.DeleteOne(context.TODO(), bson.D{{"_id", id}, {"username", username}})
+		if err != nil || result.DeletedCount == 0 {
+			errText += fmt.Sprintf("delete fail %s : %v", id, err)
+		} else {
+			r = append(r, id)
+		}
+	}
+	if errText == "" {
+		return r, nil
+	}
+	return r, errors.New(errText)
+}
+
+func (c *MongoClient) SelectNotifyChannel(username string) ([]NotifyChannel, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "createTime", Value: 1}})
+	result, err := c.channelCollection.Find(context.TODO(), bson.D{{"username", username}}, opts)
+	if err != nil {
+		errText := fmt.Sprintf("Select fail %s : %v", username, err)
+		return nil, errors.New(errText)
+	}
+	channels := make([]NotifyChannel, 0)
+	if err = result.All(context.TODO(), &channels); err != nil {
+		errText := fmt.Sprintf("Select fail %s : %v", username, err)
+		return nil, errors.New(errText)
+	}
+	for i := range channels {
+		if err := c.keyring.openNotifyChannel(&channels[i]); err != nil {
+			errText := fmt.Sprintf("Select fail %s : %v", username, err)
+			return nil, errors.New(errText)
+		}
+	}
+	return channels, nil
+}
+
+func (c *MongoClient) GetNotifyChannel(username string, id string) (*NotifyChannel, error) {
+	var channel NotifyChannel
+	if err := c.channelCollection.FindOne(context.TODO(), bson.D{{"_id", id}, {"username", username}}).Decode(&channel); err != nil {
+		errText := fmt.Sprintf("Get fail %s : %v", id, err)
+		return nil, errors.New(errText)
+	}
+	if err := c.keyring.openNotifyChannel(&channel); err != nil {
+		errText := fmt.Sprintf("Get fail %s : %v", id, err)
+		return nil, errors.New(errText)
+	}
+	return &channel, nil
+}
+
+// ReencryptNotifyChannel 用当前主密钥重新加密旧主密钥加密的渠道, 返回迁移的数量
+func (c *MongoClient) ReencryptNotifyChannel() (int, error) {
+	cursor, err := c.channelCollection.Find(context.TODO(), bson.D{})
+	if err != nil {
+		return 0, fmt.Errorf("reencrypt fail : %v", err)
+	}
+	defer cursor.Close(context.TODO())
+	count := 0
+	errText := ""
+	for cursor.Next(context.TODO()) {
+		var channel NotifyChannel
+		if err := cursor.Decode(&channel); err != nil {
+			errText += fmt.Sprintf("reencrypt decode fail : %v", err)
+			continue
+		}
+		if channel.Sealed != nil && channel.Sealed.KeyId == c.keyring.keyId {
+			continue
+		}
+		if err := c.keyring.openNotifyChannel(&channel); err != nil {
+			errText += fmt.Sprintf("reencrypt fail %s : %v", channel.Id, err)
+			continue
+		}
+		if err := c.keyring.sealNotifyChannel(&channel); err != nil {
+			errText += fmt.Sprintf("reencrypt fail %s : %v", channel.Id, err)
+			continue
+		}
+		update := bson.D{{"$set", bson.D{{"sealed", channel.Sealed}}}, {"$unset", bson.D{{"url", ""}, {"secret", ""}, {"headers", ""}}}}
+		if _, err := c.channelCollection.UpdateOne(context.TODO(), bson.D{{"_id", channel.Id}}, update); err != nil {
+			errText += fmt.Sprintf("reencrypt fail %s : %v", channel.Id, err)
+			continue
+		}
+		count++
+	}
+	if err := cursor.Err(); err != nil {
+		errText += fmt.Sprintf("reencrypt fail : %v", err)
+	}
+	if errText == "" {
+		return count, nil
+	}
+	return count, errors.New(errText)
+}
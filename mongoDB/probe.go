@@ -0,0 +1,73 @@
+package mongoDB
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+// 主机状态, hostKeyChanged 和 authFail 时 sshd 仍然响应, 计入可达时间, 只有 down 触发不可达告警
+const (
+	HostUp             = "up"
+	HostDown           = "down"
+	HostHostKeyChanged = "hostKeyChanged"
+	HostAuthFail       = "authFail"
+)
+
+// HostEvent 保存的 ssh 可达状态的一次变化, 两次变化之间状态不变
+type HostEvent struct {
+	UserName string `json:"username" bson:"username"`
+	// Host 保存的 ssh 的 key
+	Host  string `json:"host" bson:"host"`
+	State string `json:"state" bson:"state"`
+	// Stage 失败的阶段 tcp, ssh, hostKey 或 auth, Error 为失败原因, 恢复时都为空
+	Stage string `json:"stage" bson:"stage"`
+	Error string `json:"error" bson:"error"`
+	// Latency 建立 TCP 连接的毫秒数
+	Latency float64   `json:"latency" bson:"latency"`
+	Time    time.Time `json:"time" bson:"time"`
+}
+
+func (c *MongoClient) InsertHostEvent(event HostEvent) error {
+	_, err := c.hostEventCollection.InsertOne(context.TODO(), event)
+	if err != nil {
+		errText := fmt.Sprintf("Insert host event of %s fail : %v", event.Host, err)
+		return errors.New(errText)
+	}
+	return nil
+}
+
+// SelectHostEvent 按时间顺序返回 host 在 [from, to) 内的状态变化
+func (c *MongoClient) SelectHostEvent(host string, from time.Time, to time.Time) ([]HostEvent, error) {
+	filter := bson.D{{"host", host}, {"time", bson.M{"$gte": from, "$lt": to}}}
+	opts := options.Find().SetSort(bson.D{{Key: "time", Value: 1}})
+	result, err := c.hostEventCollection.Find(context.TODO(), filter, opts)
+	if err != nil {
+		errText := fmt.Sprintf("Select host event fail %s : %v", host, err)
+		return nil, errors.New(errText)
+	}
+	events := make([]HostEvent, 0)
+	if err = result.All(context.TODO(), &events); err != nil {
+		errText := fmt.Sprintf("Select host event fail %s : %v", host, err)
+		return nil, errors.New(errText)
+	}
+	return events, nil
+}
+
+// LastHostEvent host 在 before 之前的最后一次状态变化, 没有记录时返回 nil, nil
+func (c *MongoClient) LastHostEvent(host string, before time.Time) (*HostEvent, error) {
+	var event HostEvent
+	opts := options.FindOne().SetSort(bson.D{{Key: "time", Value: -1}})
+	err := c.hostEventCollection.FindOne(context.TODO(), bson.D{{"host", host}, {"time", bson.M{"$lt": before}}}, opts).Decode(&event)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	} else if err != nil {
+		errText := fmt.Sprintf("Get last host event fail %s : %v", host, err)
+		return nil, errors.New(errText)
+	}
+	return &event, nil
+}
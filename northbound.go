@@ -1,12 +1,18 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	mapSet "github.com/deckarep/golang-set/v2"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
+	"logger"
 	"mongoDB"
 	"net/http"
+	"sort"
+	"ssh"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -23,11 +29,31 @@ type SelectUserSSHResponse struct {
 }
 
 type SelectUserSSHResponseData struct {
-	Name   string `json:"name"`
-	Port   int    `json:"port"`
-	Host   string `json:"host"`
-	User   string `json:"user"`
-	Passwd string `json:"passwd"`
+	Key         string         `json:"key"`
+	Name        string         `json:"name"`
+	Port        int            `json:"port"`
+	Host        string         `json:"host"`
+	User        string         `json:"user"`
+	AuthType    string         `json:"authType"`
+	HasPassword bool           `json:"hasPassword"`
+	ProxyJump   []string       `json:"proxyJump"`
+	Intervals   map[string]int `json:"intervals"`
+	Groups      []string       `json:"groups"`
+}
+
+type RevealUserSSHResponse struct {
+	Code    int                        `json:"code"`
+	Message *string                    `json:"message"`
+	Data    *RevealUserSSHResponseData `json:"data"`
+}
+
+type RevealUserSSHResponseData struct {
+	Key         string `json:"key"`
+	AuthType    string `json:"authType"`
+	Passwd      string `json:"passwd"`
+	PrivateKey  string `json:"privateKey"`
+	Passphrase  string `json:"passphrase"`
+	Certificate string `json:"certificate"`
 }
 
 type AddUserSSHResponse struct {
@@ -37,6 +63,7 @@ type AddUserSSHResponse struct {
 }
 
 type AddUserSSHResponseData struct {
+	Key   string `json:"key"`
 	Port  int    `json:"port"`
 	Host  string `json:"host"`
 	User  string `json:"user"`
@@ -74,11 +101,21 @@ type AddUserSSHRequest struct {
 }
 
 type AddUserSSHRequestData struct {
-	Name   string  `json:"name" validate:"required"`
-	Port   int     `json:"port" validate:"required"`
-	Host   string  `json:"host" validate:"required,ip_addr"`
-	User   string  `json:"user" validate:"required"`
-	Passwd *string `json:"passwd" validate:"required"`
+	Name        string  `json:"name" validate:"required"`
+	Port        int     `json:"port" validate:"required"`
+	Host        string  `json:"host" validate:"required,ip_addr"`
+	User        string  `json:"user" validate:"required"`
+	AuthType    string  `json:"authType" validate:"omitempty,oneof=password publicKey certificate keyboardInteractive"`
+	Passwd      *string `json:"passwd"`
+	PrivateKey  string  `json:"privateKey"`
+	Passphrase  string  `json:"passphrase"`
+	Certificate string  `json:"certificate"`
+	// 跳板机, 为已保存的 ssh 的 key
+	ProxyJump []string `json:"proxyJump"`
+	// 事件的采集间隔, 单位秒
+	Intervals map[string]int `json:"intervals" validate:"omitempty,dive,keys,oneof=cpuInfo cpuPerformance memoryPerformance uptime loadavg netDev netStat temp disk process rough,endkeys,min=1"`
+	// 分组, 告警规则可以作用于一个分组
+	Groups []string `json:"groups" validate:"omitempty,dive,required"`
 }
 
 type DeleteUserSSHRequest struct {
@@ -96,14 +133,93 @@ type UpdateUserSSHRequest struct {
 }
 
 type UpdateUserSSHRequestData struct {
-	OldPort   int     `json:"oldPort" validate:"required"`
-	OldHost   string  `json:"oldHost" validate:"required,ip_addr"`
-	OldUser   string  `json:"oldUser" validate:"required"`
-	NewPort   int     `json:"newPort" validate:"required"`
-	NewHost   string  `json:"newHost" validate:"required,ip_addr"`
-	NewUser   string  `json:"newUser" validate:"required"`
-	NewName   string  `json:"newName" validate:"required"`
-	NewPasswd *string `json:"newPasswd" validate:"required"`
+	OldPort     int    `json:"oldPort" validate:"required"`
+	OldHost     string `json:"oldHost" validate:"required,ip_addr"`
+	OldUser     string `json:"oldUser" validate:"required"`
+	NewPort     int    `json:"newPort" validate:"required"`
+	NewHost     string `json:"newHost" validate:"required,ip_addr"`
+	NewUser     string `json:"newUser" validate:"required"`
+	NewName     string `json:"newName" validate:"required"`
+	NewAuthType string `json:"newAuthType" validate:"omitempty,oneof=password publicKey certificate keyboardInteractive"`
+	// 凭据为空时沿用已保存的凭据
+	NewPasswd      *string        `json:"newPasswd"`
+	NewPrivateKey  string         `json:"newPrivateKey"`
+	NewPassphrase  string         `json:"newPassphrase"`
+	NewCertificate string         `json:"newCertificate"`
+	NewProxyJump   []string       `json:"newProxyJump"`
+	NewIntervals   map[string]int `json:"newIntervals" validate:"omitempty,dive,keys,oneof=cpuInfo cpuPerformance memoryPerformance uptime loadavg netDev netStat temp disk process rough,endkeys,min=1"`
+	NewGroups      []string       `json:"newGroups" validate:"omitempty,dive,required"`
+}
+
+type RevealUserSSHRequest struct {
+	Key string `json:"key" validate:"required"`
+	// 账号密码, 查看凭据前需要再次确认
+	Passwd string `json:"passwd" validate:"required"`
+}
+
+type SelectKnownHostResponse struct {
+	Code    int                 `json:"code"`
+	Message *string             `json:"message"`
+	Data    []mongoDB.KnownHost `json:"data"`
+}
+
+type AcceptKnownHostRequest struct {
+	Host string `json:"host" validate:"required,ip_addr"`
+	Port int    `json:"port" validate:"required"`
+	// 需要接受的新公钥指纹, 必须与连接时记录的一致
+	Fingerprint string `json:"fingerprint" validate:"required"`
+}
+
+type RevokeKnownHostRequest struct {
+	Data []RevokeKnownHostRequestData `json:"data" validate:"required,dive"`
+}
+
+type RevokeKnownHostRequestData struct {
+	Host string `json:"host" validate:"required,ip_addr"`
+	Port int    `json:"port" validate:"required"`
+}
+
+type RevokeKnownHostResponse struct {
+	Code    int                           `json:"code"`
+	Message *string                       `json:"message"`
+	Data    []RevokeKnownHostResponseData `json:"data"`
+}
+
+type RevokeKnownHostResponseData struct {
+	Host    string `json:"host"`
+	Port    int    `json:"port"`
+	Revoked bool   `json:"revoked"`
+}
+
+type MetricHistoryResponse struct {
+	Code    int                        `json:"code"`
+	Message *string                    `json:"message"`
+	Data    *MetricHistoryResponseData `json:"data"`
+}
+
+type MetricHistoryResponseData struct {
+	Host   string    `json:"host"`
+	Metric string    `json:"metric"`
+	From   time.Time `json:"from"`
+	To     time.Time `json:"to"`
+	// Step 每个点覆盖的秒数
+	Step   int64                 `json:"step"`
+	Series []MetricHistorySeries `json:"series"`
+}
+
+// MetricHistorySeries 同一组 labels 的一条曲线, 例如一个网卡
+type MetricHistorySeries struct {
+	Labels map[string]string    `json:"labels"`
+	Points []MetricHistoryPoint `json:"points"`
+}
+
+type MetricHistoryPoint struct {
+	Time  time.Time `json:"time"`
+	Avg   float64   `json:"avg"`
+	Min   float64   `json:"min"`
+	Max   float64   `json:"max"`
+	P95   float64   `json:"p95"`
+	Count int       `json:"count"`
 }
 
 type RegisterRequest struct {
@@ -146,14 +262,28 @@ func addUserSSHHandler(context *gin.Context) {
 		username := context.Request.Header.Get("User-Name")
 		userSSH := make([]mongoDB.UserSSH, 0)
 		for _, ssh := range addUserSSHRequest.Data {
-			userSSH = append(userSSH, mongoDB.UserSSH{
-				UserName: username,
-				Name:     ssh.Name,
-				Port:     ssh.Port,
-				Host:     ssh.Host,
-				User:     ssh.User,
-				Passwd:   *ssh.Passwd,
-			})
+			u := mongoDB.UserSSH{
+				UserName:    username,
+				Name:        ssh.Name,
+				Port:        ssh.Port,
+				Host:        ssh.Host,
+				User:        ssh.User,
+				AuthType:    ssh.AuthType,
+				PrivateKey:  ssh.PrivateKey,
+				Passphrase:  ssh.Passphrase,
+				Certificate: ssh.Certificate,
+				ProxyJump:   ssh.ProxyJump,
+				Intervals:   ssh.Intervals,
+				Groups:      ssh.Groups,
+			}
+			if ssh.Passwd != nil {
+				u.Passwd = *ssh.Passwd
+			}
+			if err := userSSHAuthHelper(&u); err != nil {
+				authFailHelper(context, err)
+				return
+			}
+			userSSH = append(userSSH, u)
 		}
 		res, err := mongoDB.Client.InsertUserSSH(userSSH)
 		addUserSSHResponse := &AddUserSSHResponse{
@@ -170,6 +300,7 @@ func addUserSSHHandler(context *gin.Context) {
 		for _, ssh := range userSSH {
 			if resSet.Contains(mongoDB.GeneralSSHId(ssh)) {
 				addUserSSHResponse.Data = append(addUserSSHResponse.Data, AddUserSSHResponseData{
+					Key:   mongoDB.GeneralSSHId(ssh),
 					Port:  ssh.Port,
 					Host:  ssh.Host,
 					User:  ssh.User,
@@ -177,6 +308,7 @@ func addUserSSHHandler(context *gin.Context) {
 				})
 			} else {
 				addUserSSHResponse.Data = append(addUserSSHResponse.Data, AddUserSSHResponseData{
+					Key:   mongoDB.GeneralSSHId(ssh),
 					Port:  ssh.Port,
 					Host:  ssh.Host,
 					User:  ssh.User,
@@ -240,7 +372,7 @@ func updateUserSSHHandler(context *gin.Context) {
 		username := context.Request.Header.Get("User-Name")
 		userSSHUpdater := make([]mongoDB.UserSSHUpdater, 0)
 		for _, ssh := range updateUserSSHRequest.Data {
-			userSSHUpdater = append(userSSHUpdater, mongoDB.UserSSHUpdater{
+			u := mongoDB.UserSSHUpdater{
 				OldSSH: mongoDB.UserSSH{
 					UserName: username,
 					Port:     ssh.OldPort,
@@ -248,14 +380,44 @@ func updateUserSSHHandler(context *gin.Context) {
 					User:     ssh.OldUser,
 				},
 				NewSSH: mongoDB.UserSSH{
-					UserName: username,
-					Port:     ssh.NewPort,
-					Host:     ssh.NewHost,
-					User:     ssh.NewUser,
-					Passwd:   *ssh.NewPasswd,
-					Name:     ssh.NewName,
+					UserName:    username,
+					Port:        ssh.NewPort,
+					Host:        ssh.NewHost,
+					User:        ssh.NewUser,
+					Name:        ssh.NewName,
+					AuthType:    ssh.NewAuthType,
+					PrivateKey:  ssh.NewPrivateKey,
+					Passphrase:  ssh.NewPassphrase,
+					Certificate: ssh.NewCertificate,
+					ProxyJump:   ssh.NewProxyJump,
+					Intervals:   ssh.NewIntervals,
+					Groups:      ssh.NewGroups,
 				},
-			})
+			}
+			if ssh.NewPasswd != nil {
+				u.NewSSH.Passwd = *ssh.NewPasswd
+			}
+			// 前端拿不到已保存的凭据, 没有提交的凭据沿用旧的
+			if old, err := mongoDB.Client.GetUserSSH(mongoDB.GeneralSSHId(u.OldSSH)); err == nil {
+				if u.NewSSH.AuthType == "" {
+					u.NewSSH.AuthType = old.AuthType
+				}
+				if ssh.NewPasswd == nil {
+					u.NewSSH.Passwd = old.Passwd
+				}
+				if u.NewSSH.PrivateKey == "" {
+					u.NewSSH.PrivateKey = old.PrivateKey
+					u.NewSSH.Passphrase = old.Passphrase
+				}
+				if u.NewSSH.Certificate == "" {
+					u.NewSSH.Certificate = old.Certificate
+				}
+			}
+			if err := userSSHAuthHelper(&u.NewSSH); err != nil {
+				authFailHelper(context, err)
+				return
+			}
+			userSSHUpdater = append(userSSHUpdater, u)
 		}
 		res, err := mongoDB.Client.UpdateUserSSH(userSSHUpdater)
 		updateUserSSHResponse := &UpdateUserSSHResponse{
@@ -307,16 +469,187 @@ func selectUserSSHHandler(context *gin.Context) {
 	}
 	for _, ssh := range res {
 		selectUserSSHResponse.Data = append(selectUserSSHResponse.Data, SelectUserSSHResponseData{
-			Port:   ssh.Port,
-			Host:   ssh.Host,
-			User:   ssh.User,
-			Name:   ssh.Name,
-			Passwd: ssh.Passwd,
+			Key:         ssh.Key,
+			Port:        ssh.Port,
+			Host:        ssh.Host,
+			User:        ssh.User,
+			Name:        ssh.Name,
+			AuthType:    sshAuthType(ssh),
+			HasPassword: ssh.Passwd != "",
+			ProxyJump:   ssh.ProxyJump,
+			Intervals:   ssh.Intervals,
+			Groups:      ssh.Groups,
 		})
 	}
 	context.JSON(http.StatusOK, selectUserSSHResponse)
 }
 
+func sshAuthType(ssh mongoDB.UserSSH) string {
+	if ssh.AuthType == "" {
+		return mongoDB.AuthPassword
+	}
+	return ssh.AuthType
+}
+
+// userSSHAuthHelper 按 authType 只保留需要的凭据, 并检查凭据能否用于连接
+func userSSHAuthHelper(ssh *mongoDB.UserSSH) error {
+	switch ssh.AuthType {
+	case "", mongoDB.AuthPassword, mongoDB.AuthKeyboardInteractive:
+		if ssh.AuthType == "" {
+			ssh.AuthType = mongoDB.AuthPassword
+		}
+		if ssh.Passwd == "" {
+			return fmt.Errorf("%s : %s auth needs passwd", mongoDB.GeneralSSHId(*ssh), ssh.AuthType)
+		}
+		ssh.PrivateKey, ssh.Passphrase, ssh.Certificate = "", "", ""
+	case mongoDB.AuthPublicKey:
+		if ssh.PrivateKey == "" {
+			return fmt.Errorf("%s : %s auth needs privateKey", mongoDB.GeneralSSHId(*ssh), ssh.AuthType)
+		}
+		ssh.Passwd, ssh.Certificate = "", ""
+	case mongoDB.AuthCertificate:
+		if ssh.PrivateKey == "" || ssh.Certificate == "" {
+			return fmt.Errorf("%s : %s auth needs privateKey and certificate", mongoDB.GeneralSSHId(*ssh), ssh.AuthType)
+		}
+		ssh.Passwd = ""
+	default:
+		return fmt.Errorf("%s : unknown auth type %s", mongoDB.GeneralSSHId(*ssh), ssh.AuthType)
+	}
+	if err := sshAuth(ssh).Validate(); err != nil {
+		return fmt.Errorf("%s : %v", mongoDB.GeneralSSHId(*ssh), err)
+	}
+	if _, err := proxyJumpHops(ssh); err != nil {
+		return fmt.Errorf("%s : %v", mongoDB.GeneralSSHId(*ssh), err)
+	}
+	return nil
+}
+
+func authFailHelper(context *gin.Context, err error) {
+	errText := fmt.Sprintf("Request Validate Fail %v", err)
+	context.JSON(http.StatusBadRequest, Response{
+		Code:    400,
+		Message: &errText,
+	})
+}
+
+// revealUserSSHHandler 返回保存的 ssh 密码, 需要再次校验账号密码, 每次调用都会写入审计记录
+func revealUserSSHHandler(context *gin.Context) {
+	revealUserSSHRequest := &RevealUserSSHRequest{}
+	if ok := requestJsonParseHelper(context, revealUserSSHRequest); ok {
+		username := context.Request.Header.Get("User-Name")
+		audit := mongoDB.Audit{
+			UserName:   username,
+			Action:     "revealSSH",
+			Target:     revealUserSSHRequest.Key,
+			RemoteAddr: context.ClientIP(),
+		}
+		revealUserSSHResponse := &RevealUserSSHResponse{
+			Code:    200,
+			Message: nil,
+			Data:    nil,
+		}
+		if err := mongoDB.Client.CheckUserPasswd(mongoDB.User{UserName: username, Passwd: revealUserSSHRequest.Passwd}); err != nil {
+			errText := fmt.Sprintf("Check User Fail %v", err)
+			revealUserSSHResponse.Code = 403
+			revealUserSSHResponse.Message = &errText
+		} else if ssh, err := mongoDB.Client.GetUserSSH(revealUserSSHRequest.Key); err != nil || ssh.UserName != username {
+			errText := fmt.Sprintf("Reveal SSH Fail : ssh %s not belong to user %s", revealUserSSHRequest.Key, username)
+			revealUserSSHResponse.Code = 403
+			revealUserSSHResponse.Message = &errText
+		} else {
+			audit.Success = true
+			revealUserSSHResponse.Data = &RevealUserSSHResponseData{
+				Key:         ssh.Key,
+				AuthType:    sshAuthType(*ssh),
+				Passwd:      ssh.Passwd,
+				PrivateKey:  ssh.PrivateKey,
+				Passphrase:  ssh.Passphrase,
+				Certificate: ssh.Certificate,
+			}
+		}
+		logger.L.Infof("audit %s %s %s from %s success %v", audit.UserName, audit.Action, audit.Target, audit.RemoteAddr, audit.Success)
+		if err := mongoDB.Client.InsertAudit(audit); err != nil {
+			// 审计写入失败时不返回凭据
+			errText := fmt.Sprintf("Reveal SSH Fail : %v", err)
+			revealUserSSHResponse.Code = 500
+			revealUserSSHResponse.Message = &errText
+			revealUserSSHResponse.Data = nil
+		}
+		context.JSON(http.StatusOK, revealUserSSHResponse)
+	}
+}
+
+func selectKnownHostHandler(context *gin.Context) {
+	username := context.Request.Header.Get("User-Name")
+	res, err := mongoDB.Client.SelectKnownHost(username)
+	selectKnownHostResponse := &SelectKnownHostResponse{
+		Code:    200,
+		Message: nil,
+		Data:    res,
+	}
+	if err != nil {
+		errText := fmt.Sprintf("Select Known Host Fail : %v", err)
+		selectKnownHostResponse.Code = 500
+		selectKnownHostResponse.Message = &errText
+		selectKnownHostResponse.Data = make([]mongoDB.KnownHost, 0)
+	}
+	context.JSON(http.StatusOK, selectKnownHostResponse)
+}
+
+// acceptKnownHostHandler 接受主机变化后的新公钥
+func acceptKnownHostHandler(context *gin.Context) {
+	acceptKnownHostRequest := &AcceptKnownHostRequest{}
+	if ok := requestJsonParseHelper(context, acceptKnownHostRequest); ok {
+		username := context.Request.Header.Get("User-Name")
+		key := mongoDB.GeneralKnownHostId(username, acceptKnownHostRequest.Host, acceptKnownHostRequest.Port)
+		if err := mongoDB.Client.AcceptKnownHost(key, acceptKnownHostRequest.Fingerprint); err != nil {
+			errText := fmt.Sprintf("Accept Known Host Fail : %v", err)
+			context.JSON(http.StatusOK, Response{
+				Code:    400,
+				Message: &errText,
+			})
+		} else {
+			logger.L.Infof("user %s accept host key %s %s", username, key, acceptKnownHostRequest.Fingerprint)
+			context.JSON(http.StatusOK, Response{
+				Code:    200,
+				Message: nil,
+			})
+		}
+	}
+}
+
+// revokeKnownHostHandler 删除信任的公钥, 下次连接时重新记录
+func revokeKnownHostHandler(context *gin.Context) {
+	revokeKnownHostRequest := &RevokeKnownHostRequest{}
+	if ok := requestJsonParseHelper(context, revokeKnownHostRequest); ok {
+		username := context.Request.Header.Get("User-Name")
+		keys := make([]string, 0)
+		for _, h := range revokeKnownHostRequest.Data {
+			keys = append(keys, mongoDB.GeneralKnownHostId(username, h.Host, h.Port))
+		}
+		res, err := mongoDB.Client.DeleteKnownHost(keys)
+		revokeKnownHostResponse := &RevokeKnownHostResponse{
+			Code:    200,
+			Message: nil,
+			Data:    make([]RevokeKnownHostResponseData, 0),
+		}
+		if err != nil {
+			errText := fmt.Sprintf("Revoke Known Host Fail : %v", err)
+			revokeKnownHostResponse.Code = 500
+			revokeKnownHostResponse.Message = &errText
+		}
+		resSet := mapSet.NewSet(res...)
+		for i, h := range revokeKnownHostRequest.Data {
+			revokeKnownHostResponse.Data = append(revokeKnownHostResponse.Data, RevokeKnownHostResponseData{
+				Host:    h.Host,
+				Port:    h.Port,
+				Revoked: resSet.Contains(keys[i]),
+			})
+		}
+		context.JSON(http.StatusOK, revokeKnownHostResponse)
+	}
+}
+
 func registerHandler(context *gin.Context) {
 	registerRequest := &RegisterRequest{}
 	if ok := requestJsonParseHelper(context, registerRequest); ok {
@@ -386,3 +719,184 @@ func changePasswdHandler(context *gin.Context) {
 		}
 	}
 }
+
+// metricLabels 可以作为 query 参数过滤曲线的 labels
+var metricLabels = []string{"cpu", "interface", "device", "mount", "zone", "pid", "name", "physicalId"}
+
+const (
+	// defaultHistoryRange 没有 from 时查询最近一小时
+	defaultHistoryRange = time.Hour
+	// defaultHistoryPoints 没有 step 时每条曲线大约这么多个点
+	defaultHistoryPoints = 300
+	maxHistoryPoints     = 5000
+)
+
+// metricHistoryHandler 查询 /metrics/history?host=&metric=&from=&to=&step=, host 为保存的 ssh 的 key,
+// 也可以省略用户名写成 user@host:port, 只能查询自己保存的 ssh
+func metricHistoryHandler(context *gin.Context) {
+	username := context.Request.Header.Get("User-Name")
+	badRequest := func(err error) {
+		errText := fmt.Sprintf("Request Validate Fail %v", err)
+		context.JSON(http.StatusBadRequest, Response{
+			Code:    400,
+			Message: &errText,
+		})
+	}
+	metric := context.Query("metric")
+	event, ok := ssh.PointEvent(metric)
+	if !ok {
+		badRequest(fmt.Errorf("unknown metric %q", metric))
+		return
+	}
+	to, err := parseHistoryTime(context.Query("to"), time.Now())
+	if err != nil {
+		badRequest(fmt.Errorf("to : %v", err))
+		return
+	}
+	from, err := parseHistoryTime(context.Query("from"), to.Add(-defaultHistoryRange))
+	if err != nil {
+		badRequest(fmt.Errorf("from : %v", err))
+		return
+	}
+	if !from.Before(to) {
+		badRequest(errors.New("from must be before to"))
+		return
+	}
+	step, err := parseHistoryStep(context.Query("step"), to.Sub(from))
+	if err != nil {
+		badRequest(fmt.Errorf("step : %v", err))
+		return
+	}
+	if to.Sub(from)/step > maxHistoryPoints {
+		badRequest(fmt.Errorf("more than %d points, use a larger step", maxHistoryPoints))
+		return
+	}
+	labels := make(map[string]string)
+	for _, label := range metricLabels {
+		if v, ok := context.GetQuery(label); ok {
+			labels[label] = v
+		}
+	}
+
+	metricHistoryResponse := &MetricHistoryResponse{
+		Code:    200,
+		Message: nil,
+		Data:    nil,
+	}
+	host, ok := ownedHost(username, context.Query("host"))
+	if !ok {
+		errText := fmt.Sprintf("Select History Fail : ssh %s not belong to user %s", context.Query("host"), username)
+		metricHistoryResponse.Code = 403
+		metricHistoryResponse.Message = &errText
+		context.JSON(http.StatusOK, metricHistoryResponse)
+		return
+	}
+	buckets, err := mongoDB.Client.AggregateMetric(event, host, metric, labels, from, to, step)
+	if err != nil {
+		errText := fmt.Sprintf("Select History Fail : %v", err)
+		metricHistoryResponse.Code = 500
+		metricHistoryResponse.Message = &errText
+		context.JSON(http.StatusOK, metricHistoryResponse)
+		return
+	}
+	metricHistoryResponse.Data = &MetricHistoryResponseData{
+		Host:   host,
+		Metric: metric,
+		From:   from,
+		To:     to,
+		Step:   int64(step / time.Second),
+		Series: historySeries(buckets),
+	}
+	context.JSON(http.StatusOK, metricHistoryResponse)
+}
+
+// ownedHost 返回用户保存的 ssh 对应的历史数据中的 host, 历史数据按主机共享,
+// 只有凭据登录成功过的 ssh 可以读取, 只保存了相同地址的用户不能读取别人监控的数据
+func ownedHost(username string, key string) (string, bool) {
+	if key == ssh.LocalKey {
+		return ssh.LocalKey, ssh.LocalAllowed(username)
+	}
+	if !strings.HasPrefix(key, username+":") {
+		key = username + ":" + key
+	}
+	userSSH, err := mongoDB.Client.GetUserSSH(key)
+	if err != nil || userSSH.UserName != username {
+		logger.L.Debugf("resolve user ssh %s fail : %v", key, err)
+		return "", false
+	}
+	if !userSSH.Verified {
+		logger.L.Debugf("user ssh %s not verified", key)
+		return "", false
+	}
+	return ssh.GeneralKey(userSSH.Port, userSSH.Host, userSSH.User), true
+}
+
+// parseHistoryTime 支持 RFC3339 和 unix 秒, 为空时返回 def
+func parseHistoryTime(s string, def time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// parseHistoryStep 支持秒数和 5m 这样的时长, 为空时按 defaultHistoryPoints 计算, 最小 1 秒
+func parseHistoryStep(s string, span time.Duration) (time.Duration, error) {
+	var step time.Duration
+	if s == "" {
+		step = (span / defaultHistoryPoints).Truncate(time.Second)
+	} else if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		step = time.Duration(sec) * time.Second
+	} else if step, err = time.ParseDuration(s); err != nil {
+		return 0, err
+	}
+	if s != "" && step < time.Second {
+		return 0, errors.New("must be at least 1s")
+	}
+	if step < time.Second {
+		step = time.Second
+	}
+	return step.Truncate(time.Second), nil
+}
+
+// historySeries 按 labels 把桶分成曲线, 曲线按 labels 排序
+func historySeries(buckets []mongoDB.MetricBucket) []MetricHistorySeries {
+	index := make(map[string]int)
+	series := make([]MetricHistorySeries, 0)
+	for _, b := range buckets {
+		key := seriesKey(b.Labels)
+		i, ok := index[key]
+		if !ok {
+			i = len(series)
+			index[key] = i
+			series = append(series, MetricHistorySeries{Labels: b.Labels, Points: make([]MetricHistoryPoint, 0)})
+		}
+		series[i].Points = append(series[i].Points, MetricHistoryPoint{
+			Time:  b.Time,
+			Avg:   b.Avg,
+			Min:   b.Min,
+			Max:   b.Max,
+			P95:   b.P95,
+			Count: b.Count,
+		})
+	}
+	sort.Slice(series, func(i, j int) bool {
+		return seriesKey(series[i].Labels) < seriesKey(series[j].Labels)
+	})
+	return series
+}
+
+func seriesKey(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k + "=" + labels[k] + ",")
+	}
+	return b.String()
+}
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/pelletier/go-toml"
+	"io"
+	"logger"
+	"math"
+	"mime"
+	"mongoDB"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/template"
+	"time"
+)
+
+// notifier 把告警发送到用户配置的通知渠道, 每个渠道单独限速, 失败时按指数退避重试
+type notifier struct {
+	client *http.Client
+	// smtp 没有配置时不能使用邮件渠道
+	smtp *smtpConfig
+	// rateLimit 渠道没有设置时每分钟最多发送的通知数
+	rateLimit    int
+	maxRetries   int
+	retryInitial time.Duration
+	retryMax     time.Duration
+	mutex        sync.Mutex
+	limiters     map[string]*rateLimiter
+	// workers 限制同时发送的通知数
+	workers chan struct{}
+	// allowNetworks 允许访问的内网地址, 其余回环, 内网和链路本地地址都拒绝
+	allowNetworks []*net.IPNet
+}
+
+// reservedNetworks net.IP 没有对应判断方法的保留地址
+var reservedNetworks = []string{"0.0.0.0/8", "100.64.0.0/10", "192.0.0.0/24", "198.18.0.0/15", "240.0.0.0/4"}
+
+type smtpConfig struct {
+	host     string
+	port     int
+	username string
+	password string
+	from     string
+	// tls 为 true 时直接使用 TLS 连接, 例如 465 端口, 否则服务器支持时使用 STARTTLS
+	tls     bool
+	timeout time.Duration
+}
+
+// rateLimiter 令牌桶, 每分钟补充 rate 个, 最多积累 rate 个
+type rateLimiter struct {
+	tokens float64
+	last   time.Time
+}
+
+// notifyRejected 渠道配置有误或请求被拒绝, 重试也不会成功
+type notifyRejected struct {
+	err error
+}
+
+func (e *notifyRejected) Error() string {
+	return e.err.Error()
+}
+
+// notifyData webhook 模板可以使用告警的所有字段和生成的标题正文
+type notifyData struct {
+	mongoDB.Alert
+	Title string `json:"title"`
+	Text  string `json:"text"`
+}
+
+var notify *notifier
+
+// startNotify 按 conf.toml 的 [notify] 在告警触发和恢复时发送通知, 返回 nil 时不提供通知接口
+func startNotify(conf *toml.Tree, alerts *alertEngine) *notifier {
+	if !conf.GetDefault("notify.Enable", false).(bool) {
+		return nil
+	}
+	if alerts == nil {
+		logger.L.Fatalf("notify needs [alert] to be enabled")
+	}
+	timeout := time.Duration(conf.GetDefault("notify.Timeout", int64(10)).(int64)) * time.Second
+	n := &notifier{
+		rateLimit:    int(conf.GetDefault("notify.RateLimit", int64(10)).(int64)),
+		maxRetries:   int(conf.GetDefault("notify.MaxRetries", int64(5)).(int64)),
+		retryInitial: time.Duration(conf.GetDefault("notify.RetryInitial", int64(2)).(int64)) * time.Second,
+		retryMax:     time.Duration(conf.GetDefault("notify.RetryMax", int64(60)).(int64)) * time.Second,
+		limiters:     make(map[string]*rateLimiter),
+		workers:      make(chan struct{}, int(conf.GetDefault("notify.Workers", int64(8)).(int64))),
+	}
+	if timeout <= 0 || n.rateLimit <= 0 || cap(n.workers) <= 0 {
+		logger.L.Fatalf("notify.Timeout, RateLimit and Workers must be positive")
+	}
+	if n.maxRetries < 0 || n.retryInitial <= 0 || n.retryMax < n.retryInitial {
+		logger.L.Fatalf("notify.MaxRetries must not be negative and RetryMax must not be less than RetryInitial")
+	}
+	if networks, ok := conf.Get("notify.AllowNetworks").([]interface{}); ok {
+		for _, v := range networks {
+			network, ok := v.(string)
+			if !ok {
+				logger.L.Fatalf("notify.AllowNetworks must be a list of CIDR or IP, got %v", v)
+			}
+			ipNet, err := parseNetwork(network)
+			if err != nil {
+				logger.L.Fatalf("notify.AllowNetworks %s : %v", network, err)
+			}
+			n.allowNetworks = append(n.allowNetworks, ipNet)
+		}
+	}
+	// 不使用环境变量中的代理, 在建立连接时检查解析后的地址, 重定向和 DNS 重绑定也无法访问内网
+	dialer := &net.Dialer{Timeout: timeout, Control: n.dialControl}
+	n.client = &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:               nil,
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: timeout,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+	if host := conf.GetDefault("notify.SMTP.Host", "").(string); host != "" {
+		n.smtp = &smtpConfig{
+			host:     host,
+			port:     int(conf.GetDefault("notify.SMTP.Port", int64(587)).(int64)),
+			username: conf.GetDefault("notify.SMTP.Username", "").(string),
+			password: conf.GetDefault("notify.SMTP.Password", "").(string),
+			from:     conf.GetDefault("notify.SMTP.From", "").(string),
+			tls:      conf.GetDefault("notify.SMTP.TLS", false).(bool),
+			timeout:  timeout,
+		}
+		if n.smtp.from == "" {
+			logger.L.Fatalf("notify.SMTP.From is required")
+		}
+	}
+	alerts.onAlert(n.dispatch)
+	logger.L.Infof("send alert notifications, smtp configured %v", n.smtp != nil)
+	return n
+}
+
+// parseNetwork 支持 CIDR 和单个 IP
+func parseNetwork(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, errors.New("invalid IP")
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(s)
+	return ipNet, err
+}
+
+// allowIP 回环, 内网, 链路本地 (包括 169.254.169.254 等云主机元数据地址), 未指定和组播地址只在 AllowNetworks 中时允许
+func (n *notifier) allowIP(ip net.IP) bool {
+	for _, ipNet := range n.allowNetworks {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, network := range reservedNetworks {
+		if _, ipNet, _ := net.ParseCIDR(network); ipNet.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// dialControl 检查实际连接的地址, 拒绝时不会发出任何数据
+func (n *notifier) dialControl(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return &notifyRejected{err: err}
+	}
+	if ip := net.ParseIP(host); ip == nil || !n.allowIP(ip) {
+		errText := fmt.Sprintf("address %s is not allowed, add it to notify.AllowNetworks", host)
+		return &notifyRejected{err: errors.New(errText)}
+	}
+	return nil
+}
+
+// checkHost 保存渠道时提前检查, 能解析的地址都必须允许, 解析失败时留到发送时检查
+func (n *notifier) checkHost(host string) error {
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		var err error
+		if ips, err = net.LookupIP(host); err != nil {
+			logger.L.Debugf("resolve notify host %s fail : %v", host, err)
+			return nil
+		}
+	}
+	for _, ip := range ips {
+		if !n.allowIP(ip) {
+			errText := fmt.Sprintf("address %s of %s is not allowed, add it to notify.AllowNetworks", ip, host)
+			return errors.New(errText)
+		}
+	}
+	return nil
+}
+
+// dispatch 把告警发给用户所有开启且级别匹配的渠道, 不阻塞告警的处理
+func (n *notifier) dispatch(a mongoDB.Alert) {
+	channels, err := mongoDB.Client.SelectNotifyChannel(a.UserName)
+	if err != nil {
+		logger.L.Warnf("notify %s %s fail : %v", a.State, a.RuleName, err)
+		return
+	}
+	for _, channel := range channels {
+		if !channel.Enable || len(channel.Severities) > 0 && !contains(channel.Severities, a.Severity) {
+			continue
+		}
+		if !n.allow(channel, time.Now()) {
+			logger.L.Warnf("notify channel %s of %s rate limited, drop %s %s on %s", channel.Name, channel.UserName, a.State, a.RuleName, a.Host)
+			continue
+		}
+		go n.deliver(channel, a)
+	}
+}
+
+func (n *notifier) allow(channel mongoDB.NotifyChannel, now time.Time) bool {
+	rate := float64(channel.RateLimit)
+	if rate <= 0 {
+		rate = float64(n.rateLimit)
+	}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	l, ok := n.limiters[channel.Id]
+	if !ok {
+		l = &rateLimiter{tokens: rate, last: now}
+		n.limiters[channel.Id] = l
+	}
+	l.tokens = math.Min(rate, l.tokens+now.Sub(l.last).Minutes()*rate)
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// forget 删除渠道后不再保留它的限速状态
+func (n *notifier) forget(ids []string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	for _, id := range ids {
+		delete(n.limiters, id)
+	}
+}
+
+// deliver 可以重试的失败按指数退避重试 MaxRetries 次, 每次发送占用一个 worker, 等待重试时释放,
+// 不可用的渠道不会占满 worker 阻塞其他渠道
+func (n *notifier) deliver(channel mongoDB.NotifyChannel, a mongoDB.Alert) {
+	backoff := n.retryInitial
+	for attempt := 0; ; attempt++ {
+		n.workers <- struct{}{}
+		err := n.send(channel, a)
+		<-n.workers
+		if err == nil {
+			return
+		}
+		var rejected *notifyRejected
+		if errors.As(err, &rejected) || attempt >= n.maxRetries {
+			logger.L.Warnf("notify channel %s of %s fail : %v", channel.Name, channel.UserName, err)
+			return
+		}
+		logger.L.Debugf("notify channel %s of %s fail, retry in %v : %v", channel.Name, channel.UserName, backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > n.retryMax {
+			backoff = n.retryMax
+		}
+	}
+}
+
+// notifyText 生成通知的标题和正文
+func notifyText(a mongoDB.Alert) (string, string) {
+	title := fmt.Sprintf("[%s] %s", strings.ToUpper(a.State), a.RuleName)
+	lines := []string{
+		"host: " + a.Host,
+		"severity: " + a.Severity,
+		a.Message,
+		"since: " + a.StartTime.Format(time.RFC3339),
+	}
+	if a.State == mongoDB.AlertResolved {
+		lines = append(lines, "resolved: "+a.Time.Format(time.RFC3339))
+	}
+	return title, strings.Join(lines, "\n")
+}
+
+// send 发送一次, 不重试
+func (n *notifier) send(channel mongoDB.NotifyChannel, a mongoDB.Alert) error {
+	title, text := notifyText(a)
+	switch channel.Type {
+	case mongoDB.NotifyWebhook:
+		body, err := renderWebhook(channel.Template, notifyData{Alert: a, Title: title, Text: text})
+		if err != nil {
+			return &notifyRejected{err: err}
+		}
+		return n.post(channel.Type, channel.URL, channel.Headers, body)
+	case mongoDB.NotifyEmail:
+		if n.smtp == nil {
+			return &notifyRejected{err: errors.New("notify.SMTP is not configured")}
+		}
+		return n.smtp.send(channel.To, title, text)
+	case mongoDB.NotifySlack:
+		body, _ := json.Marshal(map[string]string{"text": title + "\n" + text})
+		return n.post(channel.Type, channel.URL, nil, body)
+	case mongoDB.NotifyDingTalk:
+		target := channel.URL
+		if channel.Secret != "" {
+			u, err := url.Parse(channel.URL)
+			if err != nil {
+				return &notifyRejected{err: err}
+			}
+			timestamp := strconv.FormatInt(time.Now().UnixMilli(), 10)
+			query := u.Query()
+			query.Set("timestamp", timestamp)
+			query.Set("sign", hmacBase64([]byte(channel.Secret), timestamp+"\n"+channel.Secret))
+			u.RawQuery = query.Encode()
+			target = u.String()
+		}
+		body, _ := json.Marshal(map[string]interface{}{
+			"msgtype": "text",
+			"text":    map[string]string{"content": title + "\n" + text},
+		})
+		return n.post(channel.Type, target, nil, body)
+	case mongoDB.NotifyFeishu:
+		message := map[string]interface{}{
+			"msg_type": "text",
+			"content":  map[string]string{"text": title + "\n" + text},
+		}
+		if channel.Secret != "" {
+			timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+			message["timestamp"] = timestamp
+			message["sign"] = hmacBase64([]byte(timestamp+"\n"+channel.Secret), "")
+		}
+		body, _ := json.Marshal(message)
+		return n.post(channel.Type, channel.URL, nil, body)
+	}
+	return &notifyRejected{err: fmt.Errorf("unknown channel type %s", channel.Type)}
+}
+
+func hmacBase64(key []byte, message string) string {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(message))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// renderWebhook 用模板生成 JSON body, 模板为空时发送 data 本身, 模板中可以用 {{json .Message}} 转义字符串
+func renderWebhook(text string, data notifyData) ([]byte, error) {
+	if text == "" {
+		return json.Marshal(data)
+	}
+	t, err := template.New("webhook").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Parse(text)
+	if err != nil {
+		errText := fmt.Sprintf("parse template fail : %v", err)
+		return nil, errors.New(errText)
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, data); err != nil {
+		errText := fmt.Sprintf("render template fail : %v", err)
+		return nil, errors.New(errText)
+	}
+	if !json.Valid(b.Bytes()) {
+		return nil, errors.New("template does not render valid JSON")
+	}
+	return b.Bytes(), nil
+}
+
+// post 发送 JSON, 钉钉和飞书的机器人在 HTTP 200 的 body 中用 errcode 或 code 返回错误, 其余渠道 2xx 即成功,
+// 错误中只有状态码和错误码, 响应内容只记在 debug 日志中, 不能借通知读取其他服务的响应
+func (n *notifier) post(channelType string, target string, headers map[string]string, body []byte) error {
+	request, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return &notifyRejected{err: err}
+	}
+	for k, v := range headers {
+		request.Header.Set(k, v)
+	}
+	request.Header.Set("Content-Type", "application/json; charset=utf-8")
+	response, err := n.client.Do(request)
+	if err != nil {
+		var rejected *notifyRejected
+		if errors.As(err, &rejected) {
+			return rejected
+		}
+		return err
+	}
+	defer response.Body.Close()
+	result, _ := io.ReadAll(io.LimitReader(response.Body, 4096))
+	logger.L.Debugf("post %s response : %s %s", request.URL.Host, response.Status, result)
+	if response.StatusCode/100 != 2 {
+		errText := fmt.Sprintf("post %s fail : %s", request.URL.Host, response.Status)
+		if response.StatusCode/100 == 4 && response.StatusCode != http.StatusTooManyRequests {
+			return &notifyRejected{err: errors.New(errText)}
+		}
+		return errors.New(errText)
+	}
+	if channelType != mongoDB.NotifyDingTalk && channelType != mongoDB.NotifyFeishu {
+		return nil
+	}
+	var r struct {
+		ErrCode *int `json:"errcode"`
+		Code    *int `json:"code"`
+	}
+	if json.Unmarshal(result, &r) != nil {
+		return nil
+	}
+	if r.ErrCode != nil && *r.ErrCode != 0 {
+		errText := fmt.Sprintf("post %s fail : errcode %d", request.URL.Host, *r.ErrCode)
+		return errors.New(errText)
+	}
+	if r.Code != nil && *r.Code != 0 {
+		errText := fmt.Sprintf("post %s fail : code %d", request.URL.Host, *r.Code)
+		return errors.New(errText)
+	}
+	return nil
+}
+
+// send 发送纯文本邮件, 整个会话受 timeout 限制
+func (s *smtpConfig) send(to []string, subject string, text string) error {
+	addr := net.JoinHostPort(s.host, strconv.Itoa(s.port))
+	var conn net.Conn
+	var err error
+	if s.tls {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: s.timeout}, "tcp", addr, &tls.Config{ServerName: s.host})
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, s.timeout)
+	}
+	if err != nil {
+		return err
+	}
+	_ = conn.SetDeadline(time.Now().Add(s.timeout))
+	c, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok && !s.tls {
+		if err := c.StartTLS(&tls.Config{ServerName: s.host}); err != nil {
+			return err
+		}
+	}
+	if s.username != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.username, s.password, s.host)); err != nil {
+			return &notifyRejected{err: err}
+		}
+	}
+	if err := c.Mail(s.from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return &notifyRejected{err: err}
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	header := "From: " + s.from + "\r\n" +
+		"To: " + strings.Join(to, ", ") + "\r\n" +
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: base64\r\n\r\n"
+	encoded := base64.StdEncoding.EncodeToString([]byte(text))
+	var body strings.Builder
+	for len(encoded) > 76 {
+		body.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	body.WriteString(encoded + "\r\n")
+	if _, err := w.Write([]byte(header + body.String())); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	mapSet "github.com/deckarep/golang-set/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"mongoDB"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+type NotifyChannelRequest struct {
+	Name string `json:"name" validate:"required"`
+	Type string `json:"type" validate:"required,oneof=webhook email slack dingtalk feishu"`
+	// URL 邮件以外的渠道需要, 修改时为空则保持不变
+	URL string `json:"url"`
+	// Secret 钉钉和飞书机器人的加签密钥, 修改时为空则保持不变
+	Secret string `json:"secret"`
+	// Headers webhook 的请求头, 修改时为 null 则保持不变
+	Headers map[string]string `json:"headers"`
+	// Template webhook 的 JSON body 模板, 为空时发送告警本身
+	Template   string   `json:"template"`
+	To         []string `json:"to" validate:"omitempty,dive,email"`
+	Severities []string `json:"severities" validate:"omitempty,dive,oneof=info warning critical"`
+	RateLimit  int      `json:"rateLimit" validate:"min=0"`
+	// Enable 为空时开启
+	Enable *bool `json:"enable"`
+}
+
+type UpdateNotifyChannelRequest struct {
+	Id string `json:"id" validate:"required"`
+	NotifyChannelRequest
+}
+
+type DeleteNotifyChannelRequest struct {
+	Data []string `json:"data" validate:"required,dive,required"`
+}
+
+type TestNotifyChannelRequest struct {
+	Id string `json:"id" validate:"required"`
+}
+
+// NotifyChannelData 返回给前端的渠道, 不包含 URL 中的 token, 密钥和请求头的值
+type NotifyChannelData struct {
+	Id          string    `json:"id"`
+	Name        string    `json:"name"`
+	Type        string    `json:"type"`
+	Enable      bool      `json:"enable"`
+	Severities  []string  `json:"severities"`
+	URLHost     string    `json:"urlHost"`
+	HasSecret   bool      `json:"hasSecret"`
+	HeaderNames []string  `json:"headerNames"`
+	Template    string    `json:"template"`
+	To          []string  `json:"to"`
+	RateLimit   int       `json:"rateLimit"`
+	CreateTime  time.Time `json:"createTime"`
+	UpdateTime  time.Time `json:"updateTime"`
+}
+
+type NotifyChannelResponse struct {
+	Code    int                `json:"code"`
+	Message *string            `json:"message"`
+	Data    *NotifyChannelData `json:"data"`
+}
+
+type SelectNotifyChannelResponse struct {
+	Code    int                 `json:"code"`
+	Message *string             `json:"message"`
+	Data    []NotifyChannelData `json:"data"`
+}
+
+type DeleteNotifyChannelResponse struct {
+	Code    int                               `json:"code"`
+	Message *string                           `json:"message"`
+	Data    []DeleteNotifyChannelResponseData `json:"data"`
+}
+
+type DeleteNotifyChannelResponseData struct {
+	Id      string `json:"id"`
+	Deleted bool   `json:"deleted"`
+}
+
+func notifyChannelData(channel mongoDB.NotifyChannel) NotifyChannelData {
+	data := NotifyChannelData{
+		Id:          channel.Id,
+		Name:        channel.Name,
+		Type:        channel.Type,
+		Enable:      channel.Enable,
+		Severities:  channel.Severities,
+		HasSecret:   channel.Secret != "",
+		HeaderNames: make([]string, 0, len(channel.Headers)),
+		Template:    channel.Template,
+		To:          channel.To,
+		RateLimit:   channel.RateLimit,
+		CreateTime:  channel.CreateTime,
+		UpdateTime:  channel.UpdateTime,
+	}
+	if u, err := url.Parse(channel.URL); err == nil {
+		data.URLHost = u.Host
+	}
+	for k := range channel.Headers {
+		data.HeaderNames = append(data.HeaderNames, k)
+	}
+	sort.Strings(data.HeaderNames)
+	return data
+}
+
+// testAlert 测试发送和检查模板时使用的告警
+func testAlert(username string) mongoDB.Alert {
+	now := time.Now()
+	return mongoDB.Alert{
+		RuleId:    "test",
+		RuleName:  "test notification",
+		UserName:  username,
+		Host:      username + ":root@127.0.0.1:22",
+		Metric:    "CPUPerformanceTotal.Utilization",
+		Labels:    map[string]string{},
+		Operator:  ">",
+		Threshold: 90,
+		Severity:  "info",
+		State:     mongoDB.AlertFiring,
+		Value:     95,
+		StartTime: now,
+		Time:      now,
+		Message:   "CPUPerformanceTotal.Utilization = 95 > 90 : test notification from argus",
+	}
+}
+
+// notifyChannelHelper 检查请求并转为渠道, old 不为空时未填写的 URL Secret Headers 沿用旧值
+func notifyChannelHelper(username string, request *NotifyChannelRequest, old *mongoDB.NotifyChannel) (mongoDB.NotifyChannel, error) {
+	channel := mongoDB.NotifyChannel{
+		UserName:   username,
+		Name:       request.Name,
+		Type:       request.Type,
+		Enable:     request.Enable == nil || *request.Enable,
+		Severities: request.Severities,
+		URL:        request.URL,
+		Secret:     request.Secret,
+		Headers:    request.Headers,
+		Template:   request.Template,
+		To:         request.To,
+		RateLimit:  request.RateLimit,
+	}
+	if old != nil {
+		if channel.URL == "" {
+			channel.URL = old.URL
+		}
+		if channel.Secret == "" {
+			channel.Secret = old.Secret
+		}
+		if channel.Headers == nil {
+			channel.Headers = old.Headers
+		}
+	}
+	if channel.Type == mongoDB.NotifyEmail {
+		if notify.smtp == nil {
+			return channel, errors.New("notify.SMTP is not configured")
+		}
+		if len(channel.To) == 0 {
+			return channel, errors.New("to is required for email channel")
+		}
+		return channel, nil
+	}
+	u, err := url.Parse(channel.URL)
+	if err != nil || u.Host == "" || u.Scheme != "http" && u.Scheme != "https" {
+		return channel, fmt.Errorf("url must be an http or https url for %s channel", channel.Type)
+	}
+	if err := notify.checkHost(u.Hostname()); err != nil {
+		return channel, err
+	}
+	if channel.Type == mongoDB.NotifyWebhook && channel.Template != "" {
+		title, text := notifyText(testAlert(username))
+		if _, err := renderWebhook(channel.Template, notifyData{Alert: testAlert(username), Title: title, Text: text}); err != nil {
+			return channel, err
+		}
+	}
+	return channel, nil
+}
+
+func addNotifyChannelHandler(context *gin.Context) {
+	addNotifyChannelRequest := &NotifyChannelRequest{}
+	if ok := requestJsonParseHelper(context, addNotifyChannelRequest); ok {
+		username := context.Request.Header.Get("User-Name")
+		channel, err := notifyChannelHelper(username, addNotifyChannelRequest, nil)
+		if err != nil {
+			authFailHelper(context, err)
+			return
+		}
+		channel.Id = uuid.New().String()
+		notifyChannelResponse := &NotifyChannelResponse{
+			Code:    200,
+			Message: nil,
+			Data:    nil,
+		}
+		if err := mongoDB.Client.InsertNotifyChannel(channel); err != nil {
+			errText := fmt.Sprintf("Insert Notify Channel Fail : %v", err)
+			notifyChannelResponse.Code = 500
+			notifyChannelResponse.Message = &errText
+		} else {
+			data := notifyChannelData(channel)
+			notifyChannelResponse.Data = &data
+		}
+		context.JSON(http.StatusOK, notifyChannelResponse)
+	}
+}
+
+func updateNotifyChannelHandler(context *gin.Context) {
+	updateNotifyChannelRequest := &UpdateNotifyChannelRequest{}
+	if ok := requestJsonParseHelper(context, updateNotifyChannelRequest); ok {
+		username := context.Request.Header.Get("User-Name")
+		old, err := mongoDB.Client.GetNotifyChannel(username, updateNotifyChannelRequest.Id)
+		if err != nil {
+			authFailHelper(context, err)
+			return
+		}
+		channel, err := notifyChannelHelper(username, &updateNotifyChannelRequest.NotifyChannelRequest, old)
+		if err != nil {
+			authFailHelper(context, err)
+			return
+		}
+		channel.Id = old.Id
+		channel.CreateTime = old.CreateTime
+		notifyChannelResponse := &NotifyChannelResponse{
+			Code:    200,
+			Message: nil,
+			Data:    nil,
+		}
+		if err := mongoDB.Client.UpdateNotifyChannel(channel); err != nil {
+			errText := fmt.Sprintf("Update Notify Channel Fail : %v", err)
+			notifyChannelResponse.Code = 500
+			notifyChannelResponse.Message = &errText
+		} else {
+			channel.UpdateTime = time.Now()
+			data := notifyChannelData(channel)
+			notifyChannelResponse.Data = &data
+		}
+		context.JSON(http.StatusOK, notifyChannelResponse)
+	}
+}
+
+func deleteNotifyChannelHandler(context *gin.Context) {
+	deleteNotifyChannelRequest := &DeleteNotifyChannelRequest{}
+	if ok := requestJsonParseHelper(context, deleteNotifyChannelRequest); ok {
+		username := context.Request.Header.Get("User-Name")
+		res, err := mongoDB.Client.DeleteNotifyChannel(username, deleteNotifyChannelRequest.Data)
+		notify.forget(res)
+		deleteNotifyChannelResponse := &DeleteNotifyChannelResponse{
+			Code:    200,
+			Message: nil,
+			Data:    make([]DeleteNotifyChannelResponseData, 0),
+		}
+		if err != nil {
+			errText := fmt.Sprintf("Delete Notify Channel Fail : %v", err)
+			deleteNotifyChannelResponse.Code = 500
+			deleteNotifyChannelResponse.Message = &errText
+		}
+		resSet := mapSet.NewSet(res...)
+		for _, id := range deleteNotifyChannelRequest.Data {
+			deleteNotifyChannelResponse.Data = append(deleteNotifyChannelResponse.Data, DeleteNotifyChannelResponseData{
+				Id:      id,
+				Deleted: resSet.Contains(id),
+			})
+		}
+		context.JSON(http.StatusOK, deleteNotifyChannelResponse)
+	}
+}
+
+func selectNotifyChannelHandler(context *gin.Context) {
+	username := context.Request.Header.Get("User-Name")
+	res, err := mongoDB.Client.SelectNotifyChannel(username)
+	selectNotifyChannelResponse := &SelectNotifyChannelResponse{
+		Code:    200,
+		Message: nil,
+		Data:    make([]NotifyChannelData, 0),
+	}
+	if err != nil {
+		errText := fmt.Sprintf("Select Notify Channel Fail : %v", err)
+		selectNotifyChannelResponse.Code = 500
+		selectNotifyChannelResponse.Message = &errText
+	}
+	for _, channel := range res {
+		selectNotifyChannelResponse.Data = append(selectNotifyChannelResponse.Data, notifyChannelData(channel))
+	}
+	context.JSON(http.StatusOK, selectNotifyChannelResponse)
+}
+
+// testNotifyChannelHandler 向渠道发送一条测试通知, 不重试, 同样受渠道限速
+func testNotifyChannelHandler(context *gin.Context) {
+	testNotifyChannelRequest := &TestNotifyChannelRequest{}
+	if ok := requestJsonParseHelper(context, testNotifyChannelRequest); ok {
+		username := context.Request.Header.Get("User-Name")
+		channel, err := mongoDB.Client.GetNotifyChannel(username, testNotifyChannelRequest.Id)
+		if err != nil {
+			authFailHelper(context, err)
+			return
+		}
+		response := &Response{
+			Code:    200,
+			Message: nil,
+			Data:    nil,
+		}
+		if !notify.allow(*channel, time.Now()) {
+			errText := "Test Notify Channel Fail : rate limited"
+			response.Code = 500
+			response.Message = &errText
+		} else if err := notify.send(*channel, testAlert(username)); err != nil {
+			errText := fmt.Sprintf("Test Notify Channel Fail : %v", err)
+			response.Code = 500
+			response.Message = &errText
+		}
+		context.JSON(http.StatusOK, response)
+	}
+}
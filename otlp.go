@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/pelletier/go-toml"
+	"golang.org/x/net/http2"
+	"io"
+	"logger"
+	"net"
+	"net/http"
+	"net/url"
+	"otlp"
+	"ssh"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// otlpKey OTLP 导出使用的观察者 key
+const otlpKey = "otlp"
+
+// otlpGRPCPath 和 otlpHTTPPath 拼接在 Endpoint 后
+const (
+	otlpGRPCPath = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+	otlpHTTPPath = "/v1/metrics"
+)
+
+// otlpExporter 作为观察者把每个 ssh 的消息转为 OTLP 指标, 攒批后推送到 collector
+type otlpExporter struct {
+	url      string
+	grpc     bool
+	headers  map[string]string
+	timeout  time.Duration
+	client   *http.Client
+	resource map[string]string
+	batches  chan otlp.Batch
+	// dropped 队列满时丢弃的条数, 每次推送时报告
+	dropped      int64
+	batchSize    int
+	batchTimeout time.Duration
+	maxRetries   int
+	retryInitial time.Duration
+	retryMax     time.Duration
+}
+
+// otlpRetryable 可以重试的失败, after 为服务端要求的最短等待时间
+type otlpRetryable struct {
+	err   error
+	after time.Duration
+}
+
+func (e *otlpRetryable) Error() string {
+	return e.err.Error()
+}
+
+// startOTLP 按 conf.toml 的 [otlp] 开始推送, 没有开启时什么也不做
+func startOTLP(conf *toml.Tree) {
+	if !conf.GetDefault("otlp.Enable", false).(bool) {
+		return
+	}
+	protocol := conf.GetDefault("otlp.Protocol", "grpc").(string)
+	if protocol != "grpc" && protocol != "http" {
+		logger.L.Fatalf("otlp.Protocol must be grpc or http, got %s", protocol)
+	}
+	endpoint := strings.TrimSuffix(conf.GetDefault("otlp.Endpoint", "").(string), "/")
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		logger.L.Fatalf("otlp.Endpoint must be a http or https url, got %s", endpoint)
+	}
+	e := &otlpExporter{
+		grpc:         protocol == "grpc",
+		headers:      make(map[string]string),
+		timeout:      time.Duration(conf.GetDefault("otlp.Timeout", int64(10)).(int64)) * time.Second,
+		resource:     map[string]string{"service.name": "argusyes"},
+		batchSize:    int(conf.GetDefault("otlp.BatchSize", int64(1000)).(int64)),
+		batchTimeout: time.Duration(conf.GetDefault("otlp.BatchTimeout", int64(5)).(int64)) * time.Second,
+		maxRetries:   int(conf.GetDefault("otlp.MaxRetries", int64(5)).(int64)),
+		retryInitial: time.Duration(conf.GetDefault("otlp.RetryInitial", int64(1)).(int64)) * time.Second,
+		retryMax:     time.Duration(conf.GetDefault("otlp.RetryMax", int64(30)).(int64)) * time.Second,
+	}
+	queueSize := int(conf.GetDefault("otlp.QueueSize", int64(1024)).(int64))
+	if e.timeout <= 0 || e.batchSize <= 0 || e.batchTimeout <= 0 || queueSize <= 0 {
+		logger.L.Fatalf("otlp.Timeout, BatchSize, BatchTimeout and QueueSize must be positive")
+	}
+	if e.maxRetries < 0 || e.retryInitial <= 0 || e.retryMax < e.retryInitial {
+		logger.L.Fatalf("otlp.MaxRetries must not be negative and RetryMax must not be less than RetryInitial")
+	}
+	for name, table := range map[string]map[string]string{"otlp.Headers": e.headers, "otlp.Resource": e.resource} {
+		t, ok := conf.Get(name).(*toml.Tree)
+		if !ok {
+			continue
+		}
+		for k, v := range t.ToMap() {
+			s, ok := v.(string)
+			if !ok {
+				logger.L.Fatalf("%s.%s must be a string", name, k)
+			}
+			table[k] = s
+		}
+	}
+	if e.grpc {
+		e.url = endpoint + otlpGRPCPath
+		// http 的 Endpoint 使用不加密的 HTTP/2
+		transport := &http2.Transport{}
+		if u.Scheme == "http" {
+			transport.AllowHTTP = true
+			transport.DialTLS = func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return net.DialTimeout(network, addr, e.timeout)
+			}
+		}
+		e.client = &http.Client{Transport: transport, Timeout: e.timeout}
+	} else {
+		e.url = endpoint + otlpHTTPPath
+		e.client = &http.Client{Timeout: e.timeout}
+	}
+
+	events := confEvents(conf, "otlp.Events", []string{"cpuPerformance", "memoryPerformance", "loadavg", "netDev", "netStat", "temp", "disk"})
+	interval := int(conf.GetDefault("otlp.Interval", int64(0)).(int64))
+	intervals := make(map[string]int)
+	for _, event := range events {
+		intervals[event] = interval
+	}
+
+	e.batches = make(chan otlp.Batch, queueSize)
+	go e.export()
+	ssh.M.AddObserver(otlpKey, func(port int, host, user string) ssh.AllListener {
+		return ssh.NewAllListener(events, e.record(port, host, user), intervals)
+	})
+	logger.L.Infof("export %v to %s over otlp/%s", events, e.url, protocol)
+
+	if conf.GetDefault("otlp.ExportAll", false).(bool) {
+		scanInterval := conf.GetDefault("otlp.ScanInterval", int64(60)).(int64)
+		if scanInterval <= 0 {
+			logger.L.Fatalf("otlp.ScanInterval must be positive")
+		}
+		go pinAllUserSSH(otlpKey, time.Duration(scanInterval)*time.Second)
+	}
+}
+
+func (e *otlpExporter) record(port int, host, user string) func(event string, message interface{}) {
+	key := ssh.GeneralKey(port, host, user)
+	resource := e.encodeResource(port, host, user)
+	// 计数器从开始观察这台主机时累计, 主机重启后计数变小时重新开始
+	counters := otlp.NewCumulative(time.Now())
+	return func(event string, message interface{}) {
+		points := ssh.Points(message)
+		if len(points) == 0 {
+			return
+		}
+		now := time.Now()
+		b := otlp.Batch{Host: key, Resource: resource, Points: make([]otlp.Point, 0, len(points))}
+		for _, p := range points {
+			point := otlp.Point{Name: otlpName(p.Name), Description: p.Name, Labels: p.Labels, Value: p.Value, Time: now}
+			if ssh.IsCounter(p.Name) {
+				point.Counter = true
+				point.Start = counters.Start(point.Name, p.Labels, p.Value, now)
+			}
+			b.Points = append(b.Points, point)
+		}
+		// 不阻塞采集循环, collector 不可用时队列满了就丢弃
+		select {
+		case e.batches <- b:
+		default:
+			atomic.AddInt64(&e.dropped, int64(len(points)))
+		}
+	}
+}
+
+func (e *otlpExporter) export() {
+	ticker := time.NewTicker(e.batchTimeout)
+	defer ticker.Stop()
+	pending := make([]otlp.Batch, 0)
+	n := 0
+	flush := func() {
+		if n > 0 {
+			if err := e.send(otlp.EncodeRequest(pending)); err != nil {
+				logger.L.Warnf("export %d points over otlp fail : %v", n, err)
+			}
+		}
+		if dropped := atomic.SwapInt64(&e.dropped, 0); dropped > 0 {
+			logger.L.Warnf("otlp export too slow, %d points dropped", dropped)
+		}
+		pending = make([]otlp.Batch, 0)
+		n = 0
+	}
+	for {
+		select {
+		case b := <-e.batches:
+			pending = append(pending, b)
+			n += len(b.Points)
+			if n >= e.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// send 可以重试的失败按指数退避重试 MaxRetries 次, 重试期间新的数据留在队列中
+func (e *otlpExporter) send(body []byte) error {
+	backoff := e.retryInitial
+	for attempt := 0; ; attempt++ {
+		var err error
+		if e.grpc {
+			err = e.postGRPC(body)
+		} else {
+			err = e.postHTTP(body)
+		}
+		var retryable *otlpRetryable
+		if err == nil || !errors.As(err, &retryable) || attempt >= e.maxRetries {
+			return err
+		}
+		wait := backoff
+		if retryable.after > wait {
+			wait = retryable.after
+		}
+		if wait > e.retryMax {
+			wait = e.retryMax
+		}
+		logger.L.Debugf("otlp export fail, retry in %v : %v", wait, err)
+		time.Sleep(wait)
+		if backoff *= 2; backoff > e.retryMax {
+			backoff = e.retryMax
+		}
+	}
+}
+
+func (e *otlpExporter) newRequest(body []byte, contentType string) *http.Request {
+	request, _ := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	for k, v := range e.headers {
+		request.Header.Set(k, v)
+	}
+	request.Header.Set("Content-Type", contentType)
+	return request
+}
+
+func (e *otlpExporter) postHTTP(body []byte) error {
+	response, err := e.client.Do(e.newRequest(body, "application/x-protobuf"))
+	if err != nil {
+		return &otlpRetryable{err: err}
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, 64<<10))
+	if response.StatusCode/100 == 2 {
+		return nil
+	}
+	errText := fmt.Sprintf("post %s fail : %s", e.url, response.Status)
+	switch response.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		after, _ := strconv.Atoi(response.Header.Get("Retry-After"))
+		return &otlpRetryable{err: errors.New(errText), after: time.Duration(after) * time.Second}
+	}
+	return errors.New(errText)
+}
+
+// postGRPC 以 gRPC 的一元调用发送, 消息前加 1 字节压缩标记和 4 字节长度, 结果在 grpc-status trailer 中
+func (e *otlpExporter) postGRPC(body []byte) error {
+	frame := make([]byte, 5+len(body))
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(body)))
+	copy(frame[5:], body)
+	request := e.newRequest(frame, "application/grpc")
+	request.Header.Set("TE", "trailers")
+	request.Header.Set("Grpc-Timeout", fmt.Sprintf("%dm", e.timeout.Milliseconds()))
+	response, err := e.client.Do(request)
+	if err != nil {
+		return &otlpRetryable{err: err}
+	}
+	defer response.Body.Close()
+	// 读完 body 才能拿到 trailer
+	_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, 64<<10))
+	if response.StatusCode != http.StatusOK {
+		errText := fmt.Sprintf("call %s fail : %s", e.url, response.Status)
+		return &otlpRetryable{err: errors.New(errText)}
+	}
+	// 出错时服务端可能只返回 header
+	status := response.Trailer.Get("Grpc-Status")
+	message := response.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status = response.Header.Get("Grpc-Status")
+		message = response.Header.Get("Grpc-Message")
+	}
+	if status == "0" {
+		return nil
+	}
+	message, _ = url.PathUnescape(message)
+	errText := fmt.Sprintf("call %s fail : grpc status %s %s", e.url, status, message)
+	switch status {
+	// CANCELLED DEADLINE_EXCEEDED RESOURCE_EXHAUSTED ABORTED OUT_OF_RANGE UNAVAILABLE DATA_LOSS
+	case "1", "4", "8", "10", "11", "14", "15":
+		return &otlpRetryable{err: errors.New(errText)}
+	}
+	return errors.New(errText)
+}
+
+// encodeResource 主机的 Resource, 配置的 [otlp.Resource] 可以覆盖默认的属性
+func (e *otlpExporter) encodeResource(port int, host, user string) []byte {
+	attributes := map[string]interface{}{
+		"host.name":      host,
+		"argus.ssh.port": int64(port),
+		"argus.ssh.user": user,
+	}
+	for k, v := range e.resource {
+		attributes[k] = v
+	}
+	return otlp.EncodeResource(attributes)
+}
+
+// otlpName 把 NetDev.UpSpeed 转为 argus.net_dev.up_speed
+func otlpName(pointName string) string {
+	parts := strings.Split(pointName, ".")
+	for i, part := range parts {
+		parts[i] = snakeCase(part)
+	}
+	return "argus." + strings.Join(parts, ".")
+}
@@ -0,0 +1,5 @@
+module otlp
+
+go 1.19
+
+require google.golang.org/protobuf v1.28.0
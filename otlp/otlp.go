@@ -0,0 +1,194 @@
+package otlp
+
+import (
+	"google.golang.org/protobuf/encoding/protowire"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// scopeName InstrumentationScope 的名字
+const scopeName = "argusyes"
+
+// Point 一个数据点, Counter 为 true 时编码为单调累计的 Sum, Start 为累计的起始时间, 否则为 Gauge
+type Point struct {
+	Name string
+	// Description 原始的字段名, 例如 NetDev.UpSpeed
+	Description string
+	Labels      map[string]string
+	Value       float64
+	Counter     bool
+	Start       time.Time
+	Time        time.Time
+}
+
+// Batch 一台主机的数据点, Resource 为 EncodeResource 编码好的主机属性
+type Batch struct {
+	Host     string
+	Resource []byte
+	Points   []Point
+}
+
+// EncodeRequest 编码 ExportMetricsServiceRequest, 同一主机的数据放在同一个 ResourceMetrics 中
+func EncodeRequest(batches []Batch) []byte {
+	hosts := make([]string, 0)
+	byHost := make(map[string][]Batch)
+	for _, b := range batches {
+		if _, ok := byHost[b.Host]; !ok {
+			hosts = append(hosts, b.Host)
+		}
+		byHost[b.Host] = append(byHost[b.Host], b)
+	}
+	var request []byte
+	for _, host := range hosts {
+		request = pbMessage(request, 1, encodeResourceMetrics(byHost[host]))
+	}
+	return request
+}
+
+// EncodeResource 编码 Resource, 属性按名字排序, 值为 string 或 int64
+func EncodeResource(attributes map[string]interface{}) []byte {
+	keys := make([]string, 0, len(attributes))
+	for k := range attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var resource []byte
+	for _, k := range keys {
+		resource = pbMessage(resource, 1, pbKeyValue(k, attributes[k]))
+	}
+	return resource
+}
+
+// encodeResourceMetrics 同名的数据点放在同一个 Metric 中
+func encodeResourceMetrics(batches []Batch) []byte {
+	dataPoints := make(map[string][]byte)
+	descriptions := make(map[string]string)
+	counters := make(map[string]bool)
+	for _, b := range batches {
+		for _, p := range b.Points {
+			descriptions[p.Name] = p.Description
+			counters[p.Name] = p.Counter
+			dataPoints[p.Name] = pbMessage(dataPoints[p.Name], 1, encodeDataPoint(p))
+		}
+	}
+	names := make([]string, 0, len(dataPoints))
+	for name := range dataPoints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	scope := pbMessage(nil, 1, pbString(nil, 1, scopeName))
+	for _, name := range names {
+		metric := pbString(nil, 1, name)
+		metric = pbString(metric, 2, descriptions[name])
+		if counters[name] {
+			// AGGREGATION_TEMPORALITY_CUMULATIVE 为 2
+			sum := pbVarint(dataPoints[name], 2, 2)
+			sum = pbVarint(sum, 3, 1)
+			metric = pbMessage(metric, 7, sum)
+		} else {
+			metric = pbMessage(metric, 5, dataPoints[name])
+		}
+		scope = pbMessage(scope, 2, metric)
+	}
+	resourceMetrics := pbMessage(nil, 1, batches[0].Resource)
+	return pbMessage(resourceMetrics, 2, scope)
+}
+
+// encodeDataPoint 编码 NumberDataPoint, 值统一为 double
+func encodeDataPoint(p Point) []byte {
+	var dataPoint []byte
+	if p.Counter {
+		dataPoint = pbFixed64(dataPoint, 2, uint64(p.Start.UnixNano()))
+	}
+	dataPoint = pbFixed64(dataPoint, 3, uint64(p.Time.UnixNano()))
+	dataPoint = pbFixed64(dataPoint, 4, math.Float64bits(p.Value))
+	for _, k := range sortedKeys(p.Labels) {
+		dataPoint = pbMessage(dataPoint, 7, pbKeyValue(k, p.Labels[k]))
+	}
+	return dataPoint
+}
+
+// Cumulative 一台主机上每个计数序列的起始时间. 主机重启后计数从 0 开始, 值变小时起始时间移到上一次采样的时间,
+// 否则 collector 会把重启后的值当作同一段累计中的减少
+type Cumulative struct {
+	mutex  sync.Mutex
+	start  time.Time
+	series map[string]*cumulativeSeries
+}
+
+type cumulativeSeries struct {
+	start time.Time
+	last  float64
+	time  time.Time
+}
+
+// NewCumulative start 为开始观察主机的时间, 之前的累计起点无从得知, 作为每个序列最初的起始时间
+func NewCumulative(start time.Time) *Cumulative {
+	return &Cumulative{
+		start:  start,
+		series: make(map[string]*cumulativeSeries),
+	}
+}
+
+// Start 记录序列在 t 时的值 value, 返回这个值的累计起始时间
+func (c *Cumulative) Start(name string, labels map[string]string, value float64, t time.Time) time.Time {
+	key := name
+	for _, k := range sortedKeys(labels) {
+		key += "\x00" + k + "=" + labels[k]
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	s, ok := c.series[key]
+	if !ok {
+		s = &cumulativeSeries{start: c.start}
+		c.series[key] = s
+	} else if value < s.last {
+		s.start = s.time
+	}
+	s.last, s.time = value, t
+	return s.start
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// pbKeyValue 编码 KeyValue, value 为 string 或 int64
+func pbKeyValue(key string, value interface{}) []byte {
+	var anyValue []byte
+	switch v := value.(type) {
+	case string:
+		anyValue = pbString(nil, 1, v)
+	case int64:
+		anyValue = pbVarint(nil, 3, uint64(v))
+	}
+	return pbMessage(pbString(nil, 1, key), 2, anyValue)
+}
+
+func pbString(b []byte, num protowire.Number, v string) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+func pbMessage(b []byte, num protowire.Number, v []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+func pbVarint(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func pbFixed64(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, v)
+}
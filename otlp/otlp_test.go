@@ -0,0 +1,203 @@
+package otlp
+
+import (
+	"google.golang.org/protobuf/encoding/protowire"
+	"math"
+	"testing"
+	"time"
+)
+
+// field 解码出的一个字段, 只保留用到的类型
+type field struct {
+	typ     protowire.Type
+	varint  uint64
+	fixed64 uint64
+	bytes   []byte
+}
+
+// decode 按字段号拆分一层消息, 同号的字段按出现顺序保存
+func decode(t *testing.T, b []byte) map[protowire.Number][]field {
+	t.Helper()
+	fields := make(map[protowire.Number][]field)
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatalf("bad tag : %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+		f := field{typ: typ}
+		switch typ {
+		case protowire.VarintType:
+			f.varint, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			f.fixed64, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			f.bytes, n = protowire.ConsumeBytes(b)
+		default:
+			t.Fatalf("unexpected wire type %d of field %d", typ, num)
+		}
+		if n < 0 {
+			t.Fatalf("bad field %d : %v", num, protowire.ParseError(n))
+		}
+		b = b[n:]
+		fields[num] = append(fields[num], f)
+	}
+	return fields
+}
+
+// one 取唯一的字段
+func one(t *testing.T, fields map[protowire.Number][]field, num protowire.Number) field {
+	t.Helper()
+	if len(fields[num]) != 1 {
+		t.Fatalf("want 1 field %d, got %d", num, len(fields[num]))
+	}
+	return fields[num][0]
+}
+
+// attributes 解码 KeyValue 列表, 值为 string 或 int64
+func attributes(t *testing.T, kvs []field) ([]string, map[string]interface{}) {
+	t.Helper()
+	keys := make([]string, 0, len(kvs))
+	values := make(map[string]interface{})
+	for _, kv := range kvs {
+		f := decode(t, kv.bytes)
+		key := string(one(t, f, 1).bytes)
+		value := decode(t, one(t, f, 2).bytes)
+		keys = append(keys, key)
+		if s, ok := value[1]; ok {
+			values[key] = string(s[0].bytes)
+		} else {
+			values[key] = int64(one(t, value, 3).varint)
+		}
+	}
+	return keys, values
+}
+
+func TestEncodeRequest(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	now := start.Add(time.Minute)
+	resource := EncodeResource(map[string]interface{}{"service.name": "argusyes", "host.name": "10.0.0.1", "argus.ssh.port": int64(22)})
+	request := EncodeRequest([]Batch{
+		{Host: "a", Resource: resource, Points: []Point{
+			{Name: "argus.net_dev.up_bytes", Description: "NetDev.UpBytes", Labels: map[string]string{"interface": "eth0", "host": "x"}, Value: 1024, Counter: true, Start: start, Time: now},
+			{Name: "argus.loadavg.one", Description: "Loadavg.One", Value: 0.5, Time: now},
+		}},
+		{Host: "b", Resource: EncodeResource(map[string]interface{}{"host.name": "10.0.0.2"}), Points: []Point{
+			{Name: "argus.loadavg.one", Description: "Loadavg.One", Value: 1.5, Time: now},
+		}},
+		{Host: "a", Resource: resource, Points: []Point{
+			{Name: "argus.loadavg.one", Description: "Loadavg.One", Value: 0.7, Time: now},
+		}},
+	})
+
+	// ExportMetricsServiceRequest.resource_metrics = 1, 每台主机一个
+	resourceMetrics := decode(t, request)[1]
+	if len(resourceMetrics) != 2 {
+		t.Fatalf("want 2 resource metrics, got %d", len(resourceMetrics))
+	}
+	rm := decode(t, resourceMetrics[0].bytes)
+	// ResourceMetrics.resource = 1, Resource.attributes = 1
+	keys, values := attributes(t, decode(t, one(t, rm, 1).bytes)[1])
+	if want := []string{"argus.ssh.port", "host.name", "service.name"}; len(keys) != 3 || keys[0] != want[0] || keys[1] != want[1] || keys[2] != want[2] {
+		t.Fatalf("resource attributes not sorted : %v", keys)
+	}
+	if values["argus.ssh.port"] != int64(22) || values["host.name"] != "10.0.0.1" {
+		t.Fatalf("bad resource attributes : %v", values)
+	}
+
+	// ResourceMetrics.scope_metrics = 2, ScopeMetrics.scope = 1, InstrumentationScope.name = 1
+	sm := decode(t, one(t, rm, 2).bytes)
+	if name := string(one(t, decode(t, one(t, sm, 1).bytes), 1).bytes); name != scopeName {
+		t.Fatalf("want scope %s, got %s", scopeName, name)
+	}
+	// ScopeMetrics.metrics = 2, 按名字排序
+	metrics := sm[2]
+	if len(metrics) != 2 {
+		t.Fatalf("want 2 metrics, got %d", len(metrics))
+	}
+
+	// Metric.name = 1, description = 2, gauge = 5, sum = 7
+	gauge := decode(t, metrics[0].bytes)
+	if name := string(one(t, gauge, 1).bytes); name != "argus.loadavg.one" {
+		t.Fatalf("want argus.loadavg.one first, got %s", name)
+	}
+	if description := string(one(t, gauge, 2).bytes); description != "Loadavg.One" {
+		t.Fatalf("bad description %s", description)
+	}
+	if _, ok := gauge[7]; ok {
+		t.Fatalf("gauge encoded as sum")
+	}
+	// Gauge.data_points = 1, 同一主机的两个批次合并
+	gaugePoints := decode(t, one(t, gauge, 5).bytes)[1]
+	if len(gaugePoints) != 2 {
+		t.Fatalf("want 2 gauge points, got %d", len(gaugePoints))
+	}
+	gp := decode(t, gaugePoints[1].bytes)
+	if _, ok := gp[2]; ok {
+		t.Fatalf("gauge point has start time")
+	}
+	// NumberDataPoint.time_unix_nano = 3, as_double = 4
+	if v := math.Float64frombits(one(t, gp, 4).fixed64); v != 0.7 {
+		t.Fatalf("want 0.7, got %g", v)
+	}
+
+	sum := decode(t, metrics[1].bytes)
+	if _, ok := sum[5]; ok {
+		t.Fatalf("counter encoded as gauge")
+	}
+	// Sum.data_points = 1, aggregation_temporality = 2 (CUMULATIVE), is_monotonic = 3
+	s := decode(t, one(t, sum, 7).bytes)
+	if temporality := one(t, s, 2).varint; temporality != 2 {
+		t.Fatalf("want cumulative temporality 2, got %d", temporality)
+	}
+	if monotonic := one(t, s, 3).varint; monotonic != 1 {
+		t.Fatalf("sum not monotonic")
+	}
+	dp := decode(t, one(t, s, 1).bytes)
+	// NumberDataPoint.start_time_unix_nano = 2
+	if got := one(t, dp, 2).fixed64; got != uint64(start.UnixNano()) {
+		t.Fatalf("want start %d, got %d", start.UnixNano(), got)
+	}
+	if got := one(t, dp, 3).fixed64; got != uint64(now.UnixNano()) {
+		t.Fatalf("want time %d, got %d", now.UnixNano(), got)
+	}
+	if v := math.Float64frombits(one(t, dp, 4).fixed64); v != 1024 {
+		t.Fatalf("want 1024, got %g", v)
+	}
+	// NumberDataPoint.attributes = 7
+	keys, values = attributes(t, dp[7])
+	if len(keys) != 2 || keys[0] != "host" || keys[1] != "interface" || values["interface"] != "eth0" {
+		t.Fatalf("bad point attributes : %v %v", keys, values)
+	}
+
+	rm = decode(t, resourceMetrics[1].bytes)
+	_, values = attributes(t, decode(t, one(t, rm, 1).bytes)[1])
+	if values["host.name"] != "10.0.0.2" {
+		t.Fatalf("second resource is not host b : %v", values)
+	}
+}
+
+func TestCumulativeReset(t *testing.T) {
+	attach := time.Unix(1700000000, 0)
+	c := NewCumulative(attach)
+	eth0 := map[string]string{"interface": "eth0"}
+	eth1 := map[string]string{"interface": "eth1"}
+	at := func(s int) time.Time { return attach.Add(time.Duration(s) * time.Second) }
+
+	if start := c.Start("bytes", eth0, 100, at(10)); !start.Equal(attach) {
+		t.Fatalf("first point should start at attach time, got %v", start)
+	}
+	if start := c.Start("bytes", eth0, 200, at(20)); !start.Equal(attach) {
+		t.Fatalf("increasing counter should keep its start, got %v", start)
+	}
+	// 主机重启, 计数从 0 开始
+	if start := c.Start("bytes", eth0, 5, at(30)); !start.Equal(at(20)) {
+		t.Fatalf("reset should move start to the previous sample, got %v", start)
+	}
+	if start := c.Start("bytes", eth0, 50, at(40)); !start.Equal(at(20)) {
+		t.Fatalf("start should stay after reset, got %v", start)
+	}
+	if start := c.Start("bytes", eth1, 1, at(40)); !start.Equal(attach) {
+		t.Fatalf("other series should not be affected, got %v", start)
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"fmt"
+	"github.com/pelletier/go-toml"
+	"logger"
+	"mongoDB"
+	"ssh"
+	"strings"
+	"sync"
+	"time"
+)
+
+// probeRuleId 主机不可达告警的 RuleId, 不对应保存的规则
+const probeRuleId = "hostDown"
+
+// probeState 一个保存的 ssh 的探测状态
+type probeState struct {
+	username string
+	// known 为 false 时还没有确定状态, 例如第一次探测失败但未达到 Failures
+	known bool
+	state string
+	// since 进入当前状态的时间
+	since    time.Time
+	failures int
+	check    time.Time
+	result   ssh.ProbeResult
+	// 保存的凭据每个版本只登录一次, version 为已经登录过的 UpdateTime, authResult 为那次登录的认证失败
+	loggedIn   bool
+	version    time.Time
+	authResult ssh.ProbeResult
+	// jump 多轮探测之间持有的跳板机连接, 断开后才重新登录跳板机, ssh 删除或不再经过跳板机时释放
+	jump *ssh.ProxyJump
+	// jumpKey 为拒绝登录的跳板机和凭据, 改变之前不再重新登录, jumpResult 为那次的结果
+	jumpKey    string
+	jumpResult ssh.ProbeResult
+}
+
+// prober 定时对所有保存的 ssh 做 TCP 和 ssh 握手探测, 记录状态变化, 不可达时触发告警.
+// 握手只到密钥交换, 凭据只在还没有验证过时登录一次, 避免探测本身触发登录失败封禁
+type prober struct {
+	mutex  sync.Mutex
+	states map[string]*probeState
+	// alerts 为 nil 时只记录状态变化
+	alerts   *alertEngine
+	interval time.Duration
+	timeout  time.Duration
+	// failures 连续失败这么多次才视为不可达, 避免网络抖动误报
+	failures int
+	workers  int
+	severity string
+}
+
+var probe *prober
+
+// startProbe 按 conf.toml 的 [probe] 开始探测, 返回 nil 时不提供探测接口
+func startProbe(conf *toml.Tree, alerts *alertEngine) *prober {
+	if !conf.GetDefault("probe.Enable", false).(bool) {
+		return nil
+	}
+	p := &prober{
+		states:   make(map[string]*probeState),
+		alerts:   alerts,
+		interval: time.Duration(conf.GetDefault("probe.Interval", int64(60)).(int64)) * time.Second,
+		timeout:  time.Duration(conf.GetDefault("probe.Timeout", int64(10)).(int64)) * time.Second,
+		failures: int(conf.GetDefault("probe.Failures", int64(2)).(int64)),
+		workers:  int(conf.GetDefault("probe.Workers", int64(16)).(int64)),
+		severity: conf.GetDefault("probe.Severity", "critical").(string),
+	}
+	if p.interval <= 0 || p.timeout <= 0 || p.failures <= 0 || p.workers <= 0 {
+		logger.L.Fatalf("probe.Interval, Timeout, Failures and Workers must be positive")
+	}
+	if !contains([]string{"info", "warning", "critical"}, p.severity) {
+		logger.L.Fatalf("probe.Severity must be one of info, warning and critical")
+	}
+	if alerts == nil {
+		logger.L.Warnf("probe without [alert] enabled only records host up and down")
+	}
+	go p.run()
+	logger.L.Infof("probe saved ssh every %v", p.interval)
+	return p
+}
+
+func (p *prober) run() {
+	for ; ; time.Sleep(p.interval) {
+		userSSH, err := mongoDB.Client.SelectAllUserSSH()
+		if err != nil {
+			logger.L.Warnf("probe scan saved ssh fail : %v", err)
+			if userSSH == nil {
+				continue
+			}
+		}
+		p.round(userSSH)
+	}
+}
+
+// round 同时最多探测 Workers 个 ssh, 删除的 ssh 不再保留状态, 正在触发的告警恢复
+func (p *prober) round(userSSH []mongoDB.UserSSH) {
+	saved := make(map[string]bool)
+	workers := make(chan struct{}, p.workers)
+	var wg sync.WaitGroup
+	for i := range userSSH {
+		u := userSSH[i]
+		// 本机伪主机没有连接, 不需要探测
+		if ssh.IsLocal(u.Port, u.Host, u.User) {
+			continue
+		}
+		saved[u.Key] = true
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			workers <- struct{}{}
+			defer func() { <-workers }()
+			p.check(u)
+		}()
+	}
+	wg.Wait()
+
+	now := time.Now()
+	resolved := make([]mongoDB.Alert, 0)
+	jumps := make([]*ssh.ProxyJump, 0)
+	p.mutex.Lock()
+	for key, s := range p.states {
+		if saved[key] {
+			continue
+		}
+		if s.known && s.state == mongoDB.HostDown {
+			resolved = append(resolved, p.alert(key, s, mongoDB.AlertResolved, now, "ssh deleted"))
+		}
+		if s.jump != nil {
+			jumps = append(jumps, s.jump)
+		}
+		delete(p.states, key)
+	}
+	p.mutex.Unlock()
+	for _, jump := range jumps {
+		jump.Release()
+	}
+	if p.alerts != nil {
+		for _, a := range resolved {
+			p.alerts.raise(a)
+		}
+	}
+}
+
+func (p *prober) check(u mongoDB.UserSSH) {
+	s := p.state(u)
+	p.mutex.Lock()
+	login := !u.Verified && (!s.loggedIn || !s.version.Equal(u.UpdateTime))
+	authResult := s.authResult
+	p.mutex.Unlock()
+
+	auth := sshAuth(&u)
+	var result ssh.ProbeResult
+	if hops, err := proxyJumpHops(&u); err != nil {
+		result = ssh.ProbeResult{Stage: ssh.ProbeTCP, Error: err.Error()}
+	} else if jump, jumpResult := p.proxyJump(s, hops); jumpResult.Error != "" {
+		result = jumpResult
+	} else {
+		result = ssh.M.Probe(u.Port, u.Host, u.User, auth, p.timeout, login, jump)
+	}
+	if login && (result.Error == "" || result.Stage == ssh.ProbeAuth) {
+		// 认证成功或失败都不再用这个版本的凭据登录, 修改保存的 ssh 后重新登录
+		p.mutex.Lock()
+		s.loggedIn, s.version, s.authResult = true, u.UpdateTime, ssh.ProbeResult{}
+		if result.Stage == ssh.ProbeAuth {
+			s.authResult = result
+		}
+		p.mutex.Unlock()
+		if result.Error == "" {
+			verifiedHelper(&u)
+		}
+	} else if !login && result.Error == "" && authResult.Error != "" && !u.Verified {
+		// 握手成功不说明凭据可用, 保持上次登录的认证失败
+		result.Stage, result.Error = authResult.Stage, authResult.Error
+	}
+	p.observe(u, result, time.Now())
+}
+
+// proxyJump 返回 s 持有的跳板机连接, 没有或已经断开时重新登录跳板机, 跳板机拒绝过的凭据不重复登录
+func (p *prober) proxyJump(s *probeState, hops []ssh.Hop) (*ssh.ProxyJump, ssh.ProbeResult) {
+	p.mutex.Lock()
+	jump, jumpKey, jumpResult := s.jump, s.jumpKey, s.jumpResult
+	s.jump = nil
+	p.mutex.Unlock()
+	if jump != nil && (len(hops) == 0 || !jump.Alive(hops)) {
+		jump.Release()
+		jump = nil
+	}
+	if len(hops) == 0 {
+		return nil, ssh.ProbeResult{}
+	}
+	key := ssh.ProxyJumpKey(hops)
+	var result ssh.ProbeResult
+	if jump == nil {
+		if jumpKey == key {
+			return nil, jumpResult
+		}
+		var err error
+		if jump, err = ssh.M.HoldProxyJump(hops); err != nil {
+			result = ssh.ProbeResult{Stage: ssh.ProbeTCP, Error: fmt.Sprintf("proxy jump : %v", err)}
+		}
+	}
+	p.mutex.Lock()
+	s.jump = jump
+	s.jumpKey, s.jumpResult = "", ssh.ProbeResult{}
+	if strings.Contains(result.Error, "unable to authenticate") {
+		s.jumpKey, s.jumpResult = key, result
+	}
+	p.mutex.Unlock()
+	return jump, result
+}
+
+// hostState 探测结果对应的主机状态
+func hostState(result ssh.ProbeResult) string {
+	switch {
+	case result.Error == "":
+		return mongoDB.HostUp
+	case result.Stage == ssh.ProbeHostKey:
+		return mongoDB.HostHostKeyChanged
+	case result.Stage == ssh.ProbeAuth:
+		return mongoDB.HostAuthFail
+	default:
+		return mongoDB.HostDown
+	}
+}
+
+// reachable sshd 有响应的状态都计入可达时间
+func reachable(state string) bool {
+	return state == mongoDB.HostUp || state == mongoDB.HostHostKeyChanged || state == mongoDB.HostAuthFail
+}
+
+// state 第一次探测时从最后一次状态变化恢复, 重启前不可达的主机恢复告警但不重复通知
+func (p *prober) state(u mongoDB.UserSSH) *probeState {
+	p.mutex.Lock()
+	s, ok := p.states[u.Key]
+	p.mutex.Unlock()
+	if ok {
+		return s
+	}
+	s = &probeState{username: u.UserName}
+	last, err := mongoDB.Client.LastHostEvent(u.Key, time.Now())
+	if err != nil {
+		logger.L.Warnf("probe load state of %s fail : %v", u.Key, err)
+	} else if last != nil {
+		s.known = true
+		s.state = last.State
+		s.since = last.Time
+		s.result = ssh.ProbeResult{Stage: last.Stage, Error: last.Error}
+		if s.state == mongoDB.HostDown && p.alerts != nil {
+			p.alerts.restore(p.alert(u.Key, s, mongoDB.AlertFiring, last.Time, ""))
+		}
+	}
+	p.mutex.Lock()
+	p.states[u.Key] = s
+	p.mutex.Unlock()
+	return s
+}
+
+// observe 用一次探测结果更新状态, 状态变化时写入 HostEvent 并触发或恢复告警
+func (p *prober) observe(u mongoDB.UserSSH, result ssh.ProbeResult, now time.Time) {
+	s := p.state(u)
+	p.mutex.Lock()
+	s.username = u.UserName
+	s.check = now
+	s.result = result
+	known, old, since := s.known, s.state, s.since
+	state := hostState(result)
+	changed := false
+	if state != mongoDB.HostDown {
+		s.failures = 0
+		changed = !known || old != state
+	} else {
+		s.failures++
+		changed = s.failures >= p.failures && (!known || old != mongoDB.HostDown)
+	}
+	var a mongoDB.Alert
+	if changed {
+		s.known = true
+		s.state = state
+		s.since = now
+		if state == mongoDB.HostDown {
+			a = p.alert(u.Key, s, mongoDB.AlertFiring, now, "")
+		} else if known && old == mongoDB.HostDown {
+			a = p.alert(u.Key, s, mongoDB.AlertResolved, now, fmt.Sprintf("down for %v", now.Sub(since).Round(time.Second)))
+			a.StartTime = since
+		}
+	}
+	p.mutex.Unlock()
+	if !changed {
+		return
+	}
+
+	event := mongoDB.HostEvent{
+		UserName: u.UserName,
+		Host:     u.Key,
+		State:    state,
+		Stage:    result.Stage,
+		Error:    result.Error,
+		Latency:  float64(result.Latency) / float64(time.Millisecond),
+		Time:     now,
+	}
+	if result.Error != "" {
+		logger.L.Infof("probe %s %s at %s : %s", u.Key, state, result.Stage, result.Error)
+	} else {
+		logger.L.Infof("probe %s up", u.Key)
+	}
+	if err := mongoDB.Client.InsertHostEvent(event); err != nil {
+		logger.L.Warnf("record host event fail : %v", err)
+	}
+	if p.alerts != nil && a.State != "" {
+		p.alerts.raise(a)
+	}
+}
+
+// alert 主机不可达告警, 调用者持有锁
+func (p *prober) alert(key string, s *probeState, state string, now time.Time, reason string) mongoDB.Alert {
+	message := fmt.Sprintf("%s unreachable at %s : %s", key, s.result.Stage, s.result.Error)
+	value := 0.0
+	if state == mongoDB.AlertResolved {
+		message = fmt.Sprintf("%s reachable again", key)
+		value = 1
+	}
+	if reason != "" {
+		message += " : " + reason
+	}
+	return mongoDB.Alert{
+		RuleId:    probeRuleId,
+		RuleName:  "host down",
+		UserName:  s.username,
+		Host:      key,
+		Metric:    "Probe.Up",
+		Labels:    map[string]string{},
+		Operator:  "<",
+		Threshold: 1,
+		Severity:  p.severity,
+		State:     state,
+		Value:     value,
+		StartTime: s.since,
+		Time:      now,
+		Message:   message,
+	}
+}
+
+// status 用户保存的 ssh 的当前探测状态, 还没有探测的不返回
+func (p *prober) status(key string) (probeState, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	s, ok := p.states[key]
+	if !ok {
+		return probeState{}, false
+	}
+	return *s, true
+}
+
+// availability [from, to) 内可达时间的百分比, 主机密钥变化和认证失败时 sshd 仍然响应, 也算可达, 没有状态记录的时间不计入, 全都没有记录时返回 nil
+func availability(last *mongoDB.HostEvent, events []mongoDB.HostEvent, from time.Time, to time.Time) *float64 {
+	var up, known time.Duration
+	state := ""
+	if last != nil {
+		state = last.State
+	}
+	at := from
+	add := func(end time.Time) {
+		if state == "" || !end.After(at) {
+			return
+		}
+		known += end.Sub(at)
+		if reachable(state) {
+			up += end.Sub(at)
+		}
+	}
+	for _, e := range events {
+		add(e.Time)
+		state, at = e.State, e.Time
+	}
+	add(to)
+	if known == 0 {
+		return nil
+	}
+	r := float64(up) / float64(known) * 100
+	return &r
+}
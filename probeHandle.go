@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"mongoDB"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ProbeStatusData 保存的 ssh 的探测状态, Availability 为最近 24 小时可达时间的百分比
+type ProbeStatusData struct {
+	Key   string `json:"key"`
+	Name  string `json:"name"`
+	State string `json:"state"`
+	// Since 进入当前状态的时间, 还没有确定状态时为空
+	Since        *time.Time `json:"since"`
+	CheckTime    *time.Time `json:"checkTime"`
+	Latency      float64    `json:"latency"`
+	Stage        string     `json:"stage"`
+	Error        string     `json:"error"`
+	Availability *float64   `json:"availability"`
+}
+
+type ProbeStatusResponse struct {
+	Code    int               `json:"code"`
+	Message *string           `json:"message"`
+	Data    []ProbeStatusData `json:"data"`
+}
+
+type ProbeHistoryData struct {
+	Host         string              `json:"host"`
+	From         time.Time           `json:"from"`
+	To           time.Time           `json:"to"`
+	Availability *float64            `json:"availability"`
+	Events       []mongoDB.HostEvent `json:"events"`
+}
+
+type ProbeHistoryResponse struct {
+	Code    int               `json:"code"`
+	Message *string           `json:"message"`
+	Data    *ProbeHistoryData `json:"data"`
+}
+
+// hostAvailability 从 HostEvent 计算 [from, to) 内的可用率
+func hostAvailability(host string, from time.Time, to time.Time) (*float64, []mongoDB.HostEvent, error) {
+	last, err := mongoDB.Client.LastHostEvent(host, from)
+	if err != nil {
+		return nil, nil, err
+	}
+	events, err := mongoDB.Client.SelectHostEvent(host, from, to)
+	if err != nil {
+		return nil, nil, err
+	}
+	return availability(last, events, from, to), events, nil
+}
+
+// selectProbeStatusHandler 用户所有保存的 ssh 的当前状态, 还没有探测完成的为 unknown
+func selectProbeStatusHandler(context *gin.Context) {
+	username := context.Request.Header.Get("User-Name")
+	userSSH, err := mongoDB.Client.SelectUserSSH(username, "")
+	probeStatusResponse := &ProbeStatusResponse{
+		Code:    200,
+		Message: nil,
+		Data:    make([]ProbeStatusData, 0),
+	}
+	if err != nil {
+		errText := fmt.Sprintf("Select Probe Status Fail : %v", err)
+		probeStatusResponse.Code = 500
+		probeStatusResponse.Message = &errText
+		context.JSON(http.StatusOK, probeStatusResponse)
+		return
+	}
+	now := time.Now()
+	for _, u := range userSSH {
+		data := ProbeStatusData{
+			Key:   u.Key,
+			Name:  u.Name,
+			State: "unknown",
+		}
+		if s, ok := probe.status(u.Key); ok {
+			if s.known {
+				data.State = s.state
+				data.Since = &s.since
+			}
+			if !s.check.IsZero() {
+				data.CheckTime = &s.check
+			}
+			data.Latency = float64(s.result.Latency) / float64(time.Millisecond)
+			data.Stage = s.result.Stage
+			data.Error = s.result.Error
+		}
+		if data.Availability, _, err = hostAvailability(u.Key, now.Add(-24*time.Hour), now); err != nil {
+			errText := fmt.Sprintf("Select Probe Status Fail : %v", err)
+			probeStatusResponse.Code = 500
+			probeStatusResponse.Message = &errText
+		}
+		probeStatusResponse.Data = append(probeStatusResponse.Data, data)
+	}
+	context.JSON(http.StatusOK, probeStatusResponse)
+}
+
+// selectProbeHistoryHandler 查询 /probe/selectHistory?host=&from=&to=, 返回状态变化和这段时间的可用率
+func selectProbeHistoryHandler(context *gin.Context) {
+	username := context.Request.Header.Get("User-Name")
+	badRequest := func(err error) {
+		errText := fmt.Sprintf("Request Validate Fail %v", err)
+		context.JSON(http.StatusBadRequest, Response{
+			Code:    400,
+			Message: &errText,
+		})
+	}
+	host := context.Query("host")
+	if host == "" {
+		badRequest(errors.New("host is required"))
+		return
+	}
+	if !strings.HasPrefix(host, username+":") {
+		host = username + ":" + host
+	}
+	if userSSH, err := mongoDB.Client.GetUserSSH(host); err != nil || userSSH.UserName != username {
+		badRequest(fmt.Errorf("ssh %s not belong to user %s", host, username))
+		return
+	}
+	now := time.Now()
+	to, err := parseHistoryTime(context.Query("to"), now)
+	if err != nil {
+		badRequest(fmt.Errorf("to : %v", err))
+		return
+	}
+	from, err := parseHistoryTime(context.Query("from"), to.Add(-7*24*time.Hour))
+	if err != nil {
+		badRequest(fmt.Errorf("from : %v", err))
+		return
+	}
+	if !from.Before(to) {
+		badRequest(errors.New("from must be before to"))
+		return
+	}
+	// 未来的时间还没有状态
+	if to.After(now) {
+		to = now
+	}
+	probeHistoryResponse := &ProbeHistoryResponse{
+		Code:    200,
+		Message: nil,
+		Data:    nil,
+	}
+	percent, events, err := hostAvailability(host, from, to)
+	if err != nil {
+		errText := fmt.Sprintf("Select Probe History Fail : %v", err)
+		probeHistoryResponse.Code = 500
+		probeHistoryResponse.Message = &errText
+	} else {
+		probeHistoryResponse.Data = &ProbeHistoryData{
+			Host:         host,
+			From:         from,
+			To:           to,
+			Availability: percent,
+			Events:       events,
+		}
+	}
+	context.JSON(http.StatusOK, probeHistoryResponse)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"mongoDB"
+	"testing"
+	"time"
+)
+
+func TestAvailability(t *testing.T) {
+	from := time.Unix(1700000000, 0)
+	at := func(s int) time.Time { return from.Add(time.Duration(s) * time.Second) }
+	cases := []struct {
+		name   string
+		last   *mongoDB.HostEvent
+		events []mongoDB.HostEvent
+		// want 为 -1 时应该返回 nil
+		want float64
+	}{
+		{
+			name: "nothing known",
+			want: -1,
+		},
+		{
+			name: "leading unknown gap",
+			events: []mongoDB.HostEvent{
+				{State: mongoDB.HostUp, Time: at(40)},
+				{State: mongoDB.HostDown, Time: at(70)},
+			},
+			want: 50,
+		},
+		{
+			name: "state before the range",
+			last: &mongoDB.HostEvent{State: mongoDB.HostDown, Time: at(-100)},
+			events: []mongoDB.HostEvent{
+				{State: mongoDB.HostUp, Time: at(25)},
+			},
+			want: 75,
+		},
+		{
+			name: "sshd responding counts as reachable",
+			last: &mongoDB.HostEvent{State: mongoDB.HostAuthFail, Time: at(-100)},
+			events: []mongoDB.HostEvent{
+				{State: mongoDB.HostHostKeyChanged, Time: at(50)},
+			},
+			want: 100,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := availability(c.last, c.events, from, at(100))
+			if c.want < 0 {
+				if got != nil {
+					t.Fatalf("want nil, got %g", *got)
+				}
+				return
+			}
+			if got == nil {
+				t.Fatalf("want %g, got nil", c.want)
+			}
+			if *got != c.want {
+				t.Fatalf("want %g, got %g", c.want, *got)
+			}
+		})
+	}
+}
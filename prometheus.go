@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/pelletier/go-toml"
+	"logger"
+	"net/http"
+	"sort"
+	"ssh"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// prometheusKey Prometheus 导出使用的观察者 key
+const prometheusKey = "prometheus"
+
+// promSnapshot 一个事件最近一次的消息拆成的 Point
+type promSnapshot struct {
+	time   time.Time
+	points []ssh.Point
+}
+
+type promHost struct {
+	port int
+	host string
+	user string
+	// status 最近一次 status 事件, 每次 keepalive 和连接状态变化时更新
+	status promStatus
+	events map[string]promSnapshot
+}
+
+type promStatus struct {
+	time time.Time
+	up   bool
+	rtt  float64
+}
+
+// promExporter 作为观察者保存每个 ssh 每个事件的最新值, 在 /metrics 中按 Prometheus 文本格式输出
+type promExporter struct {
+	mutex sync.Mutex
+	hosts map[string]*promHost
+	// stale 超过这么久没有更新的事件不再输出, 断开的 ssh 的数据随之消失
+	stale       time.Duration
+	username    string
+	password    string
+	bearerToken string
+}
+
+var prometheus *promExporter
+
+// startPrometheus 按 conf.toml 的 [prometheus] 开始保存最新值, 返回 nil 时不提供 /metrics
+func startPrometheus(conf *toml.Tree) *promExporter {
+	if !conf.GetDefault("prometheus.Enable", false).(bool) {
+		return nil
+	}
+	e := &promExporter{
+		hosts:       make(map[string]*promHost),
+		stale:       time.Duration(conf.GetDefault("prometheus.Stale", int64(120)).(int64)) * time.Second,
+		username:    conf.GetDefault("prometheus.Username", "").(string),
+		password:    conf.GetDefault("prometheus.Password", "").(string),
+		bearerToken: conf.GetDefault("prometheus.BearerToken", "").(string),
+	}
+	if e.stale <= 0 {
+		logger.L.Fatalf("prometheus.Stale must be positive")
+	}
+	if e.bearerToken == "" && (e.username == "" || e.password == "") {
+		logger.L.Fatalf("prometheus needs Username and Password or BearerToken")
+	}
+	events := confEvents(conf, "prometheus.Events", ssh.Events)
+	interval := int(conf.GetDefault("prometheus.Interval", int64(0)).(int64))
+	intervals := make(map[string]int)
+	for _, event := range events {
+		intervals[event] = interval
+	}
+
+	ssh.M.AddObserver(prometheusKey, func(port int, host, user string) ssh.AllListener {
+		key := ssh.GeneralKey(port, host, user)
+		listeners := ssh.NewAllListener(events, func(event string, message interface{}) {
+			e.update(key, port, host, user, event, ssh.Points(message))
+		}, intervals)
+		listeners.StatusListener = func(m ssh.StatusMessage) {
+			e.setStatus(key, port, host, user, promStatus{time: time.Now(), up: m.State == ssh.StateUp, rtt: m.RTT})
+		}
+		return listeners
+	})
+	logger.L.Infof("export %v to prometheus", events)
+
+	if conf.GetDefault("prometheus.ExportAll", false).(bool) {
+		scanInterval := conf.GetDefault("prometheus.ScanInterval", int64(60)).(int64)
+		if scanInterval <= 0 {
+			logger.L.Fatalf("prometheus.ScanInterval must be positive")
+		}
+		go pinAllUserSSH(prometheusKey, time.Duration(scanInterval)*time.Second)
+	}
+	return e
+}
+
+// promHost 调用者持有写锁
+func (e *promExporter) promHost(key string, port int, host, user string) *promHost {
+	h, ok := e.hosts[key]
+	if !ok {
+		h = &promHost{port: port, host: host, user: user, events: make(map[string]promSnapshot)}
+		e.hosts[key] = h
+	}
+	return h
+}
+
+func (e *promExporter) update(key string, port int, host, user string, event string, points []ssh.Point) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.promHost(key, port, host, user).events[event] = promSnapshot{time: time.Now(), points: points}
+}
+
+func (e *promExporter) setStatus(key string, port int, host, user string, status promStatus) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.promHost(key, port, host, user).status = status
+}
+
+// authorized Basic 认证或 Bearer token 任一通过即可, 与登录的 token 无关
+func (e *promExporter) authorized(r *http.Request) bool {
+	if e.bearerToken != "" {
+		authorization := r.Header.Get("Authorization")
+		if strings.HasPrefix(authorization, "Bearer ") &&
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(authorization, "Bearer ")), []byte(e.bearerToken)) == 1 {
+			return true
+		}
+	}
+	if e.username != "" {
+		if username, password, ok := r.BasicAuth(); ok &&
+			subtle.ConstantTimeCompare([]byte(username), []byte(e.username)) == 1 &&
+			subtle.ConstantTimeCompare([]byte(password), []byte(e.password)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// promSeries 同名指标的一行
+type promSeries struct {
+	labels string
+	value  float64
+}
+
+func prometheusHandler(context *gin.Context) {
+	if !prometheus.authorized(context.Request) {
+		context.Header("WWW-Authenticate", `Basic realm="argusyes"`)
+		context.String(http.StatusUnauthorized, "unauthorized\n")
+		return
+	}
+	context.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", prometheus.render(time.Now()))
+}
+
+// render 输出 Prometheus 文本格式, 同名指标的行放在一起, 按名字和 labels 排序保证输出稳定
+func (e *promExporter) render(now time.Time) []byte {
+	series := make(map[string][]promSeries)
+	help := make(map[string]string)
+	counter := make(map[string]bool)
+	add := func(name string, labels string, value float64) {
+		series[name] = append(series[name], promSeries{labels: labels, value: value})
+	}
+
+	e.mutex.Lock()
+	for key, h := range e.hosts {
+		for event, snapshot := range h.events {
+			if now.Sub(snapshot.time) > e.stale {
+				delete(h.events, event)
+			}
+		}
+		// ssh 关闭后不再有 status 事件
+		if now.Sub(h.status.time) > e.stale {
+			delete(e.hosts, key)
+			continue
+		}
+		hostLabels := map[string]string{"host": h.host, "port": strconv.Itoa(h.port), "user": h.user}
+		up := 0.0
+		if h.status.up {
+			up = 1
+			add("argus_ssh_rtt_milliseconds", promLabels(hostLabels, nil), h.status.rtt)
+		}
+		add("argus_up", promLabels(hostLabels, nil), up)
+		for _, snapshot := range h.events {
+			for _, p := range snapshot.points {
+				name := promName(p.Name)
+				if ssh.IsCounter(p.Name) {
+					name += "_total"
+					counter[name] = true
+				}
+				help[name] = p.Name
+				add(name, promLabels(hostLabels, p.Labels), p.Value)
+			}
+		}
+	}
+	e.mutex.Unlock()
+	help["argus_up"] = "1 when the ssh connection is up"
+	help["argus_ssh_rtt_milliseconds"] = "keepalive round trip of the ssh connection"
+
+	names := make([]string, 0, len(series))
+	for name := range series {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		metricType := "gauge"
+		if counter[name] {
+			metricType = "counter"
+		}
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help[name], name, metricType)
+		s := series[name]
+		sort.Slice(s, func(i, j int) bool { return s[i].labels < s[j].labels })
+		for _, line := range s {
+			fmt.Fprintf(&b, "%s{%s} %s\n", name, line.labels, strconv.FormatFloat(line.value, 'g', -1, 64))
+		}
+	}
+	return []byte(b.String())
+}
+
+// promName 把 NetDev.UpSpeed 转为 argus_net_dev_up_speed
+func promName(pointName string) string {
+	parts := strings.Split(pointName, ".")
+	for i, part := range parts {
+		parts[i] = snakeCase(part)
+	}
+	return "argus_" + strings.Join(parts, "_")
+}
+
+// snakeCase 把 UpSpeed 转为 up_speed
+func snakeCase(s string) string {
+	var b strings.Builder
+	runes := []rune(strings.ReplaceAll(s, "MHz", "Mhz"))
+	for i, r := range runes {
+		// 小写或数字后的大写, 以及连续大写中后面跟着小写的那个, 是一个新单词的开始,
+		// 连续大写后结尾的 s 是复数, 例如 ReadIOs
+		plural := i+2 == len(runes) && runes[i+1] == 's'
+		if i > 0 && unicode.IsUpper(r) && (!unicode.IsUpper(runes[i-1]) ||
+			i+1 < len(runes) && unicode.IsLower(runes[i+1]) && !plural) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
+
+// promLabels 按名字排序输出 labels, 值按文本格式转义
+func promLabels(hostLabels map[string]string, labels map[string]string) string {
+	all := make(map[string]string, len(hostLabels)+len(labels))
+	for k, v := range labels {
+		all[k] = v
+	}
+	for k, v := range hostLabels {
+		all[k] = v
+	}
+	keys := make([]string, 0, len(all))
+	for k := range all {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf(`%s="%s"`, k, escaper.Replace(all[k]))
+	}
+	return strings.Join(parts, ",")
+}
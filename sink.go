@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"github.com/pelletier/go-toml"
+	"logger"
+	"sort"
+	"ssh"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// SinkSample 一台主机一个事件的一条消息拆成的 Point
+type SinkSample struct {
+	Port   int
+	Host   string
+	User   string
+	Time   time.Time
+	Points []ssh.Point
+}
+
+// Sink 写入指标的外部存储, 和 AllListener 一样以观察者接收所有监控中的主机的消息,
+// Write 返回错误时这一批留在缓冲区中, 之后和新的数据一起重试, 返回 sinkRejected 时丢弃
+type Sink interface {
+	Write(samples []SinkSample) error
+}
+
+// sinkRejected 数据被拒绝, 重试也不会成功
+type sinkRejected struct {
+	err error
+}
+
+func (e *sinkRejected) Error() string {
+	return e.err.Error()
+}
+
+// sinkFactories 按 [sink.<名字>] 的配置创建 Sink, 新的 Sink 在这里注册
+var sinkFactories = map[string]func(conf *toml.Tree) (Sink, error){
+	"influx":   newInfluxSink,
+	"graphite": newGraphiteSink,
+}
+
+// sinkRunner 缓存一个 Sink 的数据, 每 FlushInterval 秒写入一次, Sink 不可用时按指数退避重试
+type sinkRunner struct {
+	name    string
+	sink    Sink
+	samples chan SinkSample
+	// bufferSize 最多缓存的数据点数, 超出时丢弃最早的
+	bufferSize    int
+	flushInterval time.Duration
+	retryMax      time.Duration
+	// dropped 缓存满时丢弃的条数, 每次写入时报告
+	dropped int64
+}
+
+// startSinks 启动 conf.toml 中开启的 [sink.<名字>]
+func startSinks(conf *toml.Tree) {
+	names := make([]string, 0, len(sinkFactories))
+	for name := range sinkFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		t, ok := conf.Get("sink." + name).(*toml.Tree)
+		if !ok || !t.GetDefault("Enable", false).(bool) {
+			continue
+		}
+		sink, err := sinkFactories[name](t)
+		if err != nil {
+			logger.L.Fatalf("create sink %s fail : %v", name, err)
+		}
+		startSink(name, sink, conf)
+	}
+}
+
+func startSink(name string, sink Sink, conf *toml.Tree) {
+	key := "sink." + name
+	r := &sinkRunner{
+		name:          name,
+		sink:          sink,
+		samples:       make(chan SinkSample, 1024),
+		bufferSize:    int(conf.GetDefault(key+".BufferSize", int64(100000)).(int64)),
+		flushInterval: time.Duration(conf.GetDefault(key+".FlushInterval", int64(10)).(int64)) * time.Second,
+		retryMax:      time.Duration(conf.GetDefault(key+".RetryMax", int64(300)).(int64)) * time.Second,
+	}
+	if r.bufferSize <= 0 || r.flushInterval <= 0 || r.retryMax < r.flushInterval {
+		logger.L.Fatalf("%s.BufferSize and FlushInterval must be positive and RetryMax must not be less than FlushInterval", key)
+	}
+	events := confEvents(conf, key+".Events", []string{"cpuPerformance", "memoryPerformance", "loadavg", "netDev", "netStat", "temp", "disk"})
+	interval := int(conf.GetDefault(key+".Interval", int64(0)).(int64))
+	intervals := make(map[string]int)
+	for _, event := range events {
+		intervals[event] = interval
+	}
+
+	go r.run()
+	ssh.M.AddObserver(key, func(port int, host, user string) ssh.AllListener {
+		return ssh.NewAllListener(events, r.record(port, host, user), intervals)
+	})
+	logger.L.Infof("write %v to sink %s", events, name)
+
+	if conf.GetDefault(key+".ExportAll", false).(bool) {
+		scanInterval := conf.GetDefault(key+".ScanInterval", int64(60)).(int64)
+		if scanInterval <= 0 {
+			logger.L.Fatalf("%s.ScanInterval must be positive", key)
+		}
+		go pinAllUserSSH(key, time.Duration(scanInterval)*time.Second)
+	}
+}
+
+// confEvents 读取事件列表, 没有配置时使用 defaults
+func confEvents(conf *toml.Tree, key string, defaults []string) []string {
+	list, ok := conf.Get(key).([]interface{})
+	if !ok {
+		return defaults
+	}
+	events := make([]string, 0, len(list))
+	for _, v := range list {
+		event, ok := v.(string)
+		if !ok || !isEvent(event) {
+			logger.L.Fatalf("%s must be a list of events, got %v", key, v)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func (r *sinkRunner) record(port int, host, user string) func(event string, message interface{}) {
+	return func(event string, message interface{}) {
+		points := ssh.Points(message)
+		if len(points) == 0 {
+			return
+		}
+		// 不阻塞采集循环, 写入跟不上时丢弃
+		select {
+		case r.samples <- SinkSample{Port: port, Host: host, User: user, Time: time.Now(), Points: points}:
+		default:
+			atomic.AddInt64(&r.dropped, int64(len(points)))
+		}
+	}
+}
+
+func (r *sinkRunner) run() {
+	ticker := time.NewTicker(r.flushInterval)
+	defer ticker.Stop()
+	pending := make([]SinkSample, 0)
+	n := 0
+	backoff := r.flushInterval
+	var next time.Time
+	for {
+		select {
+		case s := <-r.samples:
+			pending = append(pending, s)
+			n += len(s.Points)
+			for n > r.bufferSize && len(pending) > 1 {
+				n -= len(pending[0].Points)
+				atomic.AddInt64(&r.dropped, int64(len(pending[0].Points)))
+				pending = pending[1:]
+			}
+		case now := <-ticker.C:
+			if dropped := atomic.SwapInt64(&r.dropped, 0); dropped > 0 {
+				logger.L.Warnf("sink %s buffer full, %d points dropped", r.name, dropped)
+			}
+			if len(pending) == 0 || now.Before(next) {
+				continue
+			}
+			err := r.sink.Write(pending)
+			var rejected *sinkRejected
+			if err != nil && !errors.As(err, &rejected) {
+				next = now.Add(backoff)
+				logger.L.Warnf("sink %s unavailable, %d points buffered, retry in %v : %v", r.name, n, backoff, err)
+				if backoff *= 2; backoff > r.retryMax {
+					backoff = r.retryMax
+				}
+				continue
+			}
+			if err != nil {
+				logger.L.Warnf("sink %s rejected %d points : %v", r.name, n, err)
+			}
+			if backoff != r.flushInterval {
+				logger.L.Infof("sink %s available again", r.name)
+				backoff = r.flushInterval
+			}
+			pending = make([]SinkSample, 0)
+			n = 0
+		}
+	}
+}
+
+// sinkFields 把一条消息的 Point 按结构体和 labels 分组, 例如 NetDev.UpSpeed 和 NetDev.UpBytes
+// 在同一个 interface 下是同一组, 返回的分组按出现顺序排列
+func sinkFields(points []ssh.Point) []sinkGroup {
+	groups := make([]sinkGroup, 0)
+	index := make(map[string]int)
+	for _, p := range points {
+		structName, field, _ := strings.Cut(p.Name, ".")
+		key := structName + "\x00" + labelsKey(p.Labels)
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, sinkGroup{Struct: structName, Labels: p.Labels})
+		}
+		groups[i].Fields = append(groups[i].Fields, sinkField{Name: field, Value: p.Value})
+	}
+	return groups
+}
+
+type sinkGroup struct {
+	Struct string
+	Labels map[string]string
+	Fields []sinkField
+}
+
+type sinkField struct {
+	Name  string
+	Value float64
+}
+
+func labelsKey(labels map[string]string) string {
+	keys := sortedKeys(labels)
+	key := ""
+	for _, k := range keys {
+		key += k + "=" + labels[k] + "\x00"
+	}
+	return key
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,110 @@
+package ssh
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"logger"
+)
+
+// digestKey 进程启动时随机生成, 凭据摘要只在内存中比较
+var digestKey = make([]byte, 32)
+
+func init() {
+	if _, err := rand.Read(digestKey); err != nil {
+		logger.L.Fatalf("generate digest key fail : %v", err)
+	}
+}
+
+// Auth 连接 ssh 使用的凭据, 所有非空的凭据都会按公钥、密码、键盘交互的顺序尝试
+type Auth struct {
+	Passwd string
+	// PrivateKey PEM 格式的私钥, Passphrase 为空时私钥不能加密
+	PrivateKey string
+	Passphrase string
+	// Certificate OpenSSH 证书, authorized_keys 格式, 需要同时提供对应的私钥
+	Certificate string
+	// KnownHosts 为空时不校验主机公钥
+	KnownHosts KnownHostsStore
+	// ProxyJump 依次经过的跳板机, 为空时直接连接
+	ProxyJump []Hop
+}
+
+// digest 凭据的摘要, 用于判断共享的连接是否由相同的凭据建立
+func (a Auth) digest() string {
+	h := hmac.New(sha256.New, digestKey)
+	for _, v := range []string{a.Passwd, a.PrivateKey, a.Passphrase, a.Certificate} {
+		_, _ = fmt.Fprintf(h, "%d:%s", len(v), v)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Validate 检查凭据能否生成认证方式, 用于保存前提示错误
+func (a Auth) Validate() error {
+	_, err := a.methods()
+	return err
+}
+
+func (a Auth) signer() (ssh.Signer, error) {
+	var signer ssh.Signer
+	var err error
+	if a.Passphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase([]byte(a.PrivateKey), []byte(a.Passphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey([]byte(a.PrivateKey))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse private key fail : %v", err)
+	}
+	if a.Certificate == "" {
+		return signer, nil
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(a.Certificate))
+	if err != nil {
+		return nil, fmt.Errorf("parse certificate fail : %v", err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, errors.New("parse certificate fail : not a certificate")
+	}
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, fmt.Errorf("parse certificate fail : %v", err)
+	}
+	return certSigner, nil
+}
+
+func (a Auth) methods() ([]ssh.AuthMethod, error) {
+	methods := make([]ssh.AuthMethod, 0)
+	if a.PrivateKey != "" {
+		signer, err := a.signer()
+		if err != nil {
+			return nil, err
+		}
+		methods = append(methods, ssh.PublicKeys(signer))
+	} else if a.Certificate != "" {
+		return nil, errors.New("certificate needs private key")
+	}
+	if a.Passwd != "" {
+		passwd := a.Passwd
+		methods = append(methods, ssh.Password(passwd))
+		// 大多数服务器键盘交互只询问一次密码, 不回显的问题都用密码回答
+		methods = append(methods, ssh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+			answers := make([]string, len(questions))
+			for i := range questions {
+				if !echos[i] {
+					answers[i] = passwd
+				}
+			}
+			return answers, nil
+		}))
+	}
+	if len(methods) == 0 {
+		return nil, errors.New("no credential")
+	}
+	return methods, nil
+}
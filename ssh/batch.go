@@ -0,0 +1,176 @@
+package ssh
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"logger"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// batchFresh 内的读取复用同一次 exec 的结果, 同一轮的采集只执行一次命令
+	batchFresh = 500 * time.Millisecond
+	// batchExpire 内没有再读取的文件不再放进命令
+	batchExpire = time.Minute
+	batchMarker = "\n@@argus "
+	batchStatus = "\n@@argus-status "
+)
+
+// batchReader 用一次 exec 读取所有采集需要的文件, exec 被禁止时由 SFTP 读取
+type batchReader struct {
+	sshClient *ssh.Client
+	mutex     sync.Mutex
+	disabled  bool
+	wanted    map[string]time.Time
+	cache     map[string]batchResult
+	fetched   time.Time
+}
+
+type batchResult struct {
+	content string
+	err     error
+}
+
+func newBatchReader(sshClient *ssh.Client) *batchReader {
+	return &batchReader{
+		sshClient: sshClient,
+		disabled:  transport != TransportExec,
+		wanted:    make(map[string]time.Time),
+		cache:     make(map[string]batchResult),
+	}
+}
+
+// enabled 返回 false 时使用 SFTP
+func (b *batchReader) enabled() bool {
+	if b == nil {
+		return false
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return !b.disabled
+}
+
+func (b *batchReader) disable(reason string) {
+	b.disabled = true
+	logger.L.Infof("exec collection disabled, fall back to sftp : %s", reason)
+}
+
+// run 执行命令返回标准输出, exec 请求被拒绝时返回 errExecDenied
+func (b *batchReader) run(cmd string) (string, error) {
+	session, err := b.sshClient.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+	var stdout bytes.Buffer
+	session.Stdout = &stdout
+	if err := session.Start(cmd); err != nil {
+		return "", fmt.Errorf("%w : %v", errExecDenied, err)
+	}
+	if err := session.Wait(); err != nil {
+		return "", err
+	}
+	return stdout.String(), nil
+}
+
+var errExecDenied = errors.New("exec denied")
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// readFile 读取 where, 同时刷新最近读取过的所有文件
+func (b *batchReader) readFile(where string) (string, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := time.Now()
+	b.wanted[where] = now
+	if r, ok := b.cache[where]; ok && now.Sub(b.fetched) < batchFresh {
+		return r.content, r.err
+	}
+
+	paths := make([]string, 0, len(b.wanted))
+	for path, t := range b.wanted {
+		if now.Sub(t) > batchExpire {
+			delete(b.wanted, path)
+			continue
+		}
+		paths = append(paths, shellQuote(path))
+	}
+	sort.Strings(paths)
+	cmd := fmt.Sprintf(`for f in %s; do printf '%%s%%s\n' %s "$f"; cat "$f" 2>/dev/null; printf '%%s%%s' %s $?; done`,
+		strings.Join(paths, " "), shellQuote(batchMarker), shellQuote(batchStatus))
+	output, err := b.run(cmd)
+	if errors.Is(err, errExecDenied) {
+		b.disable(err.Error())
+		return "", err
+	} else if err != nil {
+		return "", err
+	}
+	cache, ok := parseBatchOutput(output)
+	if !ok {
+		// 例如 ForceCommand internal-sftp, 命令没有被执行
+		b.disable("unexpected exec output")
+		return "", errors.New("unexpected exec output")
+	}
+	b.cache = cache
+	b.fetched = now
+	if r, ok := b.cache[where]; ok {
+		return r.content, r.err
+	}
+	return "", fmt.Errorf("%s missing in exec output", where)
+}
+
+// parseBatchOutput 输出格式为 marker path \n content status code, 重复每个文件
+func parseBatchOutput(output string) (map[string]batchResult, bool) {
+	if !strings.HasPrefix(output, batchMarker) {
+		return nil, false
+	}
+	cache := make(map[string]batchResult)
+	for _, chunk := range strings.Split(output, batchMarker)[1:] {
+		path, rest, ok := strings.Cut(chunk, "\n")
+		if !ok {
+			return nil, false
+		}
+		i := strings.LastIndex(rest, batchStatus)
+		if i < 0 {
+			return nil, false
+		}
+		code, err := strconv.Atoi(strings.TrimSpace(rest[i+len(batchStatus):]))
+		if err != nil {
+			return nil, false
+		}
+		if code != 0 {
+			cache[path] = batchResult{err: fmt.Errorf("read %s : %w", path, os.ErrNotExist)}
+		} else {
+			cache[path] = batchResult{content: rest[:i]}
+		}
+	}
+	return cache, true
+}
+
+// processes 一次命令读取 /proc/stat 第一行和所有进程的 stat statm, 格式与 getProcessNew 一致
+func (b *batchReader) processes() (string, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	cmd := `head -n 1 /proc/stat; for d in /proc/[0-9]*; do { read -r s < "$d/stat" && read -r m < "$d/statm" && printf '%s %s\n' "$s" "$m"; } 2>/dev/null; done`
+	output, err := b.run(cmd)
+	if errors.Is(err, errExecDenied) {
+		b.disable(err.Error())
+		return "", err
+	} else if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(output, "cpu ") {
+		b.disable("unexpected exec output")
+		return "", errors.New("unexpected exec output")
+	}
+	return strings.TrimRight(output, "\n"), nil
+}
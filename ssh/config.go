@@ -0,0 +1,70 @@
+package ssh
+
+import (
+	"github.com/pelletier/go-toml"
+	"logger"
+	"time"
+)
+
+// defaultIntervals 默认采集间隔, 单位秒, 可以在 conf.toml 的 [monitor.Interval] 中修改
+var defaultIntervals = map[string]int64{
+	"cpuInfo":           10,
+	"cpuPerformance":    2,
+	"memoryPerformance": 2,
+	"uptime":            2,
+	"loadavg":           2,
+	"netDev":            2,
+	"netStat":           2,
+	"temp":              2,
+	"disk":              2,
+	"process":           5,
+	"rough":             2,
+}
+
+const (
+	TransportExec = "exec"
+	TransportSFTP = "sftp"
+)
+
+// transport exec 时每轮用一条命令读取所有文件, exec 被禁止时自动改用 SFTP
+var transport = TransportExec
+
+func init() {
+	conf, err := toml.LoadFile("./conf.toml")
+	if err != nil {
+		logger.L.Warnf("Read Config File Fail %v, use default monitor config", err)
+		return
+	}
+	transport = conf.GetDefault("monitor.Transport", TransportExec).(string)
+	if transport != TransportExec && transport != TransportSFTP {
+		logger.L.Fatalf("monitor.Transport must be %s or %s", TransportExec, TransportSFTP)
+	}
+	local.enable = conf.GetDefault("monitor.Local.Enable", false).(bool)
+	local.root = conf.GetDefault("monitor.Local.Root", "").(string)
+	local.users = make(map[string]bool)
+	if users, ok := conf.Get("monitor.Local.Users").([]interface{}); ok {
+		for _, user := range users {
+			username, ok := user.(string)
+			if !ok {
+				logger.L.Fatalf("monitor.Local.Users must be a list of user names")
+			}
+			local.users[username] = true
+		}
+	}
+	for event, second := range defaultIntervals {
+		second = conf.GetDefault("monitor.Interval."+event, second).(int64)
+		if second <= 0 {
+			logger.L.Fatalf("monitor.Interval.%s must be positive", event)
+		}
+		defaultIntervals[event] = second
+	}
+}
+
+func defaultInterval(event string) time.Duration {
+	return time.Duration(defaultIntervals[event]) * time.Second
+}
+
+// interval intervals 中没有的事件返回 0, 使用默认间隔
+func interval(intervals map[string]int, event string) time.Duration {
+	return time.Duration(intervals[event]) * time.Second
+}
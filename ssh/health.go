@@ -0,0 +1,124 @@
+package ssh
+
+import (
+	"errors"
+	"logger"
+	"time"
+)
+
+const (
+	keepaliveInterval    = 5 * time.Second
+	keepaliveTimeout     = 3 * time.Second
+	keepaliveMaxFailures = 3
+	reconnectMinDelay    = time.Second
+	reconnectMaxDelay    = time.Minute
+)
+
+var errKeepaliveTimeout = errors.New("keepalive timeout")
+
+func (h *SSH) setState(state ConnectionStateMessage) {
+	state.Message = Message{Port: h.Port, Host: h.Host, User: h.User}
+	h.stateMutex.Lock()
+	h.state = state
+	h.stateClient.Handler(state)
+	h.stateMutex.Unlock()
+	if state.Error != "" {
+		h.status.setError(state.Error)
+	}
+	h.pushStatus()
+}
+
+// keepalive 发送 keepalive@openssh.com, 服务端不认识该请求时也会回复, 只有连接断开或超时算失败
+func (h *SSH) keepalive() error {
+	h.connMutex.RLock()
+	conn := h.conn
+	h.connMutex.RUnlock()
+	if conn == nil {
+		return errors.New("not connected")
+	}
+	// 本机没有连接, 不会断开
+	if conn.sshClient == nil {
+		return nil
+	}
+	done := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		_, _, err := conn.sshClient.SendRequest("keepalive@openssh.com", true, nil)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			h.status.setRTT(time.Since(start))
+		}
+		return err
+	case <-time.After(keepaliveTimeout):
+		return errKeepaliveTimeout
+	}
+}
+
+// health 定时发送 keepalive, 连续超时或连接断开后重连, 所有监听者保持注册
+func (h *SSH) health() {
+	defer h.wg.Done()
+	ticker := time.NewTicker(keepaliveInterval)
+	defer ticker.Stop()
+	failures := 0
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+			err := h.keepalive()
+			if err == nil {
+				failures = 0
+				h.pushStatus()
+				continue
+			}
+			failures++
+			logger.L.Debugf("%s keepalive fail %d : %v", h.Key, failures, err)
+			// 超时可能只是网络抖动, 连接已断开时立即重连
+			if errors.Is(err, errKeepaliveTimeout) && failures < keepaliveMaxFailures {
+				continue
+			}
+			failures = 0
+			h.reconnect(err)
+		}
+	}
+}
+
+// reconnect 关闭失效的连接, 按指数退避重连直到成功或 SSH 被关闭
+func (h *SSH) reconnect(cause error) {
+	h.connMutex.Lock()
+	if h.conn != nil {
+		h.conn.close()
+		h.conn = nil
+	}
+	h.connMutex.Unlock()
+	h.setState(ConnectionStateMessage{State: StateDown, Error: cause.Error()})
+	logger.L.Infof("ssh client %s down : %v", h.Key, cause)
+
+	delay := reconnectMinDelay
+	for attempt := 1; ; attempt++ {
+		h.setState(ConnectionStateMessage{State: StateReconnecting, Attempt: attempt, Delay: delay.Seconds(), Error: cause.Error()})
+		select {
+		case <-h.stop:
+			return
+		case <-time.After(delay):
+		}
+		h.setState(ConnectionStateMessage{State: StateConnecting, Attempt: attempt})
+		conn, err := h.connect()
+		if err == nil {
+			h.connMutex.Lock()
+			h.conn = conn
+			h.connMutex.Unlock()
+			h.status.connected()
+			h.setState(ConnectionStateMessage{State: StateUp, Attempt: attempt})
+			logger.L.Infof("ssh client %s reconnected after %d attempts", h.Key, attempt)
+			return
+		}
+		cause = err
+		if delay *= 2; delay > reconnectMaxDelay {
+			delay = reconnectMaxDelay
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package ssh
+
+import (
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"strings"
+)
+
+// KnownHostsStore 保存用户信任的主机公钥, 公钥均为 authorized_keys 格式
+type KnownHostsStore interface {
+	// KnownHost 返回已信任的公钥, 没有记录时返回空串
+	KnownHost(host string, port int) (string, error)
+	// Trust 第一次连接时记录公钥
+	Trust(host string, port int, publicKey string, fingerprint string) error
+	// Reject 记录与已信任公钥不一致的新公钥, 等待用户确认
+	Reject(host string, port int, publicKey string, fingerprint string) error
+}
+
+// HostKeyError 主机公钥与已信任的不一致, 可能是中间人攻击或主机重装
+type HostKeyError struct {
+	Host             string
+	Port             int
+	Fingerprint      string
+	KnownFingerprint string
+}
+
+func (e *HostKeyError) Error() string {
+	return fmt.Sprintf("host key of %s:%d changed, got %s want %s", e.Host, e.Port, e.Fingerprint, e.KnownFingerprint)
+}
+
+func marshalPublicKey(key ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+// checkHostKey 实现 trust-on-first-use, 没有记录时信任并记录, 有记录时必须一致
+func checkHostKey(store KnownHostsStore, host string, port int, key ssh.PublicKey) error {
+	known, err := store.KnownHost(host, port)
+	if err != nil {
+		return fmt.Errorf("lookup known host %s:%d fail : %v", host, port, err)
+	}
+	publicKey := marshalPublicKey(key)
+	fingerprint := ssh.FingerprintSHA256(key)
+	if known == "" {
+		return store.Trust(host, port, publicKey, fingerprint)
+	}
+	if known == publicKey {
+		return nil
+	}
+	knownFingerprint := ""
+	if knownKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(known)); err == nil {
+		knownFingerprint = ssh.FingerprintSHA256(knownKey)
+	}
+	if err := store.Reject(host, port, publicKey, fingerprint); err != nil {
+		return fmt.Errorf("record rejected host key %s:%d fail : %v", host, port, err)
+	}
+	return &HostKeyError{
+		Host:             host,
+		Port:             port,
+		Fingerprint:      fingerprint,
+		KnownFingerprint: knownFingerprint,
+	}
+}
+
+// hostKeyAlgorithms 已有记录时只协商记录的公钥类型, 避免服务器换用另一种公钥被误判为变化
+func hostKeyAlgorithms(store KnownHostsStore, host string, port int) []string {
+	known, err := store.KnownHost(host, port)
+	if err != nil || known == "" {
+		return nil
+	}
+	knownKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(known))
+	if err != nil {
+		return nil
+	}
+	if knownKey.Type() == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+	return []string{knownKey.Type()}
+}
+
+// hostKeyCallback 记录校验过程中的错误, ssh.Dial 返回的握手错误会丢失错误类型
+func hostKeyCallback(store KnownHostsStore, port int, host string, hostKey *ssh.PublicKey, hostKeyErr *error) ssh.HostKeyCallback {
+	return func(_ string, _ net.Addr, key ssh.PublicKey) error {
+		*hostKey = key
+		if store == nil {
+			return nil
+		}
+		*hostKeyErr = checkHostKey(store, host, port, key)
+		return *hostKeyErr
+	}
+}
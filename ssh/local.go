@@ -0,0 +1,48 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+)
+
+// 本机伪主机, 直接读取后端所在主机的 /proc 和 /sys, 不需要 ssh 连接和凭据
+const (
+	LocalPort = 0
+	LocalHost = "localhost"
+	LocalUser = "local"
+)
+
+var LocalKey = generalKey(LocalPort, LocalHost, LocalUser)
+
+// local 在 conf.toml 的 [monitor.Local] 中配置, 默认关闭
+var local = struct {
+	enable bool
+	// root 后端运行在容器中时, 宿主机 / 挂载的位置, 例如 /host
+	root  string
+	users map[string]bool
+}{}
+
+func IsLocal(port int, host, user string) bool {
+	return port == LocalPort && host == LocalHost && user == LocalUser
+}
+
+// LocalAllowed 未开启本机监控时返回 false, monitor.Local.Users 为空时所有用户都可以监控本机
+func LocalAllowed(username string) bool {
+	if !local.enable {
+		return false
+	}
+	return len(local.users) == 0 || local.users[username]
+}
+
+// connectLocal 本机没有连接, 总是成功
+func connectLocal() (*connection, error) {
+	if !local.enable {
+		return nil, errors.New("local monitor is disabled")
+	}
+	return &connection{
+		source:  LocalSource{Root: local.root},
+		release: func() {},
+	}, nil
+}
+
+var errLocalTerminal = fmt.Errorf("%s has no terminal, use ssh to connect to the host", LocalKey)
@@ -1,5 +1,7 @@
 package ssh
 
+import "time"
+
 type Listener[M any] func(message M)
 
 type Message struct {
@@ -248,6 +250,9 @@ type DiskMessage struct {
 	WriteRateUnit string          `json:"writeRateUnit"`
 	ReadRate      float64         `json:"readRate"`
 	ReadRateUnit  string          `json:"readRateUnit"`
+	// 开机以来的读写字节数, 没有换算单位
+	WriteBytes int64 `json:"writeBytes"`
+	ReadBytes  int64 `json:"readBytes"`
 }
 
 type Disk struct {
@@ -272,6 +277,11 @@ type Disk struct {
 	ReadRateUnit  string  `json:"readRateUnit"`
 	WriteIOPS     int64   `json:"writeIOPS"`
 	ReadIOPS      int64   `json:"readIOPS"`
+	// 开机以来的读写字节数和次数, 没有换算单位
+	WriteBytes int64 `json:"writeBytes"`
+	ReadBytes  int64 `json:"readBytes"`
+	WriteIOs   int64 `json:"writeIOs"`
+	ReadIOs    int64 `json:"readIOs"`
 }
 
 type ProcessMessage struct {
@@ -290,8 +300,10 @@ func (s Processes) Less(i, j int) bool {
 		return true
 	} else if s[i].CPU < s[j].CPU {
 		return false
-	} else {
+	} else if s[i].MemRaw != s[j].MemRaw {
 		return s[i].MemRaw > s[j].MemRaw
+	} else {
+		return s[i].PID < s[j].PID
 	}
 }
 
@@ -355,3 +367,35 @@ type RoughDisk struct {
 	ReadRate      float64 `json:"readRate"`
 	ReadRateUnit  string  `json:"readRateUnit"`
 }
+
+const (
+	StateConnecting   = "connecting"
+	StateUp           = "up"
+	StateDown         = "down"
+	StateReconnecting = "reconnecting"
+)
+
+type ConnectionStateMessage struct {
+	Message
+	State string `json:"state"`
+	// Attempt 重连次数, Delay 为下一次重连前等待的秒数
+	Attempt int     `json:"attempt"`
+	Delay   float64 `json:"delay"`
+	Error   string  `json:"error"`
+}
+
+type MetricStatus struct {
+	LastSuccess         time.Time `json:"lastSuccess"`
+	ConsecutiveFailures int       `json:"consecutiveFailures"`
+	LastError           string    `json:"lastError"`
+}
+
+type StatusMessage struct {
+	Message
+	State       string    `json:"state"`
+	ConnectTime time.Time `json:"connectTime"`
+	// RTT keepalive 往返时间, 单位毫秒
+	RTT       float64                 `json:"rtt"`
+	LastError string                  `json:"lastError"`
+	Metrics   map[string]MetricStatus `json:"metrics"`
+}
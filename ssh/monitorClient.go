@@ -1,7 +1,6 @@
 package ssh
 
 import (
-	"github.com/pkg/sftp"
 	"logger"
 	"mutexMap"
 	"sync"
@@ -9,7 +8,7 @@ import (
 )
 
 type MonitorContext struct {
-	client  *sftp.Client
+	source  Source
 	port    int
 	host    string
 	user    string
@@ -18,42 +17,173 @@ type MonitorContext struct {
 	oldTime time.Time
 	newTime time.Time
 	where   string
+	// err 本次采集中的读取错误
+	err error
+}
+
+// demand 按需启动的采集循环, 有监听者或被其他采集依赖时运行
+type demand interface {
+	acquire()
+	release()
+	addDependent(d demand)
+	// period 运行中返回采集周期, 没有运行时返回 0
+	period() time.Duration
+}
+
+// subscriber interval 为 0 时每次采集都推送
+type subscriber[M any] struct {
+	listener Listener[M]
+	interval time.Duration
+	last     time.Time
 }
 
 type Client[M any] struct {
-	listener mutexMap.MutexMap[Listener[M]]
+	listener mutexMap.MutexMap[*subscriber[M]]
 	mutex    sync.Mutex
-	where    string
+	// name 为空时不记录采集状态
+	name  string
+	where string
+	// interval 默认采集间隔
+	interval time.Duration
+	// run 启动采集循环, 为空的 Client 只用于转发消息
+	run        func(quit chan struct{})
+	deps       []demand
+	dependents []demand
+	refs       int
+	quit       chan struct{}
 }
 
-func NewClient[M any](where string) Client[M] {
+func NewClient[M any](name string, where string) Client[M] {
 	return Client[M]{
-		listener: mutexMap.NewMutexMap[Listener[M]](0),
+		listener: mutexMap.NewMutexMap[*subscriber[M]](0),
+		name:     name,
 		where:    where,
 	}
 }
 
+// Handler 按每个监听者的间隔降采样, 允许一成采集周期的抖动
 func (c *Client[M]) Handler(m M) {
-	c.listener.Each(func(key string, val Listener[M]) {
-		val(m)
+	now := time.Now()
+	slack := c.period() / 10
+	c.listener.Each(func(key string, val *subscriber[M]) {
+		if val.interval > 0 {
+			if now.Sub(val.last) < val.interval-slack {
+				return
+			}
+			val.last = now
+		}
+		val.listener(m)
 	})
 }
 
-func (c *Client[M]) RegisterHandler(key string, listener Listener[M]) {
-	c.listener.Set(key, listener)
+// setup 设置采集循环, deps 为解析时需要其 Parser 状态的采集, 依赖的采集至少和自己一样快
+func (c *Client[M]) setup(h *SSH, f func(context *MonitorContext) *M, interval time.Duration, deps ...demand) {
+	c.interval = interval
+	c.run = func(quit chan struct{}) {
+		h.wg.Add(1)
+		go c.monitor(h, f, quit)
+	}
+	c.deps = deps
+	for _, dep := range deps {
+		dep.addDependent(c)
+	}
+}
+
+func (c *Client[M]) addDependent(d demand) {
+	c.dependents = append(c.dependents, d)
+}
+
+// period 取监听者和运行中的依赖方要求的最快间隔
+func (c *Client[M]) period() time.Duration {
+	c.mutex.Lock()
+	running := c.refs > 0
+	c.mutex.Unlock()
+	if !running {
+		return 0
+	}
+	p := c.interval
+	c.listener.Each(func(_ string, val *subscriber[M]) {
+		if val.interval > 0 && val.interval < p {
+			p = val.interval
+		}
+	})
+	for _, d := range c.dependents {
+		if dp := d.period(); dp > 0 && dp < p {
+			p = dp
+		}
+	}
+	return p
 }
 
+func (c *Client[M]) acquire() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.run == nil {
+		return
+	}
+	c.refs++
+	if c.refs > 1 {
+		return
+	}
+	for _, dep := range c.deps {
+		dep.acquire()
+	}
+	c.quit = make(chan struct{})
+	c.run(c.quit)
+	logger.L.Debugf("start monitor %s %s", c.name, c.where)
+}
+
+func (c *Client[M]) release() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.run == nil || c.refs == 0 {
+		return
+	}
+	c.refs--
+	if c.refs > 0 {
+		return
+	}
+	close(c.quit)
+	for _, dep := range c.deps {
+		dep.release()
+	}
+	logger.L.Debugf("stop monitor %s %s", c.name, c.where)
+}
+
+// RegisterHandler 第一个监听者注册时启动采集, interval 为 0 时使用默认间隔
+func (c *Client[M]) RegisterHandler(key string, listener Listener[M], interval time.Duration) {
+	if interval <= 0 {
+		interval = c.interval
+	}
+	s := &subscriber[M]{
+		listener: listener,
+		interval: interval,
+	}
+	if c.listener.Has(key) {
+		c.listener.Set(key, s)
+		return
+	}
+	c.listener.Set(key, s)
+	c.acquire()
+}
+
+// RemoveHandler 最后一个监听者离开时停止采集
 func (c *Client[M]) RemoveHandler(key string) {
+	if !c.listener.Has(key) {
+		return
+	}
 	c.listener.Remove(key)
+	c.release()
 }
 
 func (c *Client[M]) hasHandler(key string) bool {
 	return c.listener.Has(key)
 }
 
-func (c *Client[M]) monitor(h *SSH, f func(context *MonitorContext) *M, second int) {
+func (c *Client[M]) monitor(h *SSH, f func(context *MonitorContext) *M, quit chan struct{}) {
+	defer h.wg.Done()
 	context := &MonitorContext{
-		client:  h.sftpClient,
+		source:  nil,
 		port:    h.Port,
 		host:    h.Host,
 		user:    h.User,
@@ -63,17 +193,31 @@ func (c *Client[M]) monitor(h *SSH, f func(context *MonitorContext) *M, second i
 		newTime: time.Now(),
 		where:   c.where,
 	}
-	for ; ; time.Sleep(time.Duration(second) * time.Second) {
+	// 每轮重新计算周期, 订阅变化后立即生效, 对齐到周期的整数倍让同一轮的采集合并读取
+	for ; ; time.Sleep(untilNextTick(c.period())) {
 		select {
 		case s, ok := <-h.stop:
 			if !ok {
-				h.wg.Done()
 				return
 			} else {
 				logger.L.Debugf("Unexpect recv %d", s)
 			}
+		case <-quit:
+			return
 		default:
+			// 每次读取前取当前连接, 重连后使用新的连接, 断线期间跳过
+			conn := h.connection()
+			if conn == nil {
+				continue
+			}
+			context.source = conn.source
+			context.err = nil
 			m := f(context)
+			if c.name != "" && context.err != nil {
+				h.status.fail(c.name, context.err)
+			} else if c.name != "" && m != nil {
+				h.status.success(c.name)
+			}
 			if m != nil {
 				c.Handler(*m)
 			}
@@ -81,6 +225,14 @@ func (c *Client[M]) monitor(h *SSH, f func(context *MonitorContext) *M, second i
 	}
 }
 
+func untilNextTick(period time.Duration) time.Duration {
+	if period <= 0 {
+		return 0
+	}
+	now := time.Now()
+	return now.Truncate(period).Add(period).Sub(now)
+}
+
 func (c *Client[M]) LenListener() int {
 	return c.listener.Len()
 }
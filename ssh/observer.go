@@ -0,0 +1,51 @@
+package ssh
+
+import (
+	"sync"
+)
+
+// Observer 为每个建立的 ssh 生成监听者, 例如记录历史数据, 观察者不会让没有其他监听者的 ssh 保持连接
+type Observer func(port int, host, user string) AllListener
+
+// AddObserver 对已经建立和之后建立的 ssh 都注册 observer 生成的监听者
+func (m *Manager) AddObserver(key string, observer Observer) {
+	m.observers.Set(key, observer)
+	m.clients.Each(func(_ string, v *SSH) {
+		mutex := m.mutexes.GetNilThenSet(v.Key, &sync.Mutex{})
+		mutex.Lock()
+		defer mutex.Unlock()
+		v.observe(key, observer)
+	})
+}
+
+func (h *SSH) observe(key string, observer Observer) {
+	h.observers.Set(key, true)
+	h.RegisterSSHListener(key, observer(h.Port, h.Host, h.User))
+}
+
+// Pin 保持到 ssh 的连接, 没有监听者时也不断开, 直到 Unpin
+func (m *Manager) Pin(port int, host, user string, auth Auth, key string) error {
+	mutex := m.mutexes.GetNilThenSet(generalKey(port, host, user), &sync.Mutex{})
+	mutex.Lock()
+	defer mutex.Unlock()
+	s, err := m.getSSH(port, host, user, auth)
+	if err != nil {
+		return err
+	}
+	s.pins.Set(key, true)
+	return nil
+}
+
+func (m *Manager) Unpin(port int, host, user string, key string) {
+	mutex := m.mutexes.GetNilThenSet(generalKey(port, host, user), &sync.Mutex{})
+	mutex.Lock()
+	defer mutex.Unlock()
+	v, ok := m.clients.Get(generalKey(port, host, user))
+	if !ok {
+		return
+	}
+	v.pins.Remove(key)
+	if v.Empty() {
+		m.delayDeleteSSH(v.Key, v)
+	}
+}
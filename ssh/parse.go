@@ -2,13 +2,11 @@ package ssh
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	mapSet "github.com/deckarep/golang-set/v2"
-	"github.com/pkg/sftp"
-	"io/ioutil"
 	"logger"
 	"math"
-	"os"
 	"regexp"
 	"sort"
 	"strconv"
@@ -104,6 +102,9 @@ func (p *Parser) parseRoughMessage(context *MonitorContext) *RoughMessage {
 	return m
 }
 
+// now 采样时间, 测试中替换为固定的时钟
+var now = time.Now
+
 func newToOld(c *MonitorContext) {
 	c.oldTime = c.newTime
 	c.oldS = c.newS
@@ -114,12 +115,12 @@ func getNew(c *MonitorContext) bool {
 	if c.where == "" {
 		return false
 	}
-	newS, ok := readFile(c.where, c.client, true)
+	newS, ok := c.readFile(c.where)
 	if !ok {
 		return false
 	}
 	c.newS = newS
-	c.newTime = time.Now()
+	c.newTime = now()
 	return true
 }
 
@@ -135,26 +136,33 @@ func (p *Parser) parseCPUInfoMessage(c *MonitorContext) *CPUInfoMessage {
 		},
 		CPUInfoMap: make(map[int64]CPUInfo),
 	}
+	processorNum := int64(0)
 	cpus := strings.Split(c.newS, "\n\n")
 	for _, cpu := range cpus {
 		cpu = strings.TrimSpace(cpu)
 		if len(cpu) == 0 {
 			continue
 		}
-		// 正则匹配
-		physicalIdReg := regexp.MustCompile(`physical id\t: (\d+)\n`)
-		if physicalIdReg == nil {
-			logger.L.Fatalf("regexp parse fail : physical id")
-		}
-		physicalIdRegResults := physicalIdReg.FindAllStringSubmatch(cpu, -1)
-		if physicalIdRegResults == nil {
-			logger.L.Debugf("parse physical id fail")
+		fields := cpuInfoFields(cpu)
+		processorId, ok := parseInt64(fields["processor"])
+		if !ok {
+			// ARM 的 cpuinfo 末尾有 Hardware, Serial 等不属于处理器的段
+			logger.L.Debugf("parse processor id fail")
 			continue
 		}
-		physicalId, err := strconv.ParseInt(physicalIdRegResults[0][1], 10, 64)
-		if err != nil {
-			logger.L.Debugf("parse int fail : %v", err)
-			continue
+		processorNum++
+		// ARM 没有 physical id 和 core id, 视为一个 CPU, 每个逻辑处理器独占一个核心
+		physicalId := int64(0)
+		if s, ok := fields["physical id"]; ok {
+			if physicalId, ok = parseInt64(s); !ok {
+				continue
+			}
+		}
+		coreId := processorId
+		if s, ok := fields["core id"]; ok {
+			if coreId, ok = parseInt64(s); !ok {
+				continue
+			}
 		}
 		cpuInfo, ok := m.CPUInfoMap[physicalId]
 		if !ok {
@@ -162,86 +170,50 @@ func (p *Parser) parseCPUInfoMessage(c *MonitorContext) *CPUInfoMessage {
 				CPUCoreInfoMap: make(map[int64]CPUCoreInfo),
 				PhysicalId:     physicalId,
 			}
-			lines := strings.Split(cpu, "\n")
-			for _, line := range lines {
-				line = strings.TrimSpace(line)
-				if strings.HasPrefix(line, "vendor_id") {
-					cpuInfo.VendorId = strings.TrimSpace(strings.Split(line, ":")[1])
-				} else if strings.HasPrefix(line, "cpu family") {
-					cpuInfo.CPUFamily = strings.TrimSpace(strings.Split(line, ":")[1])
-				} else if strings.HasPrefix(line, "model name") {
-					cpuInfo.ModelName = strings.TrimSpace(strings.Split(line, ":")[1])
-				} else if strings.HasPrefix(line, "model") {
-					cpuInfo.Model = strings.TrimSpace(strings.Split(line, ":")[1])
-				} else if strings.HasPrefix(line, "stepping") {
-					cpuInfo.Stepping = strings.TrimSpace(strings.Split(line, ":")[1])
-				} else if strings.HasPrefix(line, "cache size") {
-					cpuInfo.CacheSize = strings.TrimSpace(strings.Split(line, ":")[1])
-				} else if strings.HasPrefix(line, "siblings") {
-					temp := strings.TrimSpace(strings.Split(line, ":")[1])
-					parseInt, err := strconv.ParseInt(temp, 10, 64)
-					if err != nil {
-						logger.L.Debugf("parse int fail : %v", err)
-						continue
+			for key, value := range fields {
+				switch key {
+				case "vendor_id":
+					cpuInfo.VendorId = value
+				case "cpu family":
+					cpuInfo.CPUFamily = value
+				case "model name":
+					cpuInfo.ModelName = value
+				case "model":
+					cpuInfo.Model = value
+				case "stepping":
+					cpuInfo.Stepping = value
+				case "cache size":
+					cpuInfo.CacheSize = value
+				case "siblings":
+					if parseInt, ok := parseInt64(value); ok {
+						cpuInfo.Siblings = parseInt
 					}
-					cpuInfo.Siblings = parseInt
-					p.CPU.CPUProcessorNum = parseInt
-				} else if strings.HasPrefix(line, "cpu cores") {
-					temp := strings.TrimSpace(strings.Split(line, ":")[1])
-					parseInt, err := strconv.ParseInt(temp, 10, 64)
-					if err != nil {
-						logger.L.Debugf("parse int fail : %v", err)
-						continue
+				case "cpu cores":
+					if parseInt, ok := parseInt64(value); ok {
+						cpuInfo.CPUCores = parseInt
 					}
-					cpuInfo.CPUCores = parseInt
-				} else if strings.HasPrefix(line, "fpu_exception") {
-					cpuInfo.FPUException = strings.TrimSpace(strings.Split(line, ":")[1]) == "yes"
-				} else if strings.HasPrefix(line, "fpu") {
-					cpuInfo.FPU = strings.TrimSpace(strings.Split(line, ":")[1]) == "yes"
-				} else if strings.HasPrefix(line, "bogomips") {
-					temp := strings.TrimSpace(strings.Split(line, ":")[1])
-					parseFloat, err := strconv.ParseFloat(temp, 64)
-					if err != nil {
-						logger.L.Debugf("parse float fail : %v", err)
-						continue
+				case "fpu_exception":
+					cpuInfo.FPUException = value == "yes"
+				case "fpu":
+					cpuInfo.FPU = value == "yes"
+				case "bogomips":
+					if parseFloat, ok := parseFloat64(value); ok {
+						cpuInfo.Bogomips = parseFloat
 					}
-					cpuInfo.Bogomips = parseFloat
-				} else if strings.HasPrefix(line, "clflush size") {
-					temp := strings.TrimSpace(strings.Split(line, ":")[1])
-					parseInt, err := strconv.ParseInt(temp, 10, 64)
-					if err != nil {
-						logger.L.Debugf("parse int fail : %v", err)
-						continue
+				case "clflush size":
+					if parseInt, ok := parseInt64(value); ok {
+						cpuInfo.ClFlushSize = parseInt
 					}
-					cpuInfo.ClFlushSize = parseInt
-				} else if strings.HasPrefix(line, "cache_alignment") {
-					temp := strings.TrimSpace(strings.Split(line, ":")[1])
-					parseInt, err := strconv.ParseInt(temp, 10, 64)
-					if err != nil {
-						logger.L.Debugf("parse int fail : %v", err)
-						continue
+				case "cache_alignment":
+					if parseInt, ok := parseInt64(value); ok {
+						cpuInfo.CacheAlignment = parseInt
 					}
-					cpuInfo.CacheAlignment = parseInt
-				} else if strings.HasPrefix(line, "address sizes") {
-					cpuInfo.AddressSizes = strings.TrimSpace(strings.Split(line, ":")[1])
+				case "address sizes":
+					cpuInfo.AddressSizes = value
 				}
 			}
 			m.CPUInfoMap[physicalId] = cpuInfo
 		}
-		coreIdReg := regexp.MustCompile(`core id\t\t: (\d+)\n`)
-		if coreIdReg == nil {
-			logger.L.Fatalf("regexp parse fail : core id")
-		}
-		coreIdRegResults := coreIdReg.FindAllStringSubmatch(cpu, -1)
-		if coreIdRegResults == nil {
-			logger.L.Debugf("parse core id fail")
-			continue
-		}
-		coreId, err := strconv.ParseInt(coreIdRegResults[0][1], 10, 64)
-		if err != nil {
-			logger.L.Debugf("parse int fail : %v", err)
-			continue
-		}
 		cpuCoreInfo, ok := cpuInfo.CPUCoreInfoMap[coreId]
 		if !ok {
 			cpuCoreInfo = CPUCoreInfo{
@@ -250,52 +222,42 @@ func (p *Parser) parseCPUInfoMessage(c *MonitorContext) *CPUInfoMessage {
 			}
 			cpuInfo.CPUCoreInfoMap[coreId] = cpuCoreInfo
 		}
-		processorIdReg := regexp.MustCompile(`processor\t: (\d+)\n`)
-		if processorIdReg == nil {
-			logger.L.Fatalf("regexp parse fail : processor id")
-		}
-		processorIdRegResults := processorIdReg.FindAllStringSubmatch(cpu, -1)
-		if processorIdRegResults == nil {
-			logger.L.Debugf("parse processor id fail")
-			continue
-		}
-		processorId, err := strconv.ParseInt(processorIdRegResults[0][1], 10, 64)
-		if err != nil {
-			logger.L.Debugf("parse int fail : %v", err)
-			continue
-		}
 		cpuProcessorInfo, ok := cpuCoreInfo.CPUProcessorInfoMap[processorId]
 		if !ok {
 			cpuProcessorInfo = CPUProcessorInfo{
 				Processor: processorId,
 			}
-			lines := strings.Split(cpu, "\n")
-			for _, line := range lines {
-				line = strings.TrimSpace(line)
-				if strings.HasPrefix(line, "cpu MHz") {
-					temp := strings.TrimSpace(strings.Split(line, ":")[1])
-					parseFloat, err := strconv.ParseFloat(temp, 64)
-					if err != nil {
-						logger.L.Debugf("parse float fail : %v", err)
-						continue
-					}
+			if s, ok := fields["cpu mhz"]; ok {
+				if parseFloat, ok := parseFloat64(s); ok {
 					cpuProcessorInfo.CPUMHz = parseFloat
-				} else if strings.HasPrefix(line, "apicid") {
-					temp := strings.TrimSpace(strings.Split(line, ":")[1])
-					parseInt, err := strconv.ParseInt(temp, 10, 64)
-					if err != nil {
-						logger.L.Debugf("parse int fail : %v", err)
-						continue
-					}
+				}
+			}
+			if s, ok := fields["apicid"]; ok {
+				if parseInt, ok := parseInt64(s); ok {
 					cpuProcessorInfo.Apicid = parseInt
 				}
 			}
 			cpuCoreInfo.CPUProcessorInfoMap[processorId] = cpuProcessorInfo
 		}
 	}
+	// 多路 CPU 时 siblings 只是单个 CPU 的逻辑核心数, 按处理器段计数
+	p.CPU.CPUProcessorNum = processorNum
 	return m
 }
 
+// cpuInfoFields 解析 cpuinfo 中一个处理器段的 "key : value" 行, key 转为小写
+func cpuInfoFields(cpu string) map[string]string {
+	fields := make(map[string]string)
+	for _, line := range strings.Split(cpu, "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		fields[strings.ToLower(strings.TrimSpace(key))] = strings.TrimSpace(value)
+	}
+	return fields
+}
+
 func (p *Parser) parseCPUPerformanceMessage(c *MonitorContext) *CPUPerformanceMessage {
 	if !getNew(c) {
 		return nil
@@ -417,18 +379,27 @@ func (p *Parser) parseCPUPerformanceMessage(c *MonitorContext) *CPUPerformanceMe
 
 	p.CPU.Utilization = m.Total.Utilization
 
-	for i := 1; i < len(oldResult); i++ {
+	// CPU 热插拔时两次采样的处理器不同, 按名字对应
+	oldMap := make(map[string][]string, 0)
+	for _, ss := range oldResult[1:] {
+		oldMap[ss[1]] = ss
+	}
+	for _, newSS := range newResult[1:] {
+		oldSS, ok := oldMap[newSS[1]]
+		if !ok {
+			continue
+		}
 		pOldTotalCPUTime := int64(0)
-		for j := 2; j < len(oldResult[i]); j++ {
-			if x, ok := parseInt64(oldResult[i][j]); ok {
+		for j := 2; j < len(oldSS); j++ {
+			if x, ok := parseInt64(oldSS[j]); ok {
 				pOldTotalCPUTime += x
 			} else {
 				return nil
 			}
 		}
 		pNewTotalCPUTime := int64(0)
-		for j := 2; j < len(newResult[i]); j++ {
-			if x, ok := parseInt64(newResult[i][j]); ok {
+		for j := 2; j < len(newSS); j++ {
+			if x, ok := parseInt64(newSS[j]); ok {
 				pNewTotalCPUTime += x
 			} else {
 				return nil
@@ -438,48 +409,48 @@ func (p *Parser) parseCPUPerformanceMessage(c *MonitorContext) *CPUPerformanceMe
 		if pDiff == 0 {
 			pDiff++
 		}
-		newPUtilization, ok := parseInt64(newResult[i][5])
+		newPUtilization, ok := parseInt64(newSS[5])
 		if !ok {
 			return nil
 		}
-		newPSystem, ok := parseInt64(newResult[i][4])
+		newPSystem, ok := parseInt64(newSS[4])
 		if !ok {
 			return nil
 		}
-		newPUser, ok := parseInt64(newResult[i][2])
+		newPUser, ok := parseInt64(newSS[2])
 		if !ok {
 			return nil
 		}
-		newPIO, ok := parseInt64(newResult[i][6])
+		newPIO, ok := parseInt64(newSS[6])
 		if !ok {
 			return nil
 		}
-		newPSteal, ok := parseInt64(newResult[i][9])
+		newPSteal, ok := parseInt64(newSS[9])
 		if !ok {
 			return nil
 		}
-		oldPUtilization, ok := parseInt64(oldResult[i][5])
+		oldPUtilization, ok := parseInt64(oldSS[5])
 		if !ok {
 			return nil
 		}
-		oldPSystem, ok := parseInt64(oldResult[i][4])
+		oldPSystem, ok := parseInt64(oldSS[4])
 		if !ok {
 			return nil
 		}
-		oldPUser, ok := parseInt64(oldResult[i][2])
+		oldPUser, ok := parseInt64(oldSS[2])
 		if !ok {
 			return nil
 		}
-		oldPIO, ok := parseInt64(oldResult[i][6])
+		oldPIO, ok := parseInt64(oldSS[6])
 		if !ok {
 			return nil
 		}
-		oldPSteal, ok := parseInt64(oldResult[i][9])
+		oldPSteal, ok := parseInt64(oldSS[9])
 		if !ok {
 			return nil
 		}
 
-		processor, ok := parseInt64(oldResult[i][1])
+		processor, ok := parseInt64(oldSS[1])
 		if !ok {
 			return nil
 		}
@@ -718,11 +689,11 @@ func (p *Parser) parseNetDevMessage(c *MonitorContext) *NetDevMessage {
 		oldMap[strings.TrimSpace(ss[1])] = ss
 	}
 	// route info
-	route, ok := readFile("/proc/net/route", c.client, true)
+	route, ok := c.readFile("/proc/net/route")
 	if !ok {
 		return nil
 	}
-	fib, ok := readFile("/proc/net/fib_trie", c.client, true)
+	fib, ok := c.readFile("/proc/net/fib_trie")
 	if !ok {
 		return nil
 	}
@@ -792,6 +763,14 @@ func (p *Parser) parseNetDevMessage(c *MonitorContext) *NetDevMessage {
 		}
 	}
 
+	// 虚拟网卡在 /sys/devices/virtual/net 下
+	virtualSet := mapSet.NewSet[string]()
+	if entries, err := c.source.ReadDir("/sys/devices/virtual/net"); err == nil {
+		for _, e := range entries {
+			virtualSet.Add(e.Name)
+		}
+	}
+
 	oldTotalUpBytes := int64(0)
 	oldTotalDownBytes := int64(0)
 	difTime := c.newTime.Sub(c.oldTime).Milliseconds()
@@ -814,13 +793,10 @@ func (p *Parser) parseNetDevMessage(c *MonitorContext) *NetDevMessage {
 			for s := range it.C {
 				n.IP = append(n.IP, s)
 			}
+			sort.Strings(n.IP)
 		}
 		// 判断虚拟化
-		n.Virtual = true
-		_, err := c.client.Stat("/sys/devices/virtual/net/" + name)
-		if err != nil {
-			n.Virtual = false
-		}
+		n.Virtual = virtualSet.Contains(name)
 		if n.DownBytes, ok = parseInt64(ss[2]); !ok {
 			continue
 		}
@@ -881,66 +857,79 @@ func (p *Parser) parseNetStatMessage(c *MonitorContext) *NetStatMessage {
 		NetUDP{},
 	}
 
-	TCPReg := regexp.MustCompile(`Tcp:\s+(\d+)\s+(\d+)\s+(\d+)\s+([\d-]+)\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+)\n`)
-	if TCPReg == nil {
-		logger.L.Fatalf("regexp parse fail : net stat tcp")
-	}
-	TCPRegResults := TCPReg.FindAllStringSubmatch(c.newS, -1)
-	if TCPRegResults == nil {
+	// 不同内核版本 Tcp, Udp 的列数不同, 按表头取值
+	tcp := snmpFields(c.newS, "Tcp")
+	if tcp == nil {
 		logger.L.Debugf("parse net stat tcp fail")
 		return nil
 	}
-
-	UDPReg := regexp.MustCompile(`Udp:\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+)[^\n]+\n`)
-	if UDPReg == nil {
-		logger.L.Fatalf("regexp parse fail : net stat udp")
-	}
-	UDPRegResults := UDPReg.FindAllStringSubmatch(c.newS, -1)
-	if UDPRegResults == nil {
+	udp := snmpFields(c.newS, "Udp")
+	if udp == nil {
 		logger.L.Debugf("parse net stat udp fail")
 		return nil
 	}
 	ok := true
-	if m.NetTCP.ActiveOpens, ok = parseInt64(TCPRegResults[0][5]); !ok {
+	if m.NetTCP.ActiveOpens, ok = parseInt64(tcp["ActiveOpens"]); !ok {
 		return nil
 	}
-	if m.NetTCP.PassiveOpens, ok = parseInt64(TCPRegResults[0][6]); !ok {
+	if m.NetTCP.PassiveOpens, ok = parseInt64(tcp["PassiveOpens"]); !ok {
 		return nil
 	}
-	if m.NetTCP.FailOpens, ok = parseInt64(TCPRegResults[0][7]); !ok {
+	if m.NetTCP.FailOpens, ok = parseInt64(tcp["AttemptFails"]); !ok {
 		return nil
 	}
-	if m.NetTCP.CurrConn, ok = parseInt64(TCPRegResults[0][9]); !ok {
+	if m.NetTCP.CurrConn, ok = parseInt64(tcp["CurrEstab"]); !ok {
 		return nil
 	}
-	if m.NetTCP.InSegments, ok = parseInt64(TCPRegResults[0][10]); !ok {
+	if m.NetTCP.InSegments, ok = parseInt64(tcp["InSegs"]); !ok {
 		return nil
 	}
-	if m.NetTCP.OutSegments, ok = parseInt64(TCPRegResults[0][11]); !ok {
+	if m.NetTCP.OutSegments, ok = parseInt64(tcp["OutSegs"]); !ok {
 		return nil
 	}
-	if m.NetTCP.ReTransSegments, ok = parseInt64(TCPRegResults[0][12]); !ok {
+	if m.NetTCP.ReTransSegments, ok = parseInt64(tcp["RetransSegs"]); !ok {
 		return nil
 	}
 	if m.NetTCP.OutSegments != 0 {
 		m.NetTCP.ReTransRate = roundFloat(100*float64(m.NetTCP.ReTransSegments)/float64(m.NetTCP.OutSegments), 2)
 	}
-	if m.NetUDP.InDatagrams, ok = parseInt64(UDPRegResults[0][1]); !ok {
+	if m.NetUDP.InDatagrams, ok = parseInt64(udp["InDatagrams"]); !ok {
 		return nil
 	}
-	if m.NetUDP.OutDatagrams, ok = parseInt64(UDPRegResults[0][4]); !ok {
+	if m.NetUDP.OutDatagrams, ok = parseInt64(udp["OutDatagrams"]); !ok {
 		return nil
 	}
-	if m.NetUDP.ReceiveBufErrors, ok = parseInt64(UDPRegResults[0][5]); !ok {
+	if m.NetUDP.ReceiveBufErrors, ok = parseInt64(udp["RcvbufErrors"]); !ok {
 		return nil
 	}
-	if m.NetUDP.SendBufErrors, ok = parseInt64(UDPRegResults[0][6]); !ok {
+	if m.NetUDP.SendBufErrors, ok = parseInt64(udp["SndbufErrors"]); !ok {
 		return nil
 	}
 
 	return m
 }
 
+// snmpFields 解析 /proc/net/snmp 中 prefix 的表头行和数值行
+func snmpFields(s string, prefix string) map[string]string {
+	var header []string
+	for _, line := range strings.Split(s, "\n") {
+		if !strings.HasPrefix(line, prefix+":") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, prefix+":"))
+		if header == nil {
+			header = fields
+			continue
+		}
+		m := make(map[string]string, len(header))
+		for i := 0; i < len(header) && i < len(fields); i++ {
+			m[header[i]] = fields[i]
+		}
+		return m
+	}
+	return nil
+}
+
 func (p *Parser) parseTempMessage(c *MonitorContext) *TempMessage {
 	if !getNew(c) {
 		return nil
@@ -961,8 +950,8 @@ func (p *Parser) parseTempMessage(c *MonitorContext) *TempMessage {
 	for i := 1; i < 10; i++ {
 		file := fmt.Sprintf("/sys/class/thermal/thermal_zone%d/temp", i)
 		zone := fmt.Sprintf("zone%d", i)
-		temp, ok := readFile(file, c.client, false)
-		if !ok {
+		temp, err := c.source.ReadFile(file)
+		if err != nil {
 			break
 		}
 		if m.TempMap[zone], ok = parseInt64(strings.TrimSpace(temp)); ok {
@@ -995,7 +984,7 @@ func (p *Parser) parseDiskMessage(c *MonitorContext) *DiskMessage {
 		},
 		DiskMap: make(map[string]Disk, 0),
 	}
-	mounts, ok := readFile("/proc/mounts", c.client, true)
+	mounts, ok := c.readFile("/proc/mounts")
 	if !ok {
 		return nil
 	}
@@ -1011,40 +1000,24 @@ func (p *Parser) parseDiskMessage(c *MonitorContext) *DiskMessage {
 	mountSet := mapSet.NewSet[string]()
 	mountMap := make(map[string][]string, 0)
 	for _, ss := range MountStatsRegResults {
-		if ss[3] == "ext4" || ss[3] == "vfat" {
+		switch ss[3] {
+		case "ext4", "ext3", "xfs", "btrfs", "vfat":
 			mountMap[ss[1]] = ss
 			mountSet.Add(ss[1])
 		}
 	}
 
-	DiskReg := regexp.MustCompile(`(\d+)\s+(\d+)\s+(\S+)\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+)[^\n]+\n`)
-	if DiskReg == nil {
-		logger.L.Fatalf("regexp parse fail : disk")
-	}
-	oldDiskRegResults := DiskReg.FindAllStringSubmatch(c.oldS, -1)
-	newDiskRegResults := DiskReg.FindAllStringSubmatch(c.newS, -1)
+	oldDiskMap := diskStats(c.oldS)
+	newDiskMap := diskStats(c.newS)
+	mapperNames(c, oldDiskMap, newDiskMap)
 	diff := c.newTime.Sub(c.oldTime).Milliseconds()
 	if diff == 0 {
 		diff++
 	}
-	if oldDiskRegResults == nil || newDiskRegResults == nil {
+	if len(oldDiskMap) == 0 || len(newDiskMap) == 0 {
 		logger.L.Debugf("parse disk fail")
 		return nil
 	}
-	oldDiskMap := make(map[string][]string, 0)
-	newDiskMap := make(map[string][]string, 0)
-	for _, ss := range oldDiskRegResults {
-		devName := fmt.Sprintf("/dev/%s", ss[3])
-		if mountSet.Contains(devName) {
-			oldDiskMap[devName] = ss
-		}
-	}
-	for _, ss := range newDiskRegResults {
-		devName := fmt.Sprintf("/dev/%s", ss[3])
-		if mountSet.Contains(devName) {
-			newDiskMap[devName] = ss
-		}
-	}
 
 	OldTotalWrite := int64(0)
 	OldTotalRead := int64(0)
@@ -1071,7 +1044,7 @@ func (p *Parser) parseDiskMessage(c *MonitorContext) *DiskMessage {
 
 		d.Mount = mountSS[2]
 		d.FileSystem = mountSS[3]
-		stat, err := c.client.StatVFS(d.Mount)
+		stat, err := c.source.StatFS(d.Mount)
 		if err != nil {
 			continue
 		}
@@ -1087,28 +1060,30 @@ func (p *Parser) parseDiskMessage(c *MonitorContext) *DiskMessage {
 			d.UsedRate = roundFloat(float64(used)/float64(total), 2)
 		}
 
-		oldWriteSector, ok := parseInt64(oldSS[10])
+		oldWriteSector, ok := parseInt64(oldSS[9])
 		if !ok {
 			continue
 		}
 		oldWrite := SectorSize * oldWriteSector
-		newWriteSector, ok := parseInt64(newSS[10])
+		newWriteSector, ok := parseInt64(newSS[9])
 		if !ok {
 			continue
 		}
 		newWrite := SectorSize * newWriteSector
+		d.WriteBytes = newWrite
 		d.Write, d.WriteUnit = roundMem(newWrite)
 		d.WriteRate, d.WriteRateUnit = roundMem((newWrite - oldWrite) * 1000 / diff)
-		oldReadSector, ok := parseInt64(oldSS[6])
+		oldReadSector, ok := parseInt64(oldSS[5])
 		if !ok {
 			continue
 		}
 		oldRead := SectorSize * oldReadSector
-		newReadSector, ok := parseInt64(newSS[6])
+		newReadSector, ok := parseInt64(newSS[5])
 		if !ok {
 			continue
 		}
 		newRead := SectorSize * newReadSector
+		d.ReadBytes = newRead
 		d.Read, d.ReadUnit = roundMem(newRead)
 		d.ReadRate, d.ReadRateUnit = roundMem((newRead - oldRead) * 1000 / diff)
 
@@ -1117,27 +1092,30 @@ func (p *Parser) parseDiskMessage(c *MonitorContext) *DiskMessage {
 		NewTotalWrite += newWrite
 		NewTotalRead += newRead
 
-		oldWriteIO, ok := parseInt64(oldSS[8])
+		oldWriteIO, ok := parseInt64(oldSS[7])
 		if !ok {
 			continue
 		}
-		newWriteIO, ok := parseInt64(newSS[8])
+		newWriteIO, ok := parseInt64(newSS[7])
 		if !ok {
 			continue
 		}
+		d.WriteIOs = newWriteIO
 		d.WriteIOPS = (newWriteIO - oldWriteIO) * 1000 / diff
-		oldReadIO, ok := parseInt64(oldSS[4])
+		oldReadIO, ok := parseInt64(oldSS[3])
 		if !ok {
 			continue
 		}
-		newReadIO, ok := parseInt64(newSS[4])
+		newReadIO, ok := parseInt64(newSS[3])
 		if !ok {
 			continue
 		}
+		d.ReadIOs = newReadIO
 		d.ReadIOPS = (newReadIO - oldReadIO) * 1000 / diff
 
 		m.DiskMap[devName] = d
 	}
+	m.WriteBytes, m.ReadBytes = NewTotalWrite, NewTotalRead
 	m.Write, m.WriteUnit = roundMem(NewTotalWrite)
 	m.Read, m.ReadUnit = roundMem(NewTotalRead)
 	m.WriteRate, m.WriteRateUnit = roundMem((NewTotalWrite - OldTotalWrite) * 1000 / diff)
@@ -1149,23 +1127,77 @@ func (p *Parser) parseDiskMessage(c *MonitorContext) *DiskMessage {
 	return m
 }
 
+// diskStats 按设备名拆分 /proc/diskstats, 列数随内核版本变化:
+// 4.18 之前 14 列, 4.18 起增加 discard 共 18 列, 5.5 起增加 flush 共 20 列, 这里只用前 14 列
+func diskStats(s string) map[string][]string {
+	m := make(map[string][]string, 0)
+	for _, line := range strings.Split(s, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 14 {
+			continue
+		}
+		m[fmt.Sprintf("/dev/%s", fields[2])] = fields
+	}
+	return m
+}
+
+// mapperNames /proc/mounts 中 LVM 等设备写作 /dev/mapper/<name>, diskstats 中是 dm-N, 按 /sys/block/dm-N/dm/name 补上对应关系
+func mapperNames(c *MonitorContext, diskMaps ...map[string][]string) {
+	if len(diskMaps) == 0 {
+		return
+	}
+	for devName := range diskMaps[0] {
+		if !strings.HasPrefix(devName, "/dev/dm-") {
+			continue
+		}
+		// 读不到时只是缺少这块盘, 不影响本次采样
+		name, err := c.source.ReadFile(fmt.Sprintf("/sys/block/%s/dm/name", strings.TrimPrefix(devName, "/dev/")))
+		if err != nil {
+			logger.L.Debugf("Read %s mapper name fail : %v", devName, err)
+			continue
+		}
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		for _, m := range diskMaps {
+			if fields, ok := m[devName]; ok {
+				m["/dev/mapper/"+name] = fields
+			}
+		}
+	}
+}
+
 func getProcessNew(c *MonitorContext) bool {
-	cpuStat, ok := readFile("/proc/stat", c.client, true)
+	if source, ok := c.source.(processSource); ok {
+		s, err := source.Processes()
+		if err == nil {
+			c.newS = s
+			c.newTime = now()
+			return true
+		} else if !errors.Is(err, errExecDenied) {
+			logger.L.Debugf("Read Proc fail : %v", err)
+			c.err = err
+			return false
+		}
+	}
+	cpuStat, ok := c.readFile("/proc/stat")
 	if !ok {
 		return false
 	}
 	cpuStat = strings.Split(cpuStat, "\n")[0]
 
-	proc, err := c.client.ReadDir("/proc")
+	proc, err := c.source.ReadDir("/proc")
 	if err != nil {
 		logger.L.Debugf("Read Proc fail : %v", err)
+		c.err = err
 		return false
 	}
 	numberReg := regexp.MustCompile(`\d+`)
 	name := make([]string, 0)
 	for _, n := range proc {
-		s := n.Name()
-		if numberReg.Match([]byte(s)) && n.IsDir() {
+		s := n.Name
+		if numberReg.Match([]byte(s)) && n.IsDir {
 			name = append(name, s)
 		}
 	}
@@ -1181,21 +1213,23 @@ func getProcessNew(c *MonitorContext) bool {
 		wg.Add(1)
 		go func() {
 			for {
+				cMutex.Lock()
 				if count >= total {
+					cMutex.Unlock()
 					break
 				} else {
-					cMutex.Lock()
 					n := name[count]
 					count++
 					cMutex.Unlock()
 
-					stat, ok := readFile("/proc/"+n+"/stat", c.client, false)
-					if !ok {
+					// 进程可能已经退出, 读取失败不算采集失败
+					stat, err := c.source.ReadFile("/proc/" + n + "/stat")
+					if err != nil {
 						continue
 					}
 					stat = strings.ReplaceAll(stat, "\n", "")
-					m, ok := readFile("/proc/"+n+"/statm", c.client, false)
-					if !ok {
+					m, err := c.source.ReadFile("/proc/" + n + "/statm")
+					if err != nil {
 						continue
 					}
 					m = strings.ReplaceAll(m, "\n", "")
@@ -1210,7 +1244,7 @@ func getProcessNew(c *MonitorContext) bool {
 	wg.Wait()
 
 	c.newS = strings.Join(stats, "\n")
-	c.newTime = time.Now()
+	c.newTime = now()
 	return true
 }
 
@@ -1261,27 +1295,20 @@ func (p *Parser) parseProcessMessage(c *MonitorContext) *ProcessMessage {
 		cpuTimeDiff++
 	}
 
-	statReg := regexp.MustCompile(`^\s*(\d+)\s+(\S+)\s+(\S+)\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+)\s+([\d-]+)\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+).*\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+)$`)
-	if statReg == nil {
-		logger.L.Debugf("parse stat reg fail : %v", statReg)
-		return nil
-	}
-
 	oldStatsMap := make(map[string][]string, 0)
 	for _, s := range oldStats {
-		ss := statReg.FindAllStringSubmatch(s, -1)
-		if ss == nil {
+		ss, ok := processStat(s)
+		if !ok {
 			continue
 		}
-		oldStatsMap[ss[0][1]+ss[0][2]] = ss[0]
+		oldStatsMap[ss[1]+ss[2]] = ss
 	}
 
 	for _, s := range stats {
-		statRegResult := statReg.FindAllStringSubmatch(s, -1)
-		if statRegResult == nil {
+		ss, ok := processStat(s)
+		if !ok {
 			continue
 		}
-		ss := statRegResult[0]
 		oldSS, ok := oldStatsMap[ss[1]+ss[2]]
 		if !ok {
 			continue
@@ -1343,10 +1370,29 @@ func (p *Parser) parseProcessMessage(c *MonitorContext) *ProcessMessage {
 	}
 
 	sort.Sort(Processes(m.Process))
-	m.Process = m.Process[:50]
+	if len(m.Process) > 50 {
+		m.Process = m.Process[:50]
+	}
 	return m
 }
 
+// processStat 拆分 stat 与 statm 拼接的一行, 返回 [原文, pid, (进程名), stat 第 3 列起的各列..., statm 各列],
+// 下标与 stat 的列号一致. 进程名可能包含空格和括号, 以最后一个 ")" 为界
+func processStat(s string) ([]string, bool) {
+	begin := strings.Index(s, "(")
+	end := strings.LastIndex(s, ")")
+	if begin < 0 || end < begin {
+		return nil, false
+	}
+	fields := strings.Fields(s[end+1:])
+	// stat 至少需要到第 17 列 cstime, statm 共 7 列
+	if len(fields) < 15+7 {
+		return nil, false
+	}
+	ss := []string{s, strings.TrimSpace(s[:begin]), s[begin : end+1]}
+	return append(ss, fields...), true
+}
+
 func parseInt64(s string) (int64, bool) {
 	parseInt, err := strconv.ParseInt(s, 10, 64)
 	if err != nil {
@@ -1394,26 +1440,13 @@ func roundFloat(num float64, n int) float64 {
 	return value
 }
 
-func readFile(where string, client *sftp.Client, doLog bool) (string, bool) {
-	srcFile, err := client.OpenFile(where, os.O_RDONLY)
-	if err != nil {
-		if doLog {
-			logger.L.Debugf("Read %s file fail : %v", where, err)
-		}
-		return "", false
-	}
-	f, err := ioutil.ReadAll(srcFile)
+// readFile 读取失败时记录错误, 在 status 事件中作为采集失败
+func (c *MonitorContext) readFile(where string) (string, bool) {
+	s, err := c.source.ReadFile(where)
 	if err != nil {
-		if doLog {
-			logger.L.Debugf("Read %s file fail : %v", where, err)
-		}
+		logger.L.Debugf("Read %s file fail : %v", where, err)
+		c.err = err
 		return "", false
 	}
-	err = srcFile.Close()
-	if err != nil {
-		if doLog {
-			logger.L.Debugf("Close %s file fail : %v", where, err)
-		}
-	}
-	return string(f), true
+	return s, true
 }
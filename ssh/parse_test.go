@@ -0,0 +1,169 @@
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite testdata/*/golden with the current parser output")
+
+// sampleInterval 两次采样的间隔, 与 testdata/record.sh 一致
+const sampleInterval = 2 * time.Second
+
+// parseEvents 与 newSSH 中的事件和文件一致, cpuInfo 必须在前, loadavg 和 process 依赖它得到的处理器数
+var parseEvents = []struct {
+	name  string
+	where string
+	parse func(p *Parser, c *MonitorContext) interface{}
+}{
+	{"cpuInfo", "/proc/cpuinfo", func(p *Parser, c *MonitorContext) interface{} { return p.parseCPUInfoMessage(c) }},
+	{"cpuPerformance", "/proc/stat", func(p *Parser, c *MonitorContext) interface{} { return p.parseCPUPerformanceMessage(c) }},
+	{"memoryPerformance", "/proc/meminfo", func(p *Parser, c *MonitorContext) interface{} { return p.parseMemoryPerformanceMessage(c) }},
+	{"uptime", "/proc/uptime", func(p *Parser, c *MonitorContext) interface{} { return p.parseUptimeMessage(c) }},
+	{"loadavg", "/proc/loadavg", func(p *Parser, c *MonitorContext) interface{} { return p.parseLoadavgMessage(c) }},
+	{"netDev", "/proc/net/dev", func(p *Parser, c *MonitorContext) interface{} { return p.parseNetDevMessage(c) }},
+	{"netStat", "/proc/net/snmp", func(p *Parser, c *MonitorContext) interface{} { return p.parseNetStatMessage(c) }},
+	{"temp", "/sys/class/thermal/thermal_zone0/temp", func(p *Parser, c *MonitorContext) interface{} { return p.parseTempMessage(c) }},
+	{"disk", "/proc/diskstats", func(p *Parser, c *MonitorContext) interface{} { return p.parseDiskMessage(c) }},
+	{"process", "", func(p *Parser, c *MonitorContext) interface{} { return p.parseProcessMessage(c) }},
+}
+
+// TestParseGolden 每个 testdata/<主机> 目录是在一台主机上录制的两次采样,
+// 依次解析 sample1 和 sample2, 把第二次的结果与 golden/<事件>.json 比较
+func TestParseGolden(t *testing.T) {
+	entries, err := os.ReadDir("testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		dir := filepath.Join("testdata", e.Name())
+		t.Run(e.Name(), func(t *testing.T) {
+			testParseGolden(t, dir)
+		})
+	}
+}
+
+func testParseGolden(t *testing.T, dir string) {
+	statFS := loadStatFS(t, filepath.Join(dir, "statfs"))
+	samples := []Source{
+		loadSnapshot(t, filepath.Join(dir, "sample1"), statFS),
+		loadSnapshot(t, filepath.Join(dir, "sample2"), statFS),
+	}
+
+	clock := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	defer func(n func() time.Time) { now = n }(now)
+	now = func() time.Time { return clock }
+
+	p := &Parser{}
+	contexts := make(map[string]*MonitorContext)
+	for _, e := range parseEvents {
+		contexts[e.name] = &MonitorContext{port: 22, host: "127.0.0.1", user: "root", where: e.where}
+	}
+	results := make(map[string]interface{})
+	for i, source := range samples {
+		if i > 0 {
+			clock = clock.Add(sampleInterval)
+		}
+		for _, e := range parseEvents {
+			c := contexts[e.name]
+			c.source = source
+			results[e.name] = e.parse(p, c)
+		}
+	}
+	results["rough"] = p.parseRoughMessage(contexts["cpuInfo"])
+
+	for name, v := range results {
+		checkGolden(t, filepath.Join(dir, "golden", name+".json"), v)
+	}
+}
+
+func checkGolden(t *testing.T, file string, v interface{}) {
+	t.Helper()
+	got, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, '\n')
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("%v, run go test -run TestParseGolden -update to create it", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s mismatch\ngot:\n%s\nwant:\n%s", file, got, want)
+	}
+}
+
+// loadSnapshot 把录制的目录读成 MemorySource, 目录下的相对路径即主机上的绝对路径
+func loadSnapshot(t *testing.T, root string, statFS map[string]FSStat) MemorySource {
+	t.Helper()
+	files := make(map[string]string)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files["/"+filepath.ToSlash(rel)] = string(content)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return MemorySource{Files: files, FS: statFS}
+}
+
+// loadStatFS 每行: 挂载点 总块数 空闲块数 块大小
+func loadStatFS(t *testing.T, file string) map[string]FSStat {
+	t.Helper()
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	statFS := make(map[string]FSStat)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 4 {
+			continue
+		}
+		var stat [3]uint64
+		for i := range stat {
+			if stat[i], err = strconv.ParseUint(fields[i+1], 10, 64); err != nil {
+				t.Fatalf("%s : %v", file, err)
+			}
+		}
+		statFS[fields[0]] = FSStat{Blocks: stat[0], Bfree: stat[1], Bsize: stat[2]}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return statFS
+}
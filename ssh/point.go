@@ -0,0 +1,292 @@
+package ssh
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Point 消息中的一个数值字段, Name 为 <结构体>.<字段>, 例如 CPUPerformanceTotal.Utilization,
+// 带单位的字段换算为字节, 字节每秒或秒, Labels 区分同名的多个值, 不包含主机
+type Point struct {
+	Name   string
+	Labels map[string]string
+	Value  float64
+}
+
+// pointEvents Point 名字中的结构体属于的事件
+var pointEvents = map[string]string{
+	"CPUInfo":             "cpuInfo",
+	"CPUProcessorInfo":    "cpuInfo",
+	"CPUPerformanceTotal": "cpuPerformance",
+	"CPUPerformance":      "cpuPerformance",
+	"MemoryPerformance":   "memoryPerformance",
+	"Uptime":              "uptime",
+	"Loadavg":             "loadavg",
+	"NetDevTotal":         "netDev",
+	"NetDev":              "netDev",
+	"NetTCP":              "netStat",
+	"NetUDP":              "netStat",
+	"Temp":                "temp",
+	"DiskTotal":           "disk",
+	"Disk":                "disk",
+	"Process":             "process",
+}
+
+// counterPoints 只增不减的计数, 重启或计数回绕时归零, 其他 Point 都是瞬时值
+var counterPoints = map[string]bool{
+	"NetDevTotal.UpBytes":     true,
+	"NetDevTotal.DownBytes":   true,
+	"NetDevTotal.UpPackets":   true,
+	"NetDevTotal.DownPackets": true,
+	"NetDev.UpBytes":          true,
+	"NetDev.DownBytes":        true,
+	"NetDev.UpPackets":        true,
+	"NetDev.DownPackets":      true,
+	"NetTCP.ActiveOpens":      true,
+	"NetTCP.PassiveOpens":     true,
+	"NetTCP.FailOpens":        true,
+	"NetTCP.InSegments":       true,
+	"NetTCP.OutSegments":      true,
+	"NetTCP.ReTransSegments":  true,
+	"NetUDP.InDatagrams":      true,
+	"NetUDP.OutDatagrams":     true,
+	"NetUDP.ReceiveBufErrors": true,
+	"NetUDP.SendBufErrors":    true,
+	"DiskTotal.Write":         true,
+	"DiskTotal.Read":          true,
+	"Disk.Write":              true,
+	"Disk.Read":               true,
+	"Disk.WriteIOs":           true,
+	"Disk.ReadIOs":            true,
+}
+
+// IsCounter 名为 name 的 Point 是否为计数
+func IsCounter(name string) bool {
+	return counterPoints[name]
+}
+
+// PointEvent 返回产生名为 name 的 Point 的事件
+func PointEvent(name string) (string, bool) {
+	structName, field, ok := strings.Cut(name, ".")
+	if !ok || field == "" {
+		return "", false
+	}
+	event, ok := pointEvents[structName]
+	return event, ok
+}
+
+// Points 把监控消息拆成 Point, 不支持的消息返回 nil
+func Points(message interface{}) []Point {
+	switch m := message.(type) {
+	case CPUInfoMessage:
+		return cpuInfoPoints(m)
+	case CPUPerformanceMessage:
+		return cpuPerformancePoints(m)
+	case MemoryPerformanceMessage:
+		return memoryPerformancePoints(m)
+	case UptimeMessage:
+		return []Point{
+			{Name: "Uptime.Seconds", Value: float64(((m.Uptime.UpDay*24+m.Uptime.UpHour)*60+m.Uptime.UpMin)*60 + m.Uptime.UpSec)},
+		}
+	case LoadavgMessage:
+		l := m.Loadavg
+		return []Point{
+			{Name: "Loadavg.One", Value: l.One},
+			{Name: "Loadavg.OneOccupy", Value: l.OneOccupy},
+			{Name: "Loadavg.Five", Value: l.Five},
+			{Name: "Loadavg.FiveOccupy", Value: l.FiveOccupy},
+			{Name: "Loadavg.Fifteen", Value: l.Fifteen},
+			{Name: "Loadavg.FifteenOccupy", Value: l.FifteenOccupy},
+			{Name: "Loadavg.Running", Value: float64(l.Running)},
+			{Name: "Loadavg.Active", Value: float64(l.Active)},
+			{Name: "Loadavg.LastPid", Value: float64(l.LastPid)},
+		}
+	case NetDevMessage:
+		return netDevPoints(m)
+	case NetStatMessage:
+		t, u := m.NetTCP, m.NetUDP
+		return []Point{
+			{Name: "NetTCP.ActiveOpens", Value: float64(t.ActiveOpens)},
+			{Name: "NetTCP.PassiveOpens", Value: float64(t.PassiveOpens)},
+			{Name: "NetTCP.FailOpens", Value: float64(t.FailOpens)},
+			{Name: "NetTCP.CurrConn", Value: float64(t.CurrConn)},
+			{Name: "NetTCP.InSegments", Value: float64(t.InSegments)},
+			{Name: "NetTCP.OutSegments", Value: float64(t.OutSegments)},
+			{Name: "NetTCP.ReTransSegments", Value: float64(t.ReTransSegments)},
+			{Name: "NetTCP.ReTransRate", Value: t.ReTransRate},
+			{Name: "NetUDP.InDatagrams", Value: float64(u.InDatagrams)},
+			{Name: "NetUDP.OutDatagrams", Value: float64(u.OutDatagrams)},
+			{Name: "NetUDP.ReceiveBufErrors", Value: float64(u.ReceiveBufErrors)},
+			{Name: "NetUDP.SendBufErrors", Value: float64(u.SendBufErrors)},
+		}
+	case TempMessage:
+		r := make([]Point, 0, len(m.TempMap))
+		for zone, temp := range m.TempMap {
+			r = append(r, Point{Name: "Temp.Temp", Labels: map[string]string{"zone": zone}, Value: float64(temp)})
+		}
+		return r
+	case DiskMessage:
+		return diskPoints(m)
+	case ProcessMessage:
+		r := make([]Point, 0, 2*len(m.Process))
+		for _, p := range m.Process {
+			labels := map[string]string{"pid": strconv.FormatInt(p.PID, 10), "name": p.Name}
+			r = append(r,
+				Point{Name: "Process.CPU", Labels: labels, Value: p.CPU},
+				Point{Name: "Process.Mem", Labels: labels, Value: float64(p.MemRaw)},
+			)
+		}
+		return r
+	}
+	return nil
+}
+
+func cpuInfoPoints(m CPUInfoMessage) []Point {
+	r := make([]Point, 0)
+	for physicalId, info := range m.CPUInfoMap {
+		labels := map[string]string{"physicalId": strconv.FormatInt(physicalId, 10)}
+		r = append(r,
+			Point{Name: "CPUInfo.Siblings", Labels: labels, Value: float64(info.Siblings)},
+			Point{Name: "CPUInfo.CPUCores", Labels: labels, Value: float64(info.CPUCores)},
+			Point{Name: "CPUInfo.Bogomips", Labels: labels, Value: info.Bogomips},
+		)
+		for _, core := range info.CPUCoreInfoMap {
+			for _, processor := range core.CPUProcessorInfoMap {
+				r = append(r, Point{
+					Name:   "CPUProcessorInfo.CPUMHz",
+					Labels: map[string]string{"cpu": strconv.FormatInt(processor.Processor, 10)},
+					Value:  processor.CPUMHz,
+				})
+			}
+		}
+	}
+	return r
+}
+
+func cpuPerformancePoints(m CPUPerformanceMessage) []Point {
+	t := m.Total
+	r := []Point{
+		{Name: "CPUPerformanceTotal.TotalTime", Value: float64(t.TotalTime) * timeUnitSeconds(t.TotalTimeUnit)},
+		{Name: "CPUPerformanceTotal.Utilization", Value: t.Utilization},
+		{Name: "CPUPerformanceTotal.Free", Value: t.Free},
+		{Name: "CPUPerformanceTotal.System", Value: t.System},
+		{Name: "CPUPerformanceTotal.User", Value: t.User},
+		{Name: "CPUPerformanceTotal.IO", Value: t.IO},
+		{Name: "CPUPerformanceTotal.Steal", Value: t.Steal},
+	}
+	for _, c := range m.CPUPerformanceMap {
+		labels := map[string]string{"cpu": strconv.FormatInt(c.Processor, 10)}
+		r = append(r,
+			Point{Name: "CPUPerformance.Utilization", Labels: labels, Value: c.Utilization},
+			Point{Name: "CPUPerformance.Free", Labels: labels, Value: c.Free},
+			Point{Name: "CPUPerformance.System", Labels: labels, Value: c.System},
+			Point{Name: "CPUPerformance.User", Labels: labels, Value: c.User},
+			Point{Name: "CPUPerformance.IO", Labels: labels, Value: c.IO},
+			Point{Name: "CPUPerformance.Steal", Labels: labels, Value: c.Steal},
+		)
+	}
+	return r
+}
+
+func memoryPerformancePoints(m MemoryPerformanceMessage) []Point {
+	mem := m.Memory
+	return []Point{
+		{Name: "MemoryPerformance.TotalMem", Value: unitBytes(mem.TotalMem, mem.TotalMemUnit)},
+		{Name: "MemoryPerformance.FreeMemOccupy", Value: mem.FreeMemOccupy},
+		{Name: "MemoryPerformance.FreeMem", Value: unitBytes(mem.FreeMem, mem.FreeMemUnit)},
+		{Name: "MemoryPerformance.AvailableMemOccupy", Value: mem.AvailableMemOccupy},
+		{Name: "MemoryPerformance.AvailableMem", Value: unitBytes(mem.AvailableMem, mem.AvailableMemUnit)},
+		{Name: "MemoryPerformance.UsedMemOccupy", Value: mem.UsedMemOccupy},
+		{Name: "MemoryPerformance.UsedMem", Value: unitBytes(mem.UsedMem, mem.UsedMemUnit)},
+		{Name: "MemoryPerformance.BufferOccupy", Value: mem.BufferOccupy},
+		{Name: "MemoryPerformance.Buffer", Value: unitBytes(mem.Buffer, mem.BufferUnit)},
+		{Name: "MemoryPerformance.CacheOccupy", Value: mem.CacheOccupy},
+		{Name: "MemoryPerformance.Cached", Value: unitBytes(mem.Cached, mem.CachedUnit)},
+		{Name: "MemoryPerformance.DirtyOccupy", Value: mem.DirtyOccupy},
+		{Name: "MemoryPerformance.Dirty", Value: unitBytes(mem.Dirty, mem.DirtyUnit)},
+		{Name: "MemoryPerformance.TotalSwap", Value: unitBytes(mem.TotalSwap, mem.TotalSwapUnit)},
+		{Name: "MemoryPerformance.FreeSwapOccupy", Value: mem.FreeSwapOccupy},
+		{Name: "MemoryPerformance.FreeSwap", Value: unitBytes(mem.FreeSwap, mem.FreeSwapUnit)},
+		{Name: "MemoryPerformance.CachedSwapOccupy", Value: mem.CachedSwapOccupy},
+		{Name: "MemoryPerformance.CachedSwap", Value: unitBytes(mem.CachedSwap, mem.CachedSwapUnit)},
+	}
+}
+
+func netDevPoints(m NetDevMessage) []Point {
+	t := m.NetDevTotal
+	r := []Point{
+		{Name: "NetDevTotal.UpBytes", Value: float64(t.UpBytes)},
+		{Name: "NetDevTotal.DownBytes", Value: float64(t.DownBytes)},
+		{Name: "NetDevTotal.UpPackets", Value: float64(t.UpPackets)},
+		{Name: "NetDevTotal.DownPackets", Value: float64(t.DownPackets)},
+		{Name: "NetDevTotal.UpSpeed", Value: unitBytes(t.UpSpeed, t.UpSpeedUnit)},
+		{Name: "NetDevTotal.DownSpeed", Value: unitBytes(t.DownSpeed, t.DownSpeedUnit)},
+	}
+	for name, n := range m.NetDevMap {
+		labels := map[string]string{"interface": name}
+		r = append(r,
+			Point{Name: "NetDev.UpBytes", Labels: labels, Value: float64(n.UpBytes)},
+			Point{Name: "NetDev.DownBytes", Labels: labels, Value: float64(n.DownBytes)},
+			Point{Name: "NetDev.UpPackets", Labels: labels, Value: float64(n.UpPackets)},
+			Point{Name: "NetDev.DownPackets", Labels: labels, Value: float64(n.DownPackets)},
+			Point{Name: "NetDev.UpSpeed", Labels: labels, Value: unitBytes(n.UpSpeed, n.UpSpeedUnit)},
+			Point{Name: "NetDev.DownSpeed", Labels: labels, Value: unitBytes(n.DownSpeed, n.DownSpeedUnit)},
+		)
+	}
+	return r
+}
+
+func diskPoints(m DiskMessage) []Point {
+	r := []Point{
+		{Name: "DiskTotal.Write", Value: float64(m.WriteBytes)},
+		{Name: "DiskTotal.Read", Value: float64(m.ReadBytes)},
+		{Name: "DiskTotal.WriteRate", Value: unitBytes(m.WriteRate, m.WriteRateUnit)},
+		{Name: "DiskTotal.ReadRate", Value: unitBytes(m.ReadRate, m.ReadRateUnit)},
+	}
+	for device, d := range m.DiskMap {
+		labels := map[string]string{"device": device, "mount": d.Mount}
+		r = append(r,
+			Point{Name: "Disk.FreeRate", Labels: labels, Value: d.FreeRate},
+			Point{Name: "Disk.Free", Labels: labels, Value: unitBytes(d.Free, d.FreeUnit)},
+			Point{Name: "Disk.UsedRate", Labels: labels, Value: d.UsedRate},
+			Point{Name: "Disk.Used", Labels: labels, Value: unitBytes(d.Used, d.UsedUnit)},
+			Point{Name: "Disk.Total", Labels: labels, Value: unitBytes(d.Total, d.TotalUnit)},
+			Point{Name: "Disk.Write", Labels: labels, Value: float64(d.WriteBytes)},
+			Point{Name: "Disk.Read", Labels: labels, Value: float64(d.ReadBytes)},
+			Point{Name: "Disk.WriteRate", Labels: labels, Value: unitBytes(d.WriteRate, d.WriteRateUnit)},
+			Point{Name: "Disk.ReadRate", Labels: labels, Value: unitBytes(d.ReadRate, d.ReadRateUnit)},
+			Point{Name: "Disk.WriteIOPS", Labels: labels, Value: float64(d.WriteIOPS)},
+			Point{Name: "Disk.ReadIOPS", Labels: labels, Value: float64(d.ReadIOPS)},
+			Point{Name: "Disk.WriteIOs", Labels: labels, Value: float64(d.WriteIOs)},
+			Point{Name: "Disk.ReadIOs", Labels: labels, Value: float64(d.ReadIOs)},
+		)
+	}
+	return r
+}
+
+// unitBytes 还原 roundMem 换算过的值, 精度为两位小数
+func unitBytes(v float64, unit string) float64 {
+	switch unit {
+	case "TB":
+		return v * 1024 * 1024 * 1024 * 1024
+	case "GB":
+		return v * 1024 * 1024 * 1024
+	case "MB":
+		return v * 1024 * 1024
+	case "KB":
+		return v * 1024
+	}
+	return v
+}
+
+func timeUnitSeconds(unit string) float64 {
+	switch unit {
+	case "D":
+		return 60 * 60 * 24
+	case "H":
+		return 60 * 60
+	case "M":
+		return 60
+	}
+	return 1
+}
@@ -0,0 +1,106 @@
+package ssh
+
+import (
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 探测失败的阶段, hostKey 和 auth 时 sshd 在运行, 主机仍然可达
+const (
+	ProbeTCP     = "tcp"
+	ProbeSSH     = "ssh"
+	ProbeHostKey = "hostKey"
+	ProbeAuth    = "auth"
+)
+
+// ProbeResult 一次探测的结果, Error 为空时主机可达
+type ProbeResult struct {
+	// Latency 建立 TCP 连接的耗时
+	Latency time.Duration
+	Stage   string
+	Error   string
+}
+
+// Probe 建立 TCP 连接并完成 ssh 握手后立即断开, 不影响监控使用的连接. jump 不为 nil 时通过调用者持有的跳板机连接,
+// auth.ProxyJump 被忽略, 避免每次探测都重新登录跳板机.
+// login 为 false 时只尝试 none 认证, 密钥交换完成后被拒绝即视为可达, 避免每次探测都登录触发 fail2ban 等封禁;
+// login 为 true 时用 auth 的凭据登录, 认证失败时 Stage 为 auth
+func (m *Manager) Probe(port int, host, user string, auth Auth, timeout time.Duration, login bool, jump *ProxyJump) ProbeResult {
+	var methods []ssh.AuthMethod
+	var err error
+	if login {
+		if methods, err = auth.methods(); err != nil {
+			return ProbeResult{Stage: ProbeAuth, Error: err.Error()}
+		}
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	start := time.Now()
+	var conn net.Conn
+	if jump == nil {
+		conn, err = net.DialTimeout("tcp", addr, timeout)
+	} else {
+		conn, err = dialViaTimeout(jump.b.sshClient, addr, timeout)
+	}
+	if err != nil {
+		return ProbeResult{Stage: ProbeTCP, Error: err.Error()}
+	}
+	latency := time.Since(start)
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	var hostKey ssh.PublicKey
+	var hostKeyErr error
+	config := &ssh.ClientConfig{
+		Timeout:         timeout,
+		User:            user,
+		HostKeyCallback: hostKeyCallback(auth.KnownHosts, port, host, &hostKey, &hostKeyErr),
+		Auth:            methods,
+	}
+	if auth.KnownHosts != nil {
+		config.HostKeyAlgorithms = hostKeyAlgorithms(auth.KnownHosts, host, port)
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		_ = conn.Close()
+		if hostKeyErr != nil {
+			return ProbeResult{Latency: latency, Stage: ProbeHostKey, Error: hostKeyErr.Error()}
+		}
+		// 收到主机密钥说明密钥交换已经完成, 之后的失败只能是认证被拒绝
+		if hostKey != nil && strings.Contains(err.Error(), "unable to authenticate") {
+			if !login {
+				return ProbeResult{Latency: latency}
+			}
+			return ProbeResult{Latency: latency, Stage: ProbeAuth, Error: err.Error()}
+		}
+		return ProbeResult{Latency: latency, Stage: ProbeSSH, Error: err.Error()}
+	}
+	_ = ssh.NewClient(c, chans, reqs).Close()
+	return ProbeResult{Latency: latency}
+}
+
+// dialViaTimeout 跳板机的 direct-tcpip 通道没有超时, 超时后到达的连接直接关闭
+func dialViaTimeout(via *ssh.Client, addr string, timeout time.Duration) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := via.Dial("tcp", addr)
+		done <- result{conn, err}
+	}()
+	select {
+	case r := <-done:
+		return r.conn, r.err
+	case <-time.After(timeout):
+		go func() {
+			if r := <-done; r.conn != nil {
+				_ = r.conn.Close()
+			}
+		}()
+		return nil, fmt.Errorf("dial %s via proxy jump timeout", addr)
+	}
+}
@@ -0,0 +1,175 @@
+package ssh
+
+import (
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"logger"
+	"strings"
+	"sync"
+)
+
+// Hop 跳板机
+type Hop struct {
+	Port int
+	Host string
+	User string
+	Auth Auth
+}
+
+// bastion 跳板机连接, 用相同凭据经过同一串跳板机的目标共享一个连接, refs 为引用数
+type bastion struct {
+	key       string
+	sshClient *ssh.Client
+	hostKey   ssh.PublicKey
+	parent    *bastion
+	refs      int
+}
+
+// bastionKey 包含每一跳凭据的摘要, 凭据不同的用户各自登录跳板机, 不能借用别人已经登录的连接
+func bastionKey(hops []Hop) string {
+	keys := make([]string, 0, len(hops))
+	for _, hop := range hops {
+		keys = append(keys, generalKey(hop.Port, hop.Host, hop.User)+"#"+hop.Auth.digest()[:16])
+	}
+	return "jump:" + strings.Join(keys, ">")
+}
+
+// ProxyJumpKey 经过的跳板机和每一跳的凭据都相同时 key 相同
+func ProxyJumpKey(hops []Hop) string {
+	return bastionKey(hops)
+}
+
+// ProxyJump 调用者长期持有的跳板机连接, 例如探测在多轮之间保持, 不在每轮重新登录跳板机
+type ProxyJump struct {
+	m *Manager
+	b *bastion
+}
+
+// HoldProxyJump 获取最后一跳的连接并持有一个引用, 不再使用时调用 Release
+func (m *Manager) HoldProxyJump(hops []Hop) (*ProxyJump, error) {
+	b, err := m.acquireBastion(hops)
+	if err != nil {
+		return nil, err
+	}
+	return &ProxyJump{m: m, b: b}, nil
+}
+
+// Alive 跳板机连接没有断开且仍然是 hops 对应的连接, 断开后需要重新 Hold
+func (p *ProxyJump) Alive(hops []Hop) bool {
+	if p.b.key != bastionKey(hops) {
+		return false
+	}
+	mutex := p.m.mutexes.GetNilThenSet(p.b.key, &sync.Mutex{})
+	mutex.Lock()
+	defer mutex.Unlock()
+	b, ok := p.m.bastions.Get(p.b.key)
+	return ok && b == p.b
+}
+
+func (p *ProxyJump) Release() {
+	p.m.releaseBastion(p.b)
+}
+
+// dial 按 auth.ProxyJump 连接目标, 返回的 release 在连接关闭后调用
+func (m *Manager) dial(port int, host, user string, auth Auth) (*ssh.Client, ssh.PublicKey, func(), error) {
+	if len(auth.ProxyJump) == 0 {
+		sshClient, hostKey, err := newSimpleSSH(port, host, user, auth, nil)
+		return sshClient, hostKey, func() {}, err
+	}
+	b, err := m.acquireBastion(auth.ProxyJump)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("Create ssh client %s fail : %w", generalKey(port, host, user), err)
+	}
+	sshClient, hostKey, err := newSimpleSSH(port, host, user, auth, b.sshClient)
+	if err != nil {
+		m.releaseBastion(b)
+		return nil, nil, nil, err
+	}
+	return sshClient, hostKey, func() { m.releaseBastion(b) }, nil
+}
+
+// acquireBastion 获取最后一跳的连接, 没有时通过前面的跳板机建立, 每个连接持有上一跳的一个引用
+func (m *Manager) acquireBastion(hops []Hop) (*bastion, error) {
+	var parent *bastion
+	if len(hops) > 1 {
+		p, err := m.acquireBastion(hops[:len(hops)-1])
+		if err != nil {
+			return nil, err
+		}
+		parent = p
+	}
+	hop := hops[len(hops)-1]
+	key := bastionKey(hops)
+	mutex := m.mutexes.GetNilThenSet(key, &sync.Mutex{})
+	mutex.Lock()
+	b, created, err := m.getBastion(key, hop, parent)
+	mutex.Unlock()
+	if parent != nil && !created {
+		// 复用已有连接或创建失败时不需要新的上一跳引用
+		m.releaseBastion(parent)
+	}
+	return b, err
+}
+
+func (m *Manager) getBastion(key string, hop Hop, parent *bastion) (*bastion, bool, error) {
+	if b, ok := m.bastions.Get(key); ok {
+		if hop.Auth.KnownHosts != nil && b.hostKey != nil {
+			if err := checkHostKey(hop.Auth.KnownHosts, hop.Host, hop.Port, b.hostKey); err != nil {
+				return nil, false, fmt.Errorf("Create ssh client %s fail : %w", generalKey(hop.Port, hop.Host, hop.User), err)
+			}
+		}
+		b.refs++
+		return b, false, nil
+	}
+	var via *ssh.Client
+	if parent != nil {
+		via = parent.sshClient
+	}
+	sshClient, hostKey, err := newSimpleSSH(hop.Port, hop.Host, hop.User, hop.Auth, via)
+	if err != nil {
+		return nil, false, err
+	}
+	b := &bastion{
+		key:       key,
+		sshClient: sshClient,
+		hostKey:   hostKey,
+		parent:    parent,
+		refs:      1,
+	}
+	m.bastions.Set(key, b)
+	logger.L.Debugf("bastion create %s", key)
+	go func() {
+		// 跳板机断开后不再复用, 已有的引用仍然按引用数释放
+		_ = sshClient.Wait()
+		mutex := m.mutexes.GetNilThenSet(key, &sync.Mutex{})
+		mutex.Lock()
+		if v, ok := m.bastions.Get(key); ok && v == b {
+			m.bastions.Remove(key)
+		}
+		mutex.Unlock()
+	}()
+	return b, true, nil
+}
+
+func (m *Manager) releaseBastion(b *bastion) {
+	mutex := m.mutexes.GetNilThenSet(b.key, &sync.Mutex{})
+	mutex.Lock()
+	b.refs--
+	last := b.refs == 0
+	if last {
+		if v, ok := m.bastions.Get(b.key); ok && v == b {
+			m.bastions.Remove(b.key)
+		}
+	}
+	mutex.Unlock()
+	if !last {
+		return
+	}
+	if err := b.sshClient.Close(); err != nil {
+		logger.L.Debugf("bastion close fail : %v", err)
+	}
+	logger.L.Debugf("bastion delete %s", b.key)
+	if b.parent != nil {
+		m.releaseBastion(b.parent)
+	}
+}
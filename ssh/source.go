@@ -0,0 +1,191 @@
+package ssh
+
+import (
+	"github.com/pkg/sftp"
+	"io"
+	"io/fs"
+	"logger"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Source 采集读取文件的来源, Parser 只通过它访问被监控的主机
+type Source interface {
+	ReadFile(name string) (string, error)
+	ReadDir(name string) ([]DirEntry, error)
+	// StatFS 返回 name 所在文件系统的容量
+	StatFS(name string) (FSStat, error)
+}
+
+type DirEntry struct {
+	Name  string
+	IsDir bool
+}
+
+type FSStat struct {
+	Blocks uint64
+	Bfree  uint64
+	Bsize  uint64
+}
+
+// processSource 能一次读取所有进程状态的 Source, 格式与 getProcessNew 拼接的一致
+type processSource interface {
+	Processes() (string, error)
+}
+
+type sftpSource struct {
+	client *sftp.Client
+}
+
+func NewSFTPSource(client *sftp.Client) Source {
+	return sftpSource{client: client}
+}
+
+func (s sftpSource) ReadFile(name string) (string, error) {
+	srcFile, err := s.client.OpenFile(name, os.O_RDONLY)
+	if err != nil {
+		return "", err
+	}
+	f, err := io.ReadAll(srcFile)
+	if err != nil {
+		_ = srcFile.Close()
+		return "", err
+	}
+	err = srcFile.Close()
+	if err != nil {
+		logger.L.Debugf("Close %s file fail : %v", name, err)
+	}
+	return string(f), nil
+}
+
+func (s sftpSource) ReadDir(name string) ([]DirEntry, error) {
+	infos, err := s.client.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]DirEntry, 0, len(infos))
+	for _, info := range infos {
+		entries = append(entries, DirEntry{Name: info.Name(), IsDir: info.IsDir()})
+	}
+	return entries, nil
+}
+
+func (s sftpSource) StatFS(name string) (FSStat, error) {
+	stat, err := s.client.StatVFS(name)
+	if err != nil {
+		return FSStat{}, err
+	}
+	return FSStat{Blocks: stat.Blocks, Bfree: stat.Bfree, Bsize: stat.Bsize}, nil
+}
+
+// execSource 文件优先用 exec 批量读取, exec 不可用时和其他操作一样使用 fallback
+type execSource struct {
+	batch    *batchReader
+	fallback Source
+}
+
+func (s execSource) ReadFile(name string) (string, error) {
+	if s.batch.enabled() {
+		content, err := s.batch.readFile(name)
+		if err == nil || s.batch.enabled() {
+			return content, err
+		}
+	}
+	return s.fallback.ReadFile(name)
+}
+
+func (s execSource) ReadDir(name string) ([]DirEntry, error) {
+	return s.fallback.ReadDir(name)
+}
+
+func (s execSource) StatFS(name string) (FSStat, error) {
+	return s.fallback.StatFS(name)
+}
+
+// Processes exec 不可用时返回 errExecDenied, 调用方逐个文件读取
+func (s execSource) Processes() (string, error) {
+	if s.batch.enabled() {
+		content, err := s.batch.processes()
+		if err == nil || s.batch.enabled() {
+			return content, err
+		}
+	}
+	return "", errExecDenied
+}
+
+// LocalSource 读取本机文件, Root 不为空时作为根目录, 用于监控后端所在主机
+type LocalSource struct {
+	Root string
+}
+
+func (s LocalSource) path(name string) string {
+	return filepath.Join(s.Root, filepath.FromSlash(name))
+}
+
+func (s LocalSource) ReadFile(name string) (string, error) {
+	b, err := os.ReadFile(s.path(name))
+	return string(b), err
+}
+
+func (s LocalSource) ReadDir(name string) ([]DirEntry, error) {
+	des, err := os.ReadDir(s.path(name))
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]DirEntry, 0, len(des))
+	for _, de := range des {
+		entries = append(entries, DirEntry{Name: de.Name(), IsDir: de.IsDir()})
+	}
+	return entries, nil
+}
+
+func (s LocalSource) StatFS(name string) (FSStat, error) {
+	return statFS(s.path(name))
+}
+
+// MemorySource 内存中的文件, 用于测试, 目录由文件路径推导
+type MemorySource struct {
+	Files map[string]string
+	FS    map[string]FSStat
+}
+
+func (s MemorySource) ReadFile(name string) (string, error) {
+	content, ok := s.Files[name]
+	if !ok {
+		return "", &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return content, nil
+}
+
+func (s MemorySource) ReadDir(name string) ([]DirEntry, error) {
+	prefix := strings.TrimSuffix(name, "/") + "/"
+	children := make(map[string]bool)
+	for file := range s.Files {
+		if !strings.HasPrefix(file, prefix) || file == prefix {
+			continue
+		}
+		rest := strings.TrimPrefix(file, prefix)
+		child, _, isDir := strings.Cut(rest, "/")
+		children[child] = children[child] || isDir
+	}
+	if len(children) == 0 {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	entries := make([]DirEntry, 0, len(children))
+	for child, isDir := range children {
+		entries = append(entries, DirEntry{Name: child, IsDir: isDir})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries, nil
+}
+
+func (s MemorySource) StatFS(name string) (FSStat, error) {
+	stat, ok := s.FS[path.Clean(name)]
+	if !ok {
+		return FSStat{}, &fs.PathError{Op: "statfs", Path: name, Err: fs.ErrNotExist}
+	}
+	return stat, nil
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 	"logger"
+	"mutexMap"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -19,8 +20,11 @@ type SSH struct {
 	Port                    int
 	Host                    string
 	User                    string
-	sshClient               *ssh.Client
-	sftpClient              *sftp.Client
+	connect                 connector
+	conn                    *connection
+	connMutex               sync.RWMutex
+	state                   ConnectionStateMessage
+	stateMutex              sync.Mutex
 	stop                    chan int
 	wg                      sync.WaitGroup
 	parser                  Parser
@@ -35,29 +39,84 @@ type SSH struct {
 	tempClient              Client[TempMessage]
 	diskClient              Client[DiskMessage]
 	processClient           Client[ProcessMessage]
+	stateClient             Client[ConnectionStateMessage]
+	statusClient            Client[StatusMessage]
+	status                  *status
+	// observers 观察者注册的监听者不计入 Empty, pins 不为空时 ssh 总是保持连接
+	observers mutexMap.MutexMap[bool]
+	pins      mutexMap.MutexMap[bool]
+	// authorized 建立连接或已经登录成功的凭据摘要, 其他凭据复用连接前需要先登录一次
+	authorized mutexMap.MutexMap[bool]
 }
 
-func newSimpleSSH(port int, host, user, passwd string) (*ssh.Client, error) {
+// dialer 建立到目标的 ssh 连接, 返回的 release 在连接关闭后调用
+type dialer func() (*ssh.Client, ssh.PublicKey, func(), error)
+
+// connector 建立连接, 断线后重连也使用它
+type connector func() (*connection, error)
+
+// connection 断线重连时整体替换, 本机伪主机的 sshClient 和 sftpClient 为 nil
+type connection struct {
+	sshClient  *ssh.Client
+	hostKey    ssh.PublicKey
+	sftpClient *sftp.Client
+	source     Source
+	release    func()
+}
+
+// newSimpleSSH via 不为空时通过跳板机连接
+func newSimpleSSH(port int, host, user string, auth Auth, via *ssh.Client) (*ssh.Client, ssh.PublicKey, error) {
+	methods, err := auth.methods()
+	if err != nil {
+		errText := fmt.Sprintf("Create ssh client %s fail : %v", generalKey(port, host, user), err)
+		logger.L.Debugf(errText)
+		return nil, nil, errors.New(errText)
+	}
+	var hostKey ssh.PublicKey
+	var hostKeyErr error
 	config := &ssh.ClientConfig{
 		Timeout:         time.Millisecond * 800,
 		User:            user,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Auth:            []ssh.AuthMethod{ssh.Password(passwd)},
+		HostKeyCallback: hostKeyCallback(auth.KnownHosts, port, host, &hostKey, &hostKeyErr),
+		Auth:            methods,
+	}
+	if auth.KnownHosts != nil {
+		config.HostKeyAlgorithms = hostKeyAlgorithms(auth.KnownHosts, host, port)
 	}
 
 	addr := fmt.Sprintf("%s:%d", host, port)
-	sshClient, err := ssh.Dial("tcp", addr, config)
+	var sshClient *ssh.Client
+	if via == nil {
+		sshClient, err = ssh.Dial("tcp", addr, config)
+	} else {
+		sshClient, err = dialVia(via, addr, config)
+	}
 	if err != nil {
-		errText := fmt.Sprintf("Create ssh client %s fail : %v", generalKey(port, host, user), err)
-		logger.L.Debugf(errText)
-		return nil, errors.New(errText)
+		if hostKeyErr != nil {
+			err = hostKeyErr
+		}
+		logger.L.Debugf("Create ssh client %s fail : %v", generalKey(port, host, user), err)
+		return nil, nil, fmt.Errorf("Create ssh client %s fail : %w", generalKey(port, host, user), err)
 	}
-	return sshClient, nil
+	return sshClient, hostKey, nil
 }
 
-func newSSH(port int, host, user, passwd string) (*SSH, error) {
+// dialVia 通过跳板机的 direct-tcpip 通道连接目标
+func dialVia(via *ssh.Client, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	conn, err := via.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
 
-	sshClient, err := newSimpleSSH(port, host, user, passwd)
+func connect(port int, host, user string, dial dialer) (*connection, error) {
+	sshClient, hostKey, release, err := dial()
 	if err != nil {
 		return nil, err
 	}
@@ -66,8 +125,40 @@ func newSSH(port int, host, user, passwd string) (*SSH, error) {
 		errText := fmt.Sprintf("Create sftp client %s fail : %v", generalKey(port, host, user), err)
 		logger.L.Debugf(errText)
 		_ = sshClient.Close()
+		release()
 		return nil, errors.New(errText)
 	}
+	return &connection{
+		sshClient:  sshClient,
+		hostKey:    hostKey,
+		sftpClient: sftpClient,
+		source: execSource{
+			batch:    newBatchReader(sshClient),
+			fallback: NewSFTPSource(sftpClient),
+		},
+		release: release,
+	}, nil
+}
+
+func (c *connection) close() {
+	if c.sftpClient != nil {
+		if err := c.sftpClient.Close(); err != nil {
+			logger.L.Debugf("sftp client close fail : %v", err)
+		}
+	}
+	if c.sshClient != nil {
+		if err := c.sshClient.Close(); err != nil {
+			logger.L.Debugf("ssh client close fail : %v", err)
+		}
+	}
+	c.release()
+}
+
+func newSSH(port int, host, user string, connect connector) (*SSH, error) {
+	conn, err := connect()
+	if err != nil {
+		return nil, err
+	}
 
 	return &SSH{
 		closeTimer:              time.NewTimer(5 * time.Second),
@@ -76,21 +167,28 @@ func newSSH(port int, host, user, passwd string) (*SSH, error) {
 		Port:                    port,
 		Host:                    host,
 		User:                    user,
-		sshClient:               sshClient,
-		sftpClient:              sftpClient,
+		connect:                 connect,
+		conn:                    conn,
+		state:                   ConnectionStateMessage{Message: Message{Port: port, Host: host, User: user}, State: StateUp},
 		stop:                    make(chan int),
 		parser:                  Parser{},
-		roughClient:             NewClient[RoughMessage](""),
-		cpuInfoClient:           NewClient[CPUInfoMessage]("/proc/cpuinfo"),
-		cpuPerformanceClient:    NewClient[CPUPerformanceMessage]("/proc/stat"),
-		memoryPerformanceClient: NewClient[MemoryPerformanceMessage]("/proc/meminfo"),
-		uptimeClient:            NewClient[UptimeMessage]("/proc/uptime"),
-		loadavgClient:           NewClient[LoadavgMessage]("/proc/loadavg"),
-		netDecClient:            NewClient[NetDevMessage]("/proc/net/dev"),
-		netStatClient:           NewClient[NetStatMessage]("/proc/net/snmp"),
-		tempClient:              NewClient[TempMessage]("/sys/class/thermal/thermal_zone0/temp"),
-		diskClient:              NewClient[DiskMessage]("/proc/diskstats"),
-		processClient:           NewClient[ProcessMessage](""),
+		roughClient:             NewClient[RoughMessage]("", ""),
+		cpuInfoClient:           NewClient[CPUInfoMessage]("cpuInfo", "/proc/cpuinfo"),
+		cpuPerformanceClient:    NewClient[CPUPerformanceMessage]("cpuPerformance", "/proc/stat"),
+		memoryPerformanceClient: NewClient[MemoryPerformanceMessage]("memoryPerformance", "/proc/meminfo"),
+		uptimeClient:            NewClient[UptimeMessage]("uptime", "/proc/uptime"),
+		loadavgClient:           NewClient[LoadavgMessage]("loadavg", "/proc/loadavg"),
+		netDecClient:            NewClient[NetDevMessage]("netDev", "/proc/net/dev"),
+		netStatClient:           NewClient[NetStatMessage]("netStat", "/proc/net/snmp"),
+		tempClient:              NewClient[TempMessage]("temp", "/sys/class/thermal/thermal_zone0/temp"),
+		diskClient:              NewClient[DiskMessage]("disk", "/proc/diskstats"),
+		processClient:           NewClient[ProcessMessage]("process", ""),
+		stateClient:             NewClient[ConnectionStateMessage]("", ""),
+		statusClient:            NewClient[StatusMessage]("", ""),
+		status:                  newStatus(),
+		observers:               mutexMap.NewMutexMap[bool](0),
+		pins:                    mutexMap.NewMutexMap[bool](0),
+		authorized:              mutexMap.NewMutexMap[bool](0),
 	}, nil
 }
 
@@ -99,92 +197,215 @@ func (h *SSH) Close() {
 	if !closed {
 		close(h.stop)
 		h.wg.Wait()
-		err := h.sftpClient.Close()
-		if err != nil {
-			logger.L.Debugf("sftp client close fail : %v", err)
-		}
-		err = h.sshClient.Close()
-		if err != nil {
-			logger.L.Debugf("ssh client close fail : %v", err)
+		h.connMutex.Lock()
+		if h.conn != nil {
+			h.conn.close()
+			h.conn = nil
 		}
+		h.connMutex.Unlock()
 	}
 }
 
-func (h *SSH) startAllMonitor() {
-	h.wg.Add(11)
-	go h.cpuInfoClient.monitor(h, h.parser.parseCPUInfoMessage, 10)
-	go h.cpuPerformanceClient.monitor(h, h.parser.parseCPUPerformanceMessage, 2)
-	go h.memoryPerformanceClient.monitor(h, h.parser.parseMemoryPerformanceMessage, 2)
-	go h.uptimeClient.monitor(h, h.parser.parseUptimeMessage, 2)
-	go h.loadavgClient.monitor(h, h.parser.parseLoadavgMessage, 2)
-	go h.netDecClient.monitor(h, h.parser.parseNetDevMessage, 2)
-	go h.netStatClient.monitor(h, h.parser.parseNetStatMessage, 2)
-	go h.tempClient.monitor(h, h.parser.parseTempMessage, 2)
-	go h.diskClient.monitor(h, h.parser.parseDiskMessage, 2)
-	go h.processClient.monitor(h, h.parser.parseProcessMessage, 5)
-	go h.roughClient.monitor(h, h.parser.parseRoughMessage, 2)
+// connection 返回当前连接, 断线期间返回 nil
+func (h *SSH) connection() *connection {
+	h.connMutex.RLock()
+	defer h.connMutex.RUnlock()
+	return h.conn
 }
 
-func (h *SSH) RegisterRoughListener(key string, listener Listener[RoughMessage]) {
-	h.roughClient.RegisterHandler(key, listener)
+// checkHostKey 复用已建立的连接前按新用户的 known hosts 校验主机公钥
+func (h *SSH) checkHostKey(auth Auth) error {
+	h.connMutex.RLock()
+	var hostKey ssh.PublicKey
+	if h.conn != nil {
+		hostKey = h.conn.hostKey
+	}
+	h.connMutex.RUnlock()
+	if auth.KnownHosts == nil || hostKey == nil {
+		return nil
+	}
+	if err := checkHostKey(auth.KnownHosts, h.Host, h.Port, hostKey); err != nil {
+		return fmt.Errorf("Create ssh client %s fail : %w", h.Key, err)
+	}
+	return nil
+}
+
+// start 启动连接健康检查, 采集循环在有监听者后才启动
+func (h *SSH) start() {
+	h.cpuInfoClient.setup(h, h.parser.parseCPUInfoMessage, defaultInterval("cpuInfo"))
+	h.cpuPerformanceClient.setup(h, h.parser.parseCPUPerformanceMessage, defaultInterval("cpuPerformance"))
+	h.memoryPerformanceClient.setup(h, h.parser.parseMemoryPerformanceMessage, defaultInterval("memoryPerformance"))
+	h.uptimeClient.setup(h, h.parser.parseUptimeMessage, defaultInterval("uptime"))
+	// 负载和进程占用按 CPU 核数计算
+	h.loadavgClient.setup(h, h.parser.parseLoadavgMessage, defaultInterval("loadavg"), &h.cpuInfoClient)
+	h.netDecClient.setup(h, h.parser.parseNetDevMessage, defaultInterval("netDev"))
+	h.netStatClient.setup(h, h.parser.parseNetStatMessage, defaultInterval("netStat"))
+	h.tempClient.setup(h, h.parser.parseTempMessage, defaultInterval("temp"))
+	h.diskClient.setup(h, h.parser.parseDiskMessage, defaultInterval("disk"))
+	h.processClient.setup(h, h.parser.parseProcessMessage, defaultInterval("process"), &h.cpuInfoClient)
+	// 概览读取其他采集写入 Parser 的结果
+	h.roughClient.setup(h, h.parser.parseRoughMessage, defaultInterval("rough"),
+		&h.cpuPerformanceClient, &h.memoryPerformanceClient, &h.loadavgClient,
+		&h.netDecClient, &h.diskClient, &h.tempClient)
+	h.wg.Add(1)
+	go h.health()
+}
+
+func (h *SSH) RegisterRoughListener(key string, listeners RoughListener) {
+	if listeners.RoughListener != nil {
+		h.roughClient.RegisterHandler(key, listeners.RoughListener, time.Duration(listeners.Interval)*time.Second)
+	}
+	if listeners.ConnectionStateListener != nil {
+		h.RegisterStateListener(key, listeners.ConnectionStateListener)
+	}
+	if listeners.StatusListener != nil {
+		h.RegisterStatusListener(key, listeners.StatusListener)
+	}
 }
 
 func (h *SSH) RemoveRoughListener(key string) {
 	h.roughClient.RemoveHandler(key)
 }
 
+// RegisterStateListener 注册后立即收到当前连接状态
+func (h *SSH) RegisterStateListener(key string, listener Listener[ConnectionStateMessage]) {
+	h.stateMutex.Lock()
+	defer h.stateMutex.Unlock()
+	h.stateClient.RegisterHandler(key, listener, 0)
+	listener(h.state)
+}
+
+func (h *SSH) RemoveStateListener(key string) {
+	h.stateClient.RemoveHandler(key)
+}
+
 func (h *SSH) RegisterSSHListener(key string, listeners AllListener) {
 	if listeners.CPUInfoListener != nil {
-		h.cpuInfoClient.RegisterHandler(key, listeners.CPUInfoListener)
+		h.cpuInfoClient.RegisterHandler(key, listeners.CPUInfoListener, interval(listeners.Intervals, "cpuInfo"))
 	}
 	if listeners.CPUPerformanceListener != nil {
-		h.cpuPerformanceClient.RegisterHandler(key, listeners.CPUPerformanceListener)
+		h.cpuPerformanceClient.RegisterHandler(key, listeners.CPUPerformanceListener, interval(listeners.Intervals, "cpuPerformance"))
 	}
 	if listeners.MemoryPerformanceListener != nil {
-		h.memoryPerformanceClient.RegisterHandler(key, listeners.MemoryPerformanceListener)
+		h.memoryPerformanceClient.RegisterHandler(key, listeners.MemoryPerformanceListener, interval(listeners.Intervals, "memoryPerformance"))
 	}
 	if listeners.UptimeListener != nil {
-		h.uptimeClient.RegisterHandler(key, listeners.UptimeListener)
+		h.uptimeClient.RegisterHandler(key, listeners.UptimeListener, interval(listeners.Intervals, "uptime"))
 	}
 	if listeners.LoadavgListener != nil {
-		h.loadavgClient.RegisterHandler(key, listeners.LoadavgListener)
+		h.loadavgClient.RegisterHandler(key, listeners.LoadavgListener, interval(listeners.Intervals, "loadavg"))
 	}
 	if listeners.NetDevListener != nil {
-		h.netDecClient.RegisterHandler(key, listeners.NetDevListener)
+		h.netDecClient.RegisterHandler(key, listeners.NetDevListener, interval(listeners.Intervals, "netDev"))
 	}
 	if listeners.NetStatListener != nil {
-		h.netStatClient.RegisterHandler(key, listeners.NetStatListener)
+		h.netStatClient.RegisterHandler(key, listeners.NetStatListener, interval(listeners.Intervals, "netStat"))
 	}
 	if listeners.TempListener != nil {
-		h.tempClient.RegisterHandler(key, listeners.TempListener)
+		h.tempClient.RegisterHandler(key, listeners.TempListener, interval(listeners.Intervals, "temp"))
 	}
 	if listeners.DiskListener != nil {
-		h.diskClient.RegisterHandler(key, listeners.DiskListener)
+		h.diskClient.RegisterHandler(key, listeners.DiskListener, interval(listeners.Intervals, "disk"))
 	}
 	if listeners.ProcessListener != nil {
-		h.processClient.RegisterHandler(key, listeners.ProcessListener)
+		h.processClient.RegisterHandler(key, listeners.ProcessListener, interval(listeners.Intervals, "process"))
+	}
+	if listeners.ConnectionStateListener != nil {
+		h.RegisterStateListener(key, listeners.ConnectionStateListener)
+	}
+	if listeners.StatusListener != nil {
+		h.RegisterStatusListener(key, listeners.StatusListener)
+	}
+}
+
+// UpdateSSHListener 按新的 listeners 替换已有订阅, 为空的事件取消订阅
+func (h *SSH) UpdateSSHListener(key string, listeners AllListener) {
+	h.RegisterSSHListener(key, listeners)
+	if listeners.CPUInfoListener == nil {
+		h.cpuInfoClient.RemoveHandler(key)
+	}
+	if listeners.CPUPerformanceListener == nil {
+		h.cpuPerformanceClient.RemoveHandler(key)
+	}
+	if listeners.MemoryPerformanceListener == nil {
+		h.memoryPerformanceClient.RemoveHandler(key)
+	}
+	if listeners.UptimeListener == nil {
+		h.uptimeClient.RemoveHandler(key)
+	}
+	if listeners.LoadavgListener == nil {
+		h.loadavgClient.RemoveHandler(key)
+	}
+	if listeners.NetDevListener == nil {
+		h.netDecClient.RemoveHandler(key)
+	}
+	if listeners.NetStatListener == nil {
+		h.netStatClient.RemoveHandler(key)
+	}
+	if listeners.TempListener == nil {
+		h.tempClient.RemoveHandler(key)
+	}
+	if listeners.DiskListener == nil {
+		h.diskClient.RemoveHandler(key)
+	}
+	if listeners.ProcessListener == nil {
+		h.processClient.RemoveHandler(key)
+	}
+}
+
+// listenerSet 不区分消息类型地管理监听者
+type listenerSet interface {
+	hasHandler(key string) bool
+	RemoveHandler(key string)
+	LenListener() int
+}
+
+func (h *SSH) monitorClients() []listenerSet {
+	return []listenerSet{
+		&h.cpuInfoClient,
+		&h.cpuPerformanceClient,
+		&h.memoryPerformanceClient,
+		&h.uptimeClient,
+		&h.loadavgClient,
+		&h.netDecClient,
+		&h.netStatClient,
+		&h.tempClient,
+		&h.diskClient,
+		&h.processClient,
 	}
 }
 
 func (h *SSH) RemoveSSHListener(key string) {
-	h.cpuInfoClient.RemoveHandler(key)
-	h.cpuPerformanceClient.RemoveHandler(key)
-	h.memoryPerformanceClient.RemoveHandler(key)
-	h.uptimeClient.RemoveHandler(key)
-	h.loadavgClient.RemoveHandler(key)
-	h.netDecClient.RemoveHandler(key)
-	h.netStatClient.RemoveHandler(key)
-	h.tempClient.RemoveHandler(key)
-	h.diskClient.RemoveHandler(key)
+	for _, c := range h.monitorClients() {
+		c.RemoveHandler(key)
+	}
 }
 
 func (h *SSH) HasSSHListener(key string) bool {
-	return h.cpuInfoClient.hasHandler(key)
+	for _, c := range h.monitorClients() {
+		if c.hasHandler(key) {
+			return true
+		}
+	}
+	return false
 }
+
 func (h *SSH) HasRoughListener(key string) bool {
 	return h.roughClient.hasHandler(key)
 }
 
 func (h *SSH) Empty() bool {
-	return h.cpuInfoClient.LenListener()+h.roughClient.LenListener() <= 0
+	if h.pins.Len() > 0 {
+		return false
+	}
+	n := h.roughClient.LenListener()
+	for _, c := range h.monitorClients() {
+		n += c.LenListener()
+		h.observers.Each(func(key string, _ bool) {
+			if c.hasHandler(key) {
+				n--
+			}
+		})
+	}
+	return n <= 0
 }
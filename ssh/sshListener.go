@@ -11,4 +11,61 @@ type AllListener struct {
 	TempListener              Listener[TempMessage]
 	DiskListener              Listener[DiskMessage]
 	ProcessListener           Listener[ProcessMessage]
+	ConnectionStateListener   Listener[ConnectionStateMessage]
+	StatusListener            Listener[StatusMessage]
+	// Intervals 按事件名设置推送间隔, 单位秒, 没有设置的事件使用默认间隔
+	Intervals map[string]int
+}
+
+type RoughListener struct {
+	RoughListener           Listener[RoughMessage]
+	ConnectionStateListener Listener[ConnectionStateMessage]
+	StatusListener          Listener[StatusMessage]
+	// Interval 推送间隔, 单位秒, 为 0 时使用默认间隔
+	Interval int
+}
+
+// Events 可以拆成 Point 的事件, rough 由其他事件汇总得到, 不单独拆分
+var Events = []string{
+	"cpuInfo",
+	"cpuPerformance",
+	"memoryPerformance",
+	"uptime",
+	"loadavg",
+	"netDev",
+	"netStat",
+	"temp",
+	"disk",
+	"process",
+}
+
+// NewAllListener 不区分消息类型地监听 events 中的事件, f 收到事件名和消息
+func NewAllListener(events []string, f func(event string, message interface{}), intervals map[string]int) AllListener {
+	listeners := AllListener{Intervals: intervals}
+	for _, event := range events {
+		event := event
+		switch event {
+		case "cpuInfo":
+			listeners.CPUInfoListener = func(m CPUInfoMessage) { f(event, m) }
+		case "cpuPerformance":
+			listeners.CPUPerformanceListener = func(m CPUPerformanceMessage) { f(event, m) }
+		case "memoryPerformance":
+			listeners.MemoryPerformanceListener = func(m MemoryPerformanceMessage) { f(event, m) }
+		case "uptime":
+			listeners.UptimeListener = func(m UptimeMessage) { f(event, m) }
+		case "loadavg":
+			listeners.LoadavgListener = func(m LoadavgMessage) { f(event, m) }
+		case "netDev":
+			listeners.NetDevListener = func(m NetDevMessage) { f(event, m) }
+		case "netStat":
+			listeners.NetStatListener = func(m NetStatMessage) { f(event, m) }
+		case "temp":
+			listeners.TempListener = func(m TempMessage) { f(event, m) }
+		case "disk":
+			listeners.DiskListener = func(m DiskMessage) { f(event, m) }
+		case "process":
+			listeners.ProcessListener = func(m ProcessMessage) { f(event, m) }
+		}
+	}
+	return listeners
 }
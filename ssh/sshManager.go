@@ -14,37 +14,83 @@ func generalKey(port int, host, user string) string {
 	return fmt.Sprintf("%s@%s:%d", user, host, port)
 }
 
+// GeneralKey 与 SSH.Key 一致, 同一主机的多个用户共用
+func GeneralKey(port int, host, user string) string {
+	return generalKey(port, host, user)
+}
+
 type Manager struct {
-	clients mutexMap.MutexMap[*SSH]
-	mutexes mutexMap.MutexMap[*sync.Mutex]
+	clients   mutexMap.MutexMap[*SSH]
+	bastions  mutexMap.MutexMap[*bastion]
+	mutexes   mutexMap.MutexMap[*sync.Mutex]
+	observers mutexMap.MutexMap[Observer]
 }
 
 var M = newManager()
 
 func newManager() *Manager {
 	return &Manager{
-		clients: mutexMap.NewMutexMap[*SSH](0),
-		mutexes: mutexMap.NewMutexMap[*sync.Mutex](0),
+		clients:   mutexMap.NewMutexMap[*SSH](0),
+		bastions:  mutexMap.NewMutexMap[*bastion](0),
+		mutexes:   mutexMap.NewMutexMap[*sync.Mutex](0),
+		observers: mutexMap.NewMutexMap[Observer](0),
 	}
 }
 
-func (m *Manager) getSSH(port int, host, user, passwd string) (*SSH, error) {
+func (m *Manager) getSSH(port int, host, user string, auth Auth) (*SSH, error) {
 	key := generalKey(port, host, user)
 	c, ok := m.clients.Get(key)
 
 	if ok {
+		if err := c.checkHostKey(auth); err != nil {
+			return nil, err
+		}
+		if err := m.checkAuth(c, auth); err != nil {
+			return nil, err
+		}
 		return c, nil
 	}
-	c, err := newSSH(port, host, user, passwd)
+	connector := func() (*connection, error) {
+		return connect(port, host, user, func() (*ssh.Client, ssh.PublicKey, func(), error) {
+			return m.dial(port, host, user, auth)
+		})
+	}
+	if IsLocal(port, host, user) {
+		connector = connectLocal
+	}
+	c, err := newSSH(port, host, user, connector)
 	if err != nil {
 		return nil, err
 	}
+	c.authorized.Set(auth.digest(), true)
 	m.clients.Set(key, c)
-	c.startAllMonitor()
+	c.start()
+	m.observers.Each(func(key string, observer Observer) {
+		c.observe(key, observer)
+	})
 	logger.L.Debugf("ssh client create %s", c.Key)
 	return c, nil
 }
 
+// checkAuth 复用其他凭据建立的连接前用 auth 登录一次, 保存了主机但凭据错误的用户不能读取别人的连接
+func (m *Manager) checkAuth(h *SSH, auth Auth) error {
+	if IsLocal(h.Port, h.Host, h.User) {
+		return nil
+	}
+	digest := auth.digest()
+	if h.authorized.Has(digest) {
+		return nil
+	}
+	sshClient, _, release, err := m.dial(h.Port, h.Host, h.User, auth)
+	if err != nil {
+		return err
+	}
+	_ = sshClient.Close()
+	release()
+	h.authorized.Set(digest, true)
+	return nil
+}
+
 func (m *Manager) delayDeleteSSH(key string, client *SSH) {
 	client.closeTimer.Reset(client.closeDelay)
 	go func() {
@@ -60,12 +106,12 @@ func (m *Manager) delayDeleteSSH(key string, client *SSH) {
 	}()
 }
 
-func (m *Manager) RegisterSSHListener(port int, host, user, passwd, wsKey string, listeners AllListener) error {
+func (m *Manager) RegisterSSHListener(port int, host, user string, auth Auth, wsKey string, listeners AllListener) error {
 	key := generalKey(port, host, user)
 	mutex := m.mutexes.GetNilThenSet(key, &sync.Mutex{})
 	mutex.Lock()
 	defer mutex.Unlock()
-	s, err := m.getSSH(port, host, user, passwd)
+	s, err := m.getSSH(port, host, user, auth)
 	if err != nil {
 		return err
 	}
@@ -73,6 +119,20 @@ func (m *Manager) RegisterSSHListener(port int, host, user, passwd, wsKey string
 	return nil
 }
 
+// UpdateSSHListener 修改已有订阅的事件, 不重新连接
+func (m *Manager) UpdateSSHListener(port int, host, user string, wsKey string, listeners AllListener) error {
+	key := generalKey(port, host, user)
+	mutex := m.mutexes.GetNilThenSet(key, &sync.Mutex{})
+	mutex.Lock()
+	defer mutex.Unlock()
+	v, ok := m.clients.Get(key)
+	if !ok || !v.HasSSHListener(wsKey) {
+		return fmt.Errorf("ssh %s not monitored by %s", key, wsKey)
+	}
+	v.UpdateSSHListener(wsKey, listeners)
+	return nil
+}
+
 func (m *Manager) RemoveSSHListener(port int, host, user, wsKey string) {
 	key := generalKey(port, host, user)
 	mutex := m.mutexes.GetNilThenSet(key, &sync.Mutex{})
@@ -83,21 +143,25 @@ func (m *Manager) RemoveSSHListener(port int, host, user, wsKey string) {
 		return
 	}
 	v.RemoveSSHListener(wsKey)
+	if !v.HasRoughListener(wsKey) {
+		v.RemoveStateListener(wsKey)
+		v.RemoveStatusListener(wsKey)
+	}
 	if v.Empty() {
 		m.delayDeleteSSH(v.Key, v)
 	}
 }
 
-func (m *Manager) RegisterRoughListener(port int, host string, user string, passwd string, wsKey string, listener func(m RoughMessage)) error {
+func (m *Manager) RegisterRoughListener(port int, host string, user string, auth Auth, wsKey string, listeners RoughListener) error {
 	key := generalKey(port, host, user)
 	mutex := m.mutexes.GetNilThenSet(key, &sync.Mutex{})
 	mutex.Lock()
 	defer mutex.Unlock()
-	s, err := m.getSSH(port, host, user, passwd)
+	s, err := m.getSSH(port, host, user, auth)
 	if err != nil {
 		return err
 	}
-	s.RegisterRoughListener(wsKey, listener)
+	s.RegisterRoughListener(wsKey, listeners)
 	return nil
 }
 
@@ -111,6 +175,10 @@ func (m *Manager) RemoveRoughListener(port int, host string, user string, wsKey
 		return
 	}
 	v.RemoveRoughListener(wsKey)
+	if !v.HasSSHListener(wsKey) {
+		v.RemoveStateListener(wsKey)
+		v.RemoveStatusListener(wsKey)
+	}
 	if v.Empty() {
 		m.delayDeleteSSH(v.Key, v)
 	}
@@ -124,6 +192,8 @@ func (m *Manager) ClearListener(wsKey string) {
 			defer mutex.Unlock()
 			v.RemoveSSHListener(wsKey)
 			v.RemoveRoughListener(wsKey)
+			v.RemoveStateListener(wsKey)
+			v.RemoveStatusListener(wsKey)
 			m.delayDeleteSSH(v.Key, v)
 			logger.L.Debugf("done clear die wsocket handler in ssh %s", v.Key)
 		}
@@ -162,16 +232,24 @@ func (w myReader) Read(p []byte) (int, error) {
 	return len(data), nil
 }
 
-func (m *Manager) NewSSHClientWithConn(port int, host string, user string, passwd string, conn *websocket.Conn, mutex *sync.Mutex) (bool, error) {
-	c, err := newSimpleSSH(port, host, user, passwd)
+func (m *Manager) NewSSHClientWithConn(port int, host string, user string, auth Auth, conn *websocket.Conn, mutex *sync.Mutex) (bool, error) {
+	if IsLocal(port, host, user) {
+		return false, errLocalTerminal
+	}
+	c, _, release, err := m.dial(port, host, user, auth)
 	if err != nil {
 		logger.L.Debugf("new client fail : %v", err)
 		return false, err
 	}
+	fail := func() {
+		_ = c.Close()
+		release()
+	}
 
 	session, err := c.NewSession()
 	if err != nil {
 		logger.L.Debugf("new session fail : %v", err)
+		fail()
 		return false, err
 	}
 
@@ -194,12 +272,14 @@ func (m *Manager) NewSSHClientWithConn(port int, host string, user string, passw
 	// 请求伪终端
 	if err = session.RequestPty("linux", 32, 160, modes); err != nil {
 		logger.L.Debugf("request pty error: %s", err.Error())
+		fail()
 		return false, err
 	}
 
 	//启动远程shell
 	if err = session.Shell(); err != nil {
 		logger.L.Debugf("start shell error: %s", err.Error())
+		fail()
 		return false, err
 	}
 	go func() {
@@ -213,6 +293,7 @@ func (m *Manager) NewSSHClientWithConn(port int, host string, user string, passw
 		if err := c.Close(); err != nil {
 			logger.L.Debugf("close error: %s", err.Error())
 		}
+		release()
 		if err := conn.Close(); err != nil {
 			logger.L.Debugf("close error: %s", err.Error())
 		}
@@ -0,0 +1,11 @@
+package ssh
+
+import "syscall"
+
+func statFS(name string) (FSStat, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(name, &stat); err != nil {
+		return FSStat{}, err
+	}
+	return FSStat{Blocks: stat.Blocks, Bfree: stat.Bfree, Bsize: uint64(stat.Bsize)}, nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package ssh
+
+import (
+	"errors"
+	"io/fs"
+)
+
+func statFS(name string) (FSStat, error) {
+	return FSStat{}, &fs.PathError{Op: "statfs", Path: name, Err: errors.New("not supported")}
+}
@@ -0,0 +1,102 @@
+package ssh
+
+import (
+	"sync"
+	"time"
+)
+
+// status 连接和各项采集的健康状态, 随 keepalive 定时作为 status 事件推送
+type status struct {
+	mutex       sync.Mutex
+	connectTime time.Time
+	rtt         time.Duration
+	lastError   string
+	metrics     map[string]*MetricStatus
+}
+
+func newStatus() *status {
+	return &status{
+		connectTime: time.Now(),
+		metrics:     make(map[string]*MetricStatus),
+	}
+}
+
+func (s *status) metric(name string) *MetricStatus {
+	m, ok := s.metrics[name]
+	if !ok {
+		m = &MetricStatus{}
+		s.metrics[name] = m
+	}
+	return m
+}
+
+func (s *status) success(name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	m := s.metric(name)
+	m.LastSuccess = time.Now()
+	m.ConsecutiveFailures = 0
+}
+
+func (s *status) fail(name string, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	m := s.metric(name)
+	m.ConsecutiveFailures++
+	m.LastError = err.Error()
+	s.lastError = name + " : " + err.Error()
+}
+
+func (s *status) connected() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.connectTime = time.Now()
+}
+
+func (s *status) setRTT(rtt time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.rtt = rtt
+}
+
+func (s *status) setError(errText string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.lastError = errText
+}
+
+func (h *SSH) statusMessage() StatusMessage {
+	h.stateMutex.Lock()
+	state := h.state.State
+	h.stateMutex.Unlock()
+	h.status.mutex.Lock()
+	defer h.status.mutex.Unlock()
+	metrics := make(map[string]MetricStatus, len(h.status.metrics))
+	for name, m := range h.status.metrics {
+		metrics[name] = *m
+	}
+	return StatusMessage{
+		Message:     Message{Port: h.Port, Host: h.Host, User: h.User},
+		State:       state,
+		ConnectTime: h.status.connectTime,
+		RTT:         float64(h.status.rtt.Microseconds()) / 1000,
+		LastError:   h.status.lastError,
+		Metrics:     metrics,
+	}
+}
+
+func (h *SSH) pushStatus() {
+	if h.statusClient.LenListener() > 0 {
+		h.statusClient.Handler(h.statusMessage())
+	}
+}
+
+// RegisterStatusListener 注册后立即收到当前状态
+func (h *SSH) RegisterStatusListener(key string, listener Listener[StatusMessage]) {
+	h.statusClient.RegisterHandler(key, listener, 0)
+	listener(h.statusMessage())
+}
+
+func (h *SSH) RemoveStatusListener(key string) {
+	h.statusClient.RemoveHandler(key)
+}
@@ -0,0 +1,47 @@
+#!/bin/sh
+# 在目标主机上录制解析器用到的 /proc 和 /sys 快照, 用法: record.sh <输出目录>
+# 录制两次, 间隔 2 秒, 与 parse_test.go 中的采样时钟一致, 然后执行 go test -run TestParseGolden -update 生成期望输出
+set -e
+out=$1
+if [ -z "$out" ]; then
+	echo "usage: $0 <dir>" >&2
+	exit 1
+fi
+
+sample() {
+	dir=$out/$1
+	mkdir -p "$dir/proc/net" "$dir/sys/devices/virtual/net"
+	for f in cpuinfo stat meminfo uptime loadavg mounts diskstats net/dev net/snmp net/route net/fib_trie; do
+		cat "/proc/$f" > "$dir/proc/$f"
+	done
+	for d in /proc/[0-9]*; do
+		mkdir -p "$dir$d"
+		# 进程可能已经退出
+		{ cat "$d/stat" > "$dir$d/stat" && cat "$d/statm" > "$dir$d/statm"; } 2>/dev/null || rm -rf "${dir:?}$d"
+	done
+	for z in /sys/class/thermal/thermal_zone*; do
+		[ -f "$z/temp" ] || continue
+		mkdir -p "$dir$z"
+		cat "$z/temp" > "$dir$z/temp"
+	done
+	# LVM 等设备在 mounts 中的名字
+	for b in /sys/block/dm-*; do
+		[ -f "$b/dm/name" ] || continue
+		mkdir -p "$dir$b/dm"
+		cat "$b/dm/name" > "$dir$b/dm/name"
+	done
+	# 只需要虚拟网卡的名字
+	for n in /sys/devices/virtual/net/*; do
+		[ -e "$n" ] || continue
+		: > "$dir$n"
+	done
+}
+
+sample sample1
+sleep 2
+sample sample2
+
+# 每行: 挂载点 总块数 空闲块数 块大小
+awk '{print $2}' /proc/mounts | sort -u | while read -r m; do
+	stat -f -c "$m %b %f %s" "$m" 2>/dev/null || true
+done > "$out/statfs"
@@ -9,14 +9,35 @@ import (
 	"regexp"
 	"ssh"
 	"sync"
+	"time"
+	"wsocket"
 )
 
 var wsUpgrader = websocket.Upgrader{
 	ReadBufferSize:  4096,
 	WriteBufferSize: 4096,
+	Subprotocols:    []string{wsocket.Subprotocol},
 }
 
-func handleNewSSHConnect(w http.ResponseWriter, r *http.Request) {
+func sshResponseErrorHelper(conn *websocket.Conn, id string, code int, errText string) {
+	logger.L.Debugf(errText)
+	wsResponse := &WSResponse{
+		ResponseHead: ResponseHead{
+			Id: id,
+			Error: &ResponseError{
+				Code:    code,
+				Message: errText,
+			},
+		},
+		Result: nil,
+	}
+	if wsResponseBytes, ok := messageJsonStringifyHelper(wsResponse); ok {
+		_ = conn.WriteMessage(websocket.TextMessage, wsResponseBytes)
+	}
+}
+
+// handleNewSSHConnect username 为升级前认证的用户, 为空时第一帧必须是 auth 消息
+func handleNewSSHConnect(w http.ResponseWriter, r *http.Request, username string) {
 	conn, err := wsUpgrader.Upgrade(w, r, nil)
 	id := uuid.New()
 	key := fmt.Sprintf("%s:%s", conn.RemoteAddr().String(), id.String())
@@ -25,18 +46,25 @@ func handleNewSSHConnect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	logger.L.Debugf("websocket connected from : %s", key)
-
-	mt, message, err := conn.ReadMessage()
-	if err != nil {
-		logger.L.Debugf("websocket %s error: %v", key, err)
-		return
+	// 与 /monitor 一样, authTimeout 内没有完成认证的连接关闭
+	if username == "" {
+		_ = conn.SetReadDeadline(time.Now().Add(authTimeout))
 	}
-	switch mt {
-	case websocket.TextMessage:
+
+	for {
+		mt, message, err := conn.ReadMessage()
+		if err != nil {
+			logger.L.Debugf("websocket %s error: %v", key, err)
+			_ = conn.Close()
+			return
+		}
+		if mt != websocket.TextMessage {
+			continue
+		}
 		logger.L.Debugf("websocket %s recv : %s", key, message)
 		wsRequest := &WSRequest{}
-		err := json.Unmarshal(message, wsRequest)
-		if err != nil || wsRequest.Method != "ssh.startSSH" {
+		err = json.Unmarshal(message, wsRequest)
+		if err != nil || wsRequest.Id == nil || (wsRequest.Method != "ssh.startSSH" && wsRequest.Method != "auth") {
 			errText := fmt.Sprintf("Json parse fail : %v", err)
 			logger.L.Debugf(errText)
 			idReg := regexp.MustCompile(`"id":"([^)]+)"`)
@@ -48,81 +76,97 @@ func handleNewSSHConnect(w http.ResponseWriter, r *http.Request) {
 				logger.L.Debugf("parse id fail")
 				return
 			}
-			wsResponse := &WSResponse{
-				ResponseHead: ResponseHead{
-					Id: string(idRegResults[0][1]),
-					Error: &ResponseError{
-						Code:    400,
-						Message: errText,
-					},
-				},
-				Result: nil,
-			}
-			if wsResponseBytes, ok := messageJsonStringifyHelper(wsResponse); ok {
-				_ = conn.WriteMessage(websocket.TextMessage, wsResponseBytes)
-			}
+			sshResponseErrorHelper(conn, string(idRegResults[0][1]), 400, errText)
 			return
 		}
 
 		id := *wsRequest.Id
-		wsStartSSHRequest := &WSStartSSHRequest{}
-		err = json.Unmarshal(message, wsStartSSHRequest)
-		if err != nil {
-			errText := fmt.Sprintf("Json parse fail : %v", err)
-			logger.L.Debugf(errText)
-			wsResponse := &WSResponse{
-				ResponseHead: ResponseHead{
-					Id: id,
-					Error: &ResponseError{
-						Code:    400,
-						Message: errText,
-					},
-				},
-				Result: nil,
-			}
-			if wsResponseBytes, ok := messageJsonStringifyHelper(wsResponse); ok {
-				_ = conn.WriteMessage(websocket.TextMessage, wsResponseBytes)
-			}
-			return
-		} else if err := valid.Struct(wsStartSSHRequest); err != nil {
-			errText := fmt.Sprintf("message validate fail : %v", err)
-			logger.L.Debugf(errText)
-			wsResponse := &WSResponse{
-				ResponseHead: ResponseHead{
-					Id: id,
-					Error: &ResponseError{
-						Code:    400,
-						Message: errText,
-					},
-				},
-				Result: nil,
-			}
-			if wsResponseBytes, ok := messageJsonStringifyHelper(wsResponse); ok {
-				_ = conn.WriteMessage(websocket.TextMessage, wsResponseBytes)
+		if wsRequest.Method == "auth" {
+			authName, ok := handleSSHAuth(conn, id, message, username)
+			if !ok {
+				return
 			}
-			return
+			username = authName
+			_ = conn.SetReadDeadline(time.Time{})
+			continue
 		}
-		wsStartSSHResponse := &WSStartSSHResponse{
-			ResponseHead: ResponseHead{
-				Id:    *wsStartSSHRequest.Id,
-				Error: nil,
-			},
-			Result: make([]bool, 0),
-		}
-		m := &sync.Mutex{}
-		res, err := ssh.M.NewSSHClientWithConn(wsStartSSHRequest.Params[0].Port, wsStartSSHRequest.Params[0].Host, wsStartSSHRequest.Params[0].User, wsStartSSHRequest.Params[0].Passwd, conn, m)
-		if !res || err != nil {
-			wsStartSSHResponse.Error = &ResponseError{
-				Code:    400,
-				Message: err.Error(),
-			}
-		} else {
-			wsStartSSHResponse.Result = append(wsStartSSHResponse.Result, res)
+		if username == "" {
+			sshResponseErrorHelper(conn, id, 401, fmt.Sprintf("%s unauthenticated, send auth first", key))
+			return
 		}
+		handleStartSSH(conn, id, message, username)
+		return
+	}
+}
+
+func handleSSHAuth(conn *websocket.Conn, id string, message []byte, username string) (string, bool) {
+	wsAuthRequest := &WSAuthRequest{}
+	if err := json.Unmarshal(message, wsAuthRequest); err != nil {
+		sshResponseErrorHelper(conn, id, 400, fmt.Sprintf("Json parse fail : %v", err))
+		return "", false
+	} else if err := valid.Struct(wsAuthRequest); err != nil {
+		sshResponseErrorHelper(conn, id, 400, fmt.Sprintf("message validate fail : %v", err))
+		return "", false
+	}
+	authName, err := parseToken(wsAuthRequest.Params.Token)
+	if err != nil {
+		sshResponseErrorHelper(conn, id, 401, err.Error())
+		return "", false
+	}
+	if username != "" && username != authName {
+		sshResponseErrorHelper(conn, id, 403, fmt.Sprintf("already authenticated as %s", username))
+		return "", false
+	}
+	wsAuthResponse := &WSAuthResponse{
+		ResponseHead: ResponseHead{
+			Id:    id,
+			Error: nil,
+		},
+		Result: true,
+	}
+	if wsResponseBytes, ok := messageJsonStringifyHelper(wsAuthResponse); ok {
+		_ = conn.WriteMessage(websocket.TextMessage, wsResponseBytes)
+	}
+	return authName, true
+}
+
+func handleStartSSH(conn *websocket.Conn, id string, message []byte, username string) {
+	wsStartSSHRequest := &WSStartSSHRequest{}
+	err := json.Unmarshal(message, wsStartSSHRequest)
+	if err != nil {
+		sshResponseErrorHelper(conn, id, 400, fmt.Sprintf("Json parse fail : %v", err))
+		return
+	} else if err := valid.Struct(wsStartSSHRequest); err != nil {
+		sshResponseErrorHelper(conn, id, 400, fmt.Sprintf("message validate fail : %v", err))
+		return
+	}
+	wsStartSSHResponse := &WSStartSSHResponse{
+		ResponseHead: ResponseHead{
+			Id:    *wsStartSSHRequest.Id,
+			Error: nil,
+		},
+		Result: make([]bool, 0),
+	}
+	p := wsStartSSHRequest.Params[0]
+	userSSH, auth, resErr := resolveUserSSH(username, p.Key, p.Port, p.Host, p.User)
+	if resErr != nil {
+		wsStartSSHResponse.Error = resErr
 		if wsResponseBytes, ok := messageJsonStringifyHelper(wsStartSSHResponse); ok {
-			m.Lock()
 			_ = conn.WriteMessage(websocket.TextMessage, wsResponseBytes)
-			m.Unlock()
 		}
+		return
+	}
+	m := &sync.Mutex{}
+	res, err := ssh.M.NewSSHClientWithConn(userSSH.Port, userSSH.Host, userSSH.User, auth, conn, m)
+	if !res || err != nil {
+		wsStartSSHResponse.Error = connectErrorHelper(err)
+	} else {
+		verifiedHelper(userSSH)
+		wsStartSSHResponse.Result = append(wsStartSSHResponse.Result, res)
+	}
+	if wsResponseBytes, ok := messageJsonStringifyHelper(wsStartSSHResponse); ok {
+		m.Lock()
+		_ = conn.WriteMessage(websocket.TextMessage, wsResponseBytes)
+		m.Unlock()
 	}
 }
@@ -1,13 +1,16 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	jsoniter "github.com/json-iterator/go"
 	"logger"
+	"mongoDB"
 	"regexp"
 	"ssh"
 	"strings"
 	"sync"
+	"time"
 	"wsocket"
 )
 
@@ -23,32 +26,44 @@ type WSRequest struct {
 	Params interface{} `json:"params"`
 }
 
+type WSAuthRequest struct {
+	RequestHead
+	Params struct {
+		Token string `json:"token" validate:"required"`
+	} `json:"params"`
+}
+
 type WSMonitorSSHRequest struct {
 	RequestHead
 	Params []struct {
-		Port   int    `json:"port"`
-		Host   string `json:"host" validate:"required"`
-		User   string `json:"user" validate:"required"`
-		Passwd string `json:"passwd" validate:"required"`
+		Key  string `json:"key"`
+		Port int    `json:"port"`
+		Host string `json:"host" validate:"required_without=Key"`
+		User string `json:"user" validate:"required_without=Key"`
+		// Events 为空时订阅全部事件, 只用于 ssh.startMonitor 和 ssh.updateSubscription
+		Events []string `json:"events" validate:"omitempty,dive,oneof=cpuInfo cpuPerformance memoryPerformance uptime loadavg netDev netStat temp disk process"`
+		// Intervals 事件的推送间隔, 单位秒, 优先于保存的 ssh 和 conf.toml 中的间隔
+		Intervals map[string]int `json:"intervals" validate:"omitempty,dive,keys,oneof=cpuInfo cpuPerformance memoryPerformance uptime loadavg netDev netStat temp disk process rough,endkeys,min=1"`
 	} `json:"params" validate:"required,dive"`
 }
 
 type WSUnMonitorSSHRequest struct {
 	RequestHead
 	Params []struct {
-		Port int    `json:"port" validate:"required"`
-		Host string `json:"host" validate:"required"`
-		User string `json:"user" validate:"required"`
+		Key  string `json:"key"`
+		Port int    `json:"port" validate:"min=0"`
+		Host string `json:"host" validate:"required_without=Key"`
+		User string `json:"user" validate:"required_without=Key"`
 	} `json:"params" validate:"required,dive"`
 }
 
 type WSStartSSHRequest struct {
 	RequestHead
 	Params []struct {
-		Port   int    `json:"port" validate:"required"`
-		Host   string `json:"host" validate:"required"`
-		User   string `json:"user" validate:"required"`
-		Passwd string `json:"passwd" validate:"required"`
+		Key  string `json:"key"`
+		Port int    `json:"port" validate:"required_without=Key"`
+		Host string `json:"host" validate:"required_without=Key"`
+		User string `json:"user" validate:"required_without=Key"`
 	} `json:"params" validate:"required,dive"`
 }
 
@@ -75,15 +90,21 @@ type WSResponse struct {
 	Result interface{} `json:"result"`
 }
 
+type WSAuthResponse struct {
+	ResponseHead
+	Result bool `json:"result"`
+}
+
 type WSMonitorSSHResponse struct {
 	ResponseHead
 	Result []WSMonitorSSHResponseResult `json:"result" validate:"dive"`
 }
 
 type WSMonitorSSHResponseResult struct {
-	Port    int            `json:"port" validate:"required"`
-	Host    string         `json:"host" validate:"required"`
-	User    string         `json:"user" validate:"required"`
+	Key     string         `json:"key"`
+	Port    int            `json:"port"`
+	Host    string         `json:"host" validate:"required_without=Key"`
+	User    string         `json:"user" validate:"required_without=Key"`
 	Monitor bool           `json:"monitor"`
 	Error   *ResponseError `json:"error"`
 }
@@ -94,9 +115,10 @@ type WSUnMonitorSSHResponse struct {
 }
 
 type WSUnMonitorSSHResponseResult struct {
-	Port      int            `json:"port" validate:"required"`
-	Host      string         `json:"host" validate:"required"`
-	User      string         `json:"user" validate:"required"`
+	Key       string         `json:"key"`
+	Port      int            `json:"port"`
+	Host      string         `json:"host" validate:"required_without=Key"`
+	User      string         `json:"user" validate:"required_without=Key"`
 	UnMonitor bool           `json:"unMonitor"`
 	Error     *ResponseError `json:"error"`
 }
@@ -130,19 +152,265 @@ func listenerTemplate[M any](conn *wsocket.Connect, event string) func(m M) {
 	}
 }
 
-func getSSHListener(conn *wsocket.Connect) ssh.AllListener {
+// mergeIntervals 订阅时指定的间隔优先于保存的 ssh 的间隔
+func mergeIntervals(userSSH *mongoDB.UserSSH, intervals map[string]int) map[string]int {
+	r := make(map[string]int, len(userSSH.Intervals)+len(intervals))
+	for event, second := range userSSH.Intervals {
+		r[event] = second
+	}
+	for event, second := range intervals {
+		r[event] = second
+	}
+	return r
+}
+
+// getSSHListener events 为空时订阅全部事件, 连接状态和 status 事件总是推送
+func getSSHListener(conn *wsocket.Connect, events []string, intervals map[string]int) ssh.AllListener {
+	selected := func(event string) bool {
+		if len(events) == 0 {
+			return true
+		}
+		for _, e := range events {
+			if e == event {
+				return true
+			}
+		}
+		return false
+	}
+	listeners := ssh.AllListener{
+		ConnectionStateListener: listenerTemplate[ssh.ConnectionStateMessage](conn, "connectionState"),
+		StatusListener:          listenerTemplate[ssh.StatusMessage](conn, "status"),
+		Intervals:               intervals,
+	}
+	if selected("cpuInfo") {
+		listeners.CPUInfoListener = listenerTemplate[ssh.CPUInfoMessage](conn, "cpuInfo")
+	}
+	if selected("cpuPerformance") {
+		listeners.CPUPerformanceListener = listenerTemplate[ssh.CPUPerformanceMessage](conn, "cpuPerformance")
+	}
+	if selected("memoryPerformance") {
+		listeners.MemoryPerformanceListener = listenerTemplate[ssh.MemoryPerformanceMessage](conn, "memoryPerformance")
+	}
+	if selected("uptime") {
+		listeners.UptimeListener = listenerTemplate[ssh.UptimeMessage](conn, "uptime")
+	}
+	if selected("loadavg") {
+		listeners.LoadavgListener = listenerTemplate[ssh.LoadavgMessage](conn, "loadavg")
+	}
+	if selected("netDev") {
+		listeners.NetDevListener = listenerTemplate[ssh.NetDevMessage](conn, "netDev")
+	}
+	if selected("netStat") {
+		listeners.NetStatListener = listenerTemplate[ssh.NetStatMessage](conn, "netStat")
+	}
+	if selected("temp") {
+		listeners.TempListener = listenerTemplate[ssh.TempMessage](conn, "temp")
+	}
+	if selected("disk") {
+		listeners.DiskListener = listenerTemplate[ssh.DiskMessage](conn, "disk")
+	}
+	if selected("process") {
+		listeners.ProcessListener = listenerTemplate[ssh.ProcessMessage](conn, "process")
+	}
+	return listeners
+}
+
+func getRoughListener(conn *wsocket.Connect, interval int) ssh.RoughListener {
+	return ssh.RoughListener{
+		Interval:                interval,
+		RoughListener:           listenerTemplate[ssh.RoughMessage](conn, "rough"),
+		ConnectionStateListener: listenerTemplate[ssh.ConnectionStateMessage](conn, "connectionState"),
+		StatusListener:          listenerTemplate[ssh.StatusMessage](conn, "status"),
+	}
+}
+
+// authTimeout 内没有完成认证的 websocket 会被关闭
+const authTimeout = 10 * time.Second
+
+func authTimeoutHandler(conn *wsocket.Connect) {
+	if conn.User() != "" {
+		return
+	}
+	time.AfterFunc(authTimeout, func() {
+		if conn.User() == "" {
+			logger.L.Debugf("%s auth timeout", conn.Key)
+			conn.Close()
+		}
+	})
+}
+
+// resolveUserSSH 按 key 或 port/host/user 找到已认证用户保存的 ssh, 连接凭据只在服务端使用
+func resolveUserSSH(username string, key string, port int, host string, user string) (*mongoDB.UserSSH, ssh.Auth, *ResponseError) {
+	if key == ssh.LocalKey || key == "" && ssh.IsLocal(port, host, user) {
+		return resolveLocal(username)
+	}
+	if key == "" {
+		key = mongoDB.GeneralSSHId(mongoDB.UserSSH{UserName: username, Port: port, Host: host, User: user})
+	}
+	userSSH, err := mongoDB.Client.GetUserSSH(key)
+	if err != nil || userSSH.UserName != username {
+		logger.L.Debugf("resolve user ssh %s fail : %v", key, err)
+		return nil, ssh.Auth{}, &ResponseError{
+			Code:    403,
+			Message: fmt.Sprintf("ssh %s not belong to user %s", key, username),
+		}
+	}
+	auth := sshAuth(userSSH)
+	if auth.ProxyJump, err = proxyJumpHops(userSSH); err != nil {
+		return nil, ssh.Auth{}, &ResponseError{
+			Code:    400,
+			Message: err.Error(),
+		}
+	}
+	return userSSH, auth, nil
+}
+
+// verifiedHelper 保存的凭据登录成功后标记为已验证, 只有已验证的 ssh 可以读取对应主机的历史数据
+func verifiedHelper(userSSH *mongoDB.UserSSH) {
+	if userSSH.Verified || userSSH.Key == ssh.LocalKey {
+		return
+	}
+	if err := mongoDB.Client.SetUserSSHVerified(userSSH.Key, userSSH.UpdateTime); err != nil {
+		logger.L.Warnf("%v", err)
+		return
+	}
+	userSSH.Verified = true
+}
+
+// resolveLocal 本机伪主机没有保存的 ssh 和凭据, 由 conf.toml 的 monitor.Local 控制哪些用户可以监控
+func resolveLocal(username string) (*mongoDB.UserSSH, ssh.Auth, *ResponseError) {
+	if !ssh.LocalAllowed(username) {
+		return nil, ssh.Auth{}, &ResponseError{
+			Code:    403,
+			Message: fmt.Sprintf("ssh %s not belong to user %s", ssh.LocalKey, username),
+		}
+	}
+	return &mongoDB.UserSSH{
+		Key:      ssh.LocalKey,
+		UserName: username,
+		Port:     ssh.LocalPort,
+		Host:     ssh.LocalHost,
+		User:     ssh.LocalUser,
+	}, ssh.Auth{}, nil
+}
+
+// unMonitorHelper 与开始监控一样按 key 或 port/host/user 找到 ssh, 只取消 conn 自己的监听,
+// 监控期间删除的 ssh 按请求中的 port/host/user 取消
+func unMonitorHelper(conn *wsocket.Connect, key string, port int, host string, user string, remove func(port int, host, user, wsKey string)) WSUnMonitorSSHResponseResult {
+	result := WSUnMonitorSSHResponseResult{
+		Key:  key,
+		Port: port,
+		Host: host,
+		User: user,
+	}
+	userSSH, _, resErr := resolveUserSSH(conn.User(), key, port, host, user)
+	if resErr != nil && key != "" {
+		result.UnMonitor = false
+		result.Error = resErr
+		return result
+	}
+	if resErr == nil {
+		result.Key, result.Port, result.Host, result.User = userSSH.Key, userSSH.Port, userSSH.Host, userSSH.User
+	}
+	remove(result.Port, result.Host, result.User, conn.Key)
+	result.UnMonitor = true
+	return result
+}
+
+func sshAuth(userSSH *mongoDB.UserSSH) ssh.Auth {
+	return ssh.Auth{
+		Passwd:      userSSH.Passwd,
+		PrivateKey:  userSSH.PrivateKey,
+		Passphrase:  userSSH.Passphrase,
+		Certificate: userSSH.Certificate,
+		KnownHosts:  userKnownHosts{username: userSSH.UserName},
+	}
+}
+
+// proxyJumpHops 展开 ProxyJump 引用的跳板机, 跳板机自己的 ProxyJump 排在它前面
+func proxyJumpHops(userSSH *mongoDB.UserSSH) ([]ssh.Hop, error) {
+	return appendProxyJumpHops(nil, userSSH, map[string]bool{mongoDB.GeneralSSHId(*userSSH): true})
+}
+
+func appendProxyJumpHops(hops []ssh.Hop, userSSH *mongoDB.UserSSH, visited map[string]bool) ([]ssh.Hop, error) {
+	for _, key := range userSSH.ProxyJump {
+		if visited[key] {
+			return nil, fmt.Errorf("proxy jump %s of %s repeated", key, mongoDB.GeneralSSHId(*userSSH))
+		}
+		visited[key] = true
+		jump, err := mongoDB.Client.GetUserSSH(key)
+		if err != nil || jump.UserName != userSSH.UserName {
+			return nil, fmt.Errorf("proxy jump %s not belong to user %s", key, userSSH.UserName)
+		}
+		if hops, err = appendProxyJumpHops(hops, jump, visited); err != nil {
+			return nil, err
+		}
+		hops = append(hops, ssh.Hop{
+			Port: jump.Port,
+			Host: jump.Host,
+			User: jump.User,
+			Auth: sshAuth(jump),
+		})
+	}
+	return hops, nil
+}
+
+// userKnownHosts 每个用户各自信任主机公钥
+type userKnownHosts struct {
+	username string
+}
+
+func (k userKnownHosts) KnownHost(host string, port int) (string, error) {
+	knownHost, err := mongoDB.Client.GetKnownHost(mongoDB.GeneralKnownHostId(k.username, host, port))
+	if err != nil || knownHost == nil {
+		return "", err
+	}
+	return knownHost.PublicKey, nil
+}
+
+func (k userKnownHosts) Trust(host string, port int, publicKey string, fingerprint string) error {
+	logger.L.Infof("user %s trust host key %s:%d %s", k.username, host, port, fingerprint)
+	return mongoDB.Client.InsertKnownHost(mongoDB.KnownHost{
+		UserName:    k.username,
+		Host:        host,
+		Port:        port,
+		PublicKey:   publicKey,
+		Fingerprint: fingerprint,
+	})
+}
+
+func (k userKnownHosts) Reject(host string, port int, publicKey string, fingerprint string) error {
+	logger.L.Warnf("user %s reject changed host key %s:%d %s", k.username, host, port, fingerprint)
+	return mongoDB.Client.PendingKnownHost(mongoDB.GeneralKnownHostId(k.username, host, port), publicKey, fingerprint)
+}
 
-	return ssh.AllListener{
-		CPUInfoListener:           listenerTemplate[ssh.CPUInfoMessage](conn, "cpuInfo"),
-		CPUPerformanceListener:    listenerTemplate[ssh.CPUPerformanceMessage](conn, "cpuPerformance"),
-		MemoryPerformanceListener: listenerTemplate[ssh.MemoryPerformanceMessage](conn, "memoryPerformance"),
-		UptimeListener:            listenerTemplate[ssh.UptimeMessage](conn, "uptime"),
-		LoadavgListener:           listenerTemplate[ssh.LoadavgMessage](conn, "loadavg"),
-		NetDevListener:            listenerTemplate[ssh.NetDevMessage](conn, "netDev"),
-		NetStatListener:           listenerTemplate[ssh.NetStatMessage](conn, "netStat"),
-		TempListener:              listenerTemplate[ssh.TempMessage](conn, "temp"),
-		DiskListener:              listenerTemplate[ssh.DiskMessage](conn, "disk"),
-		ProcessListener:           listenerTemplate[ssh.ProcessMessage](conn, "process"),
+// connectErrorHelper 主机公钥变化返回 409, 需要用户确认新公钥后重试
+func connectErrorHelper(err error) *ResponseError {
+	code := 400
+	var hostKeyErr *ssh.HostKeyError
+	if errors.As(err, &hostKeyErr) {
+		code = 409
+	}
+	return &ResponseError{
+		Code:    code,
+		Message: err.Error(),
+	}
+}
+
+func responseErrorHelper(id string, conn *wsocket.Connect, code int, errText string) {
+	logger.L.Debugf(errText)
+	wsResponse := &WSResponse{
+		ResponseHead: ResponseHead{
+			Id: id,
+			Error: &ResponseError{
+				Code:    code,
+				Message: errText,
+			},
+		},
+		Result: nil,
+	}
+	if wsResponseBytes, ok := messageJsonStringifyHelper(wsResponse); ok {
+		conn.WriteMessage(wsResponseBytes)
 	}
 }
 
@@ -250,6 +518,14 @@ func handleRequest(conn *wsocket.Connect, msg []byte) {
 	if !ok {
 		return
 	}
+	if method == "auth" {
+		handleAuth(id, conn, msg)
+		return
+	}
+	if conn.User() == "" {
+		responseErrorHelper(id, conn, 401, fmt.Sprintf("%s unauthenticated, send auth first", conn.Key))
+		return
+	}
 	switch method {
 	case "ssh.startRoughMonitor":
 		logger.L.Debugf("%s handle ssh.startMonitior", conn.Key)
@@ -269,22 +545,26 @@ func handleRequest(conn *wsocket.Connect, msg []byte) {
 
 		for _, p := range wsMonitorSSHRequest.Params {
 			wg.Add(1)
-			go func(port int, host string, user string, passwd string) {
-				err := ssh.M.RegisterRoughListener(port, host, user, passwd, conn.Key, listenerTemplate[ssh.RoughMessage](conn, "rough"))
+			go func(key string, port int, host string, user string, intervals map[string]int) {
 				result := WSMonitorSSHResponseResult{
+					Key:  key,
 					Port: port,
 					Host: host,
 					User: user,
 				}
-				if err == nil {
-					result.Monitor = true
-					result.Error = nil
-				} else {
-					errText := err.Error()
+				userSSH, auth, resErr := resolveUserSSH(conn.User(), key, port, host, user)
+				if resErr != nil {
 					result.Monitor = false
-					result.Error = &ResponseError{
-						Code:    400,
-						Message: errText,
+					result.Error = resErr
+				} else {
+					result.Key, result.Port, result.Host, result.User = userSSH.Key, userSSH.Port, userSSH.Host, userSSH.User
+					if err := ssh.M.RegisterRoughListener(userSSH.Port, userSSH.Host, userSSH.User, auth, conn.Key, getRoughListener(conn, mergeIntervals(userSSH, intervals)["rough"])); err != nil {
+						result.Monitor = false
+						result.Error = connectErrorHelper(err)
+					} else {
+						verifiedHelper(userSSH)
+						result.Monitor = true
+						result.Error = nil
 					}
 				}
 				m.Lock()
@@ -292,7 +572,7 @@ func handleRequest(conn *wsocket.Connect, msg []byte) {
 				m.Unlock()
 				wg.Done()
 				logger.L.Debugf("rough done %d %s %s", port, host, user)
-			}(p.Port, p.Host, p.User, p.Passwd)
+			}(p.Key, p.Port, p.Host, p.User, p.Intervals)
 		}
 		wg.Wait()
 		if wsResponseBytes, ok := messageJsonStringifyHelper(wsMonitorSSHResponse); ok {
@@ -313,14 +593,7 @@ func handleRequest(conn *wsocket.Connect, msg []byte) {
 			Result: make([]WSUnMonitorSSHResponseResult, 0),
 		}
 		for _, p := range wsUnMonitorSSHRequest.Params {
-			ssh.M.RemoveRoughListener(p.Port, p.Host, p.User, conn.Key)
-			result := WSUnMonitorSSHResponseResult{
-				Port:      p.Port,
-				Host:      p.Host,
-				User:      p.User,
-				UnMonitor: true,
-				Error:     nil,
-			}
+			result := unMonitorHelper(conn, p.Key, p.Port, p.Host, p.User, ssh.M.RemoveRoughListener)
 			wsUnMonitorSSHResponse.Result = append(wsUnMonitorSSHResponse.Result, result)
 		}
 		if wsResponseBytes, ok := messageJsonStringifyHelper(wsUnMonitorSSHResponse); ok {
@@ -345,22 +618,26 @@ func handleRequest(conn *wsocket.Connect, msg []byte) {
 
 		for _, p := range wsMonitorSSHRequest.Params {
 			wg.Add(1)
-			go func(port int, host string, user string, passwd string) {
-				err := ssh.M.RegisterSSHListener(port, host, user, passwd, conn.Key, getSSHListener(conn))
+			go func(key string, port int, host string, user string, events []string, intervals map[string]int) {
 				result := WSMonitorSSHResponseResult{
+					Key:  key,
 					Port: port,
 					Host: host,
 					User: user,
 				}
-				if err == nil {
-					result.Monitor = true
-					result.Error = nil
-				} else {
-					errText := err.Error()
+				userSSH, auth, resErr := resolveUserSSH(conn.User(), key, port, host, user)
+				if resErr != nil {
 					result.Monitor = false
-					result.Error = &ResponseError{
-						Code:    400,
-						Message: errText,
+					result.Error = resErr
+				} else {
+					result.Key, result.Port, result.Host, result.User = userSSH.Key, userSSH.Port, userSSH.Host, userSSH.User
+					if err := ssh.M.RegisterSSHListener(userSSH.Port, userSSH.Host, userSSH.User, auth, conn.Key, getSSHListener(conn, events, mergeIntervals(userSSH, intervals))); err != nil {
+						result.Monitor = false
+						result.Error = connectErrorHelper(err)
+					} else {
+						verifiedHelper(userSSH)
+						result.Monitor = true
+						result.Error = nil
 					}
 				}
 				m.Lock()
@@ -368,13 +645,55 @@ func handleRequest(conn *wsocket.Connect, msg []byte) {
 				m.Unlock()
 				wg.Done()
 				logger.L.Debugf("done %d %s %s", port, host, user)
-			}(p.Port, p.Host, p.User, p.Passwd)
+			}(p.Key, p.Port, p.Host, p.User, p.Events, p.Intervals)
 		}
 		wg.Wait()
 		if wsResponseBytes, ok := messageJsonStringifyHelper(wsMonitorSSHResponse); ok {
 			conn.WriteMessage(wsResponseBytes)
 			logger.L.Debugf("send to wsocket %s", string(wsResponseBytes))
 		}
+	case "ssh.updateSubscription":
+		wsMonitorSSHRequest := &WSMonitorSSHRequest{}
+		if ok := messageJsonParseHelper(id, conn, msg, wsMonitorSSHRequest); !ok {
+			return
+		}
+		wsMonitorSSHResponse := &WSMonitorSSHResponse{
+			ResponseHead: ResponseHead{
+				Id:    *wsMonitorSSHRequest.Id,
+				Error: nil,
+			},
+			Result: make([]WSMonitorSSHResponseResult, 0),
+		}
+		for _, p := range wsMonitorSSHRequest.Params {
+			result := WSMonitorSSHResponseResult{
+				Key:  p.Key,
+				Port: p.Port,
+				Host: p.Host,
+				User: p.User,
+			}
+			userSSH, _, resErr := resolveUserSSH(conn.User(), p.Key, p.Port, p.Host, p.User)
+			if resErr != nil {
+				result.Monitor = false
+				result.Error = resErr
+			} else {
+				result.Key, result.Port, result.Host, result.User = userSSH.Key, userSSH.Port, userSSH.Host, userSSH.User
+				if err := ssh.M.UpdateSSHListener(userSSH.Port, userSSH.Host, userSSH.User, conn.Key, getSSHListener(conn, p.Events, mergeIntervals(userSSH, p.Intervals))); err != nil {
+					result.Monitor = false
+					result.Error = &ResponseError{
+						Code:    404,
+						Message: err.Error(),
+					}
+				} else {
+					result.Monitor = true
+					result.Error = nil
+				}
+			}
+			wsMonitorSSHResponse.Result = append(wsMonitorSSHResponse.Result, result)
+		}
+		if wsResponseBytes, ok := messageJsonStringifyHelper(wsMonitorSSHResponse); ok {
+			conn.WriteMessage(wsResponseBytes)
+			logger.L.Debugf("send to wsocket %s", string(wsResponseBytes))
+		}
 	case "ssh.stopMonitor":
 		wsUnMonitorSSHRequest := &WSUnMonitorSSHRequest{}
 		if ok := messageJsonParseHelper(id, conn, msg, wsUnMonitorSSHRequest); !ok {
@@ -388,14 +707,7 @@ func handleRequest(conn *wsocket.Connect, msg []byte) {
 			Result: make([]WSUnMonitorSSHResponseResult, 0),
 		}
 		for _, p := range wsUnMonitorSSHRequest.Params {
-			ssh.M.RemoveSSHListener(p.Port, p.Host, p.User, conn.Key)
-			result := WSUnMonitorSSHResponseResult{
-				Port:      p.Port,
-				Host:      p.Host,
-				User:      p.User,
-				UnMonitor: true,
-				Error:     nil,
-			}
+			result := unMonitorHelper(conn, p.Key, p.Port, p.Host, p.User, ssh.M.RemoveSSHListener)
 			wsUnMonitorSSHResponse.Result = append(wsUnMonitorSSHResponse.Result, result)
 		}
 		if wsResponseBytes, ok := messageJsonStringifyHelper(wsUnMonitorSSHResponse); ok {
@@ -405,6 +717,34 @@ func handleRequest(conn *wsocket.Connect, msg []byte) {
 	}
 }
 
+func handleAuth(id string, conn *wsocket.Connect, msg []byte) {
+	wsAuthRequest := &WSAuthRequest{}
+	if ok := messageJsonParseHelper(id, conn, msg, wsAuthRequest); !ok {
+		return
+	}
+	username, err := parseToken(wsAuthRequest.Params.Token)
+	if err != nil {
+		responseErrorHelper(id, conn, 401, err.Error())
+		return
+	}
+	if user := conn.User(); user != "" && user != username {
+		responseErrorHelper(id, conn, 403, fmt.Sprintf("%s already authenticated as %s", conn.Key, user))
+		return
+	}
+	conn.SetUser(username)
+	wsAuthResponse := &WSAuthResponse{
+		ResponseHead: ResponseHead{
+			Id:    id,
+			Error: nil,
+		},
+		Result: true,
+	}
+	if wsResponseBytes, ok := messageJsonStringifyHelper(wsAuthResponse); ok {
+		conn.WriteMessage(wsResponseBytes)
+		logger.L.Debugf("%s auth as %s", conn.Key, username)
+	}
+}
+
 func handleResponse(conn *wsocket.Connect, msg []byte) {
 	logger.L.Debugf("recv response : %s", string(msg))
 }
@@ -15,11 +15,36 @@ type MessageHandler func(conn *Connect, msg []byte)
 type CloseHandler func(conn *Connect)
 type ErrorHandler func(conn *Connect, err error)
 
+// Subprotocol is echoed back when the client carries its token in Sec-WebSocket-Protocol
+const Subprotocol = "Argusyes"
+
 type Connect struct {
-	Key     string
-	conn    *websocket.Conn
-	m       sync.Mutex
-	manager *Manager
+	Key       string
+	conn      *websocket.Conn
+	m         sync.Mutex
+	manager   *Manager
+	user      string
+	userMutex sync.RWMutex
+}
+
+// User returns the authenticated user name, empty before authentication
+func (c *Connect) User() string {
+	c.userMutex.RLock()
+	defer c.userMutex.RUnlock()
+	return c.user
+}
+
+func (c *Connect) SetUser(user string) {
+	c.userMutex.Lock()
+	defer c.userMutex.Unlock()
+	c.user = user
+}
+
+func (c *Connect) Close() {
+	err := c.conn.Close()
+	if err != nil {
+		logger.L.Debugf("websocket close %s fail : %v", c.Key, err)
+	}
 }
 
 func (c *Connect) WriteMessage(data []byte) {
@@ -63,9 +88,11 @@ var WsocketManager = newManager()
 var wsUpgrader = websocket.Upgrader{
 	ReadBufferSize:  4096,
 	WriteBufferSize: 4096,
+	Subprotocols:    []string{Subprotocol},
 }
 
-func (m *Manager) HandleNewConnect(w http.ResponseWriter, r *http.Request) {
+// HandleNewConnect upgrade the request, user is the name authenticated before upgrade or empty
+func (m *Manager) HandleNewConnect(w http.ResponseWriter, r *http.Request, user string) {
 	conn, err := wsUpgrader.Upgrade(w, r, nil)
 	id := uuid.New()
 	key := fmt.Sprintf("%s:%s", conn.RemoteAddr().String(), id.String())
@@ -77,6 +104,7 @@ func (m *Manager) HandleNewConnect(w http.ResponseWriter, r *http.Request) {
 		Key:     key,
 		conn:    conn,
 		manager: m,
+		user:    user,
 	}
 	m.websocketMap.Set(key, c)
 	logger.L.Debugf("websocket connected from : %s", key)